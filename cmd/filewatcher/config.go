@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/masterserver"
+	"github.com/matarc/filewatcher/nodewatcher"
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/storage"
+)
+
+// configCommand runs the `config` command and returns the exit code of the executable.
+// `config validate` and `config schema` are handled by `validateCommand` and `schemaCommand`,
+// otherwise it prints the configuration of the component named by the first argument, built
+// from the flags that follow it.
+func configCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return validateCommand(args[1:])
+		case "schema":
+			return schemaCommand(args[1:])
+		}
+	}
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	address := flags.String("address", "", "Address in the form `host:port` on which to listen (masterserver and storage only)")
+	storageAddress := flags.String("storageAddress", "", "Address in the form `host:port` to dial to query the storage server (masterserver and nodewatcher only)")
+	id := flags.String("id", "", "Id for the client (nodewatcher only)")
+	dbpath := flags.String("dbpath", "mydb.bolt", "`Path` to the database (storage only)")
+	dir := flags.String("dir", "", "`Path` to the directory that must be watched (nodewatcher only)")
+	monitorAddress := flags.String("monitorAddress", "", "Address in the form `host:port` on which to serve metrics (storage and nodewatcher only)")
+	certFile := flags.String("certFile", "", "`Path` to the TLS certificate, enables HTTPS (masterserver only)")
+	keyFile := flags.String("keyFile", "", "`Path` to the TLS private key (masterserver only)")
+	tlsMinVersion := flags.String("tlsMinVersion", "", "Minimum TLS `version` accepted [1.0|1.1|1.2|1.3] (masterserver only)")
+	redirectAddr := flags.String("redirectAddress", "", "Address in the form `host:port` on which to redirect HTTP requests to HTTPS (masterserver only)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s config [masterserver|nodewatcher|storage] [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s config validate [-component name] <file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s config schema [masterserver|nodewatcher|storage]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+	component := args[0]
+	flags.Parse(args[1:])
+
+	var cfg interface{}
+	switch component {
+	case "masterserver":
+		srv := &masterserver.Server{Address: *address, StorageAddress: *storageAddress}
+		if *certFile != "" {
+			srv.TLS = &masterserver.TLSConfig{
+				CertFile:        *certFile,
+				KeyFile:         *keyFile,
+				MinVersion:      *tlsMinVersion,
+				RedirectAddress: *redirectAddr,
+			}
+		}
+		cfg = srv
+	case "nodewatcher":
+		cfg = &nodewatcher.Client{StorageAddress: *storageAddress, Id: *id, Dir: *dir, MonitorAddress: *monitorAddress}
+	case "storage":
+		cfg = &storage.Server{Address: *address, DbPath: *dbpath, MonitorAddress: *monitorAddress}
+	default:
+		flags.Usage()
+		return 2
+	}
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	var out bytes.Buffer
+	json.Indent(&out, buf, "", "\t")
+	out.WriteTo(os.Stdout)
+	return 0
+}
+
+// validateCommand checks a configuration file and prints every problem found, prefixed by the
+// line where it was found.
+// The component is guessed from the name of the file unless `-component` is given.
+// It returns the exit code of the executable : 0 if the file is valid, 1 otherwise.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	name := flags.String("component", "", "Validate the file as the configuration of `[masterserver|nodewatcher|storage]`, guessed from the name of the file by default")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s config validate [-component name] <file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	if *name == "" {
+		*name = strings.SplitN(filepath.Base(path), ".", 2)[0]
+	}
+	cmp := findComponent(*name)
+	if cmp == nil {
+		fmt.Fprintf(os.Stderr, "Can't tell which component '%s' configures, use -component\n", path)
+		return 2
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	errs := shared.ValidateConfig(data, cmp.newRunnable())
+	for _, err := range errs {
+		if err.Field == "" {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, err.Line, err.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s : %s\n", path, err.Line, err.Field, err.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Printf("'%s' is a valid %s configuration\n", path, cmp.name)
+	return 0
+}
+
+// schemaCommand prints the JSON Schema of the configuration of a component.
+// It returns the exit code of the executable.
+func schemaCommand(args []string) int {
+	if len(args) != 1 || findComponent(args[0]) == nil {
+		fmt.Fprintf(os.Stderr, "Usage : %s config schema [masterserver|nodewatcher|storage]\n", os.Args[0])
+		return 2
+	}
+	cmp := findComponent(args[0])
+	err := shared.PrintConfig(shared.Schema(cmp.newRunnable(), cmp.name+" configuration"))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
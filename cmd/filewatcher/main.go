@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/masterserver"
+	"github.com/matarc/filewatcher/nodewatcher"
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/storage"
+)
+
+// component is one of the elements of filewatcher that can be run by the executable.
+type component struct {
+	name           string
+	defaultCfgPath string
+	newRunnable    func() shared.Runnable
+}
+
+// components lists the elements of filewatcher in the order in which they are started by `all`.
+var components = []*component{
+	{
+		name:           "storage",
+		defaultCfgPath: "storage.conf",
+		newRunnable:    func() shared.Runnable { return new(storage.Server) },
+	},
+	{
+		name:           "masterserver",
+		defaultCfgPath: "masterserver.conf",
+		newRunnable:    func() shared.Runnable { return new(masterserver.Server) },
+	},
+	{
+		name:           "nodewatcher",
+		defaultCfgPath: "nodewatcher.conf",
+		newRunnable:    func() shared.Runnable { return new(nodewatcher.Client) },
+	},
+}
+
+// findComponent returns the component called `name`, or nil if there is none.
+func findComponent(name string) *component {
+	for _, cmp := range components {
+		if cmp.name == name {
+			return cmp
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage : %s <command> [flags]
+
+Commands :
+  nodewatcher   Watch a directory and send the list of its files to storage
+  storage       Store the lists sent by the nodewatchers
+  masterserver  Serve the lists kept by storage through a REST API
+  all           Run storage, masterserver and nodewatcher in a single process
+  config        Print a configuration file for one of the components
+
+Run '%s <command> -help' to display the flags of a command.
+`, os.Args[0], os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "config":
+		os.Exit(configCommand(args))
+	case "all":
+		os.Exit(allCommand(args))
+	case "help", "-help", "-h", "--help":
+		usage()
+		os.Exit(0)
+	}
+	cmp := findComponent(command)
+	if cmp == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(componentCommand(cmp, args))
+}
+
+// componentCommand runs `cmp` alone and returns the exit code of the executable.
+func componentCommand(cmp *component, args []string) int {
+	flags := flag.NewFlagSet(cmp.name, flag.ExitOnError)
+	cfgPath := flags.String("config", cmp.defaultCfgPath, "`Path` to configuration file")
+	shutdownTimeout := flags.Duration("shutdownTimeout", shared.DefaultShutdownTimeout, "Maximum `duration` to wait for work in flight to complete when stopping")
+	strict := flags.Bool("strict", false, "Fail if the configuration file can't be read or contains unknown fields")
+	printConfig := flags.Bool("print-config", false, "Print the effective configuration and exit")
+	showSecrets := flags.Bool("show-secrets", false, "Print tokens and passwords with -print-config instead of hiding them")
+	cfg := &shared.Config{Component: cmp.name}
+	cfg.Flags(flags, "", cmp.newRunnable())
+	flags.Parse(args)
+	cfg.Path, cfg.Strict = *cfgPath, *strict
+	instances := []*instance{{cmp: cmp, cfg: cfg}}
+	if *printConfig {
+		return printConfigs(instances, *showSecrets)
+	}
+	return run(instances, *shutdownTimeout)
+}
+
+// allCommand runs all components in a single process and returns the exit code of the executable.
+// It is meant for development, each component still reads its own configuration file and its
+// fields can be overridden with flags prefixed by the name of the component, as in `-storage.address`.
+func allCommand(args []string) int {
+	flags := flag.NewFlagSet("all", flag.ExitOnError)
+	cfgPaths := make([]*string, len(components))
+	instances := make([]*instance, len(components))
+	for i, cmp := range components {
+		cfgPaths[i] = flags.String(cmp.name+"Config", cmp.defaultCfgPath, "`Path` to the configuration file of "+cmp.name)
+		instances[i] = &instance{cmp: cmp, cfg: &shared.Config{Component: cmp.name}}
+		instances[i].cfg.Flags(flags, cmp.name+".", cmp.newRunnable())
+	}
+	shutdownTimeout := flags.Duration("shutdownTimeout", shared.DefaultShutdownTimeout, "Maximum `duration` to wait for work in flight to complete when stopping")
+	strict := flags.Bool("strict", false, "Fail if a configuration file can't be read or contains unknown fields")
+	printConfig := flags.Bool("print-config", false, "Print the effective configuration of every component and exit")
+	showSecrets := flags.Bool("show-secrets", false, "Print tokens and passwords with -print-config instead of hiding them")
+	flags.Parse(args)
+	for i, in := range instances {
+		in.cfg.Path, in.cfg.Strict = *cfgPaths[i], *strict
+	}
+	if *printConfig {
+		return printConfigs(instances, *showSecrets)
+	}
+	return run(instances, *shutdownTimeout)
+}
+
+// printConfigs prints the effective configuration of `instances`, after all layers have been
+// applied, and returns the exit code of the executable.
+// A single instance is printed as is, several instances are printed as an object keyed by the
+// names of their components.
+// Secrets such as tokens and passwords are replaced by `***` unless `showSecrets` is true.
+func printConfigs(instances []*instance, showSecrets bool) int {
+	// Keep `stdout` for the configuration.
+	log.SetInfoOutput(os.Stderr)
+	cfgs := make(map[string]interface{})
+	for _, in := range instances {
+		r := in.cmp.newRunnable()
+		err := in.cfg.Load(r)
+		var cfg interface{} = r
+		if err == nil && !showSecrets {
+			cfg, err = shared.RedactSecrets(r)
+		}
+		if err != nil {
+			log.Errorf("%s : %s", in.cmp.name, err)
+			return 1
+		}
+		cfgs[in.cmp.name] = cfg
+	}
+	var err error
+	if len(instances) == 1 {
+		err = shared.PrintConfig(cfgs[instances[0].cmp.name])
+	} else {
+		err = shared.PrintConfig(cfgs)
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
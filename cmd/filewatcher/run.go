@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/shared"
+)
+
+// instance is a running component.
+type instance struct {
+	cmp *component
+	cfg *shared.Config
+	srv shared.Runnable
+}
+
+// start loads the configuration of the instance and runs it.
+// The error that made the instance fail afterwards is sent on `failCh`.
+// It returns an error if the instance couldn't be started.
+func (in *instance) start(failCh chan<- error) error {
+	in.srv = in.cmp.newRunnable()
+	err := in.cfg.Load(in.srv)
+	if err != nil {
+		return err
+	}
+	err = in.srv.Run(context.Background())
+	if err != nil {
+		return err
+	}
+	go func(srv shared.Runnable) {
+		<-srv.Done()
+		// `Done` is also closed when the instance is stopped, which isn't a failure.
+		if srv.Err() != nil {
+			failCh <- fmt.Errorf("%s : %s", in.cmp.name, srv.Err())
+		}
+	}(in.srv)
+	return nil
+}
+
+// stop stops the instance, giving it `timeout` to complete the work in flight.
+// It returns an error if the work in flight couldn't be completed in time.
+func (in *instance) stop(timeout time.Duration) error {
+	if in.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := in.srv.Stop(ctx)
+	if err != nil {
+		log.Errorf("%s : %s", in.cmp.name, err)
+	}
+	return err
+}
+
+// reload applies the configuration file of the instance again.
+// Instances that can't apply the changes in place are stopped and started again.
+// It returns an error if the instance had to be restarted and couldn't be started again.
+func (in *instance) reload(timeout time.Duration, failCh chan<- error) error {
+	log.Infof("Reloading configuration '%s'", in.cfg.Path)
+	cfg := in.cmp.newRunnable()
+	err := in.cfg.Load(cfg)
+	if err != nil {
+		// The running configuration is kept.
+		log.Errorf("Can't reload '%s' : %s", in.cfg.Path, err)
+		return nil
+	}
+	if r, ok := in.srv.(shared.Reloadable); ok {
+		err = r.Reload(cfg)
+		if err == nil {
+			return nil
+		}
+		if err != shared.ErrRestartRequired {
+			// The running configuration is kept.
+			log.Errorf("Can't reload '%s' : %s", in.cfg.Path, err)
+			return nil
+		}
+		log.Infof("The new configuration of %s requires a restart", in.cmp.name)
+	}
+	in.stop(timeout)
+	return in.start(failCh)
+}
+
+// run starts `instances` in order and keeps them running until the process receives a signal
+// asking it to terminate or until one of them fails.
+// `SIGUSR1` reopens the log files and reloads the configuration of every instance.
+// Instances are stopped in the reverse order in which they were started, each one is given
+// `timeout` to complete its work in flight.
+// It returns the exit code of the executable : 0 if every instance completed its work in flight,
+// 1 otherwise.
+func run(instances []*instance, timeout time.Duration) int {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+	failCh := make(chan error, len(instances))
+
+	stopAll := func() int {
+		code := 0
+		for i := len(instances) - 1; i >= 0; i-- {
+			if instances[i].stop(timeout) != nil {
+				code = 1
+			}
+		}
+		return code
+	}
+
+	for _, in := range instances {
+		err := in.start(failCh)
+		if err != nil {
+			log.Errorf("%s : %s", in.cmp.name, err)
+			stopAll()
+			return 1
+		}
+	}
+	for {
+		select {
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGUSR1:
+				err := log.Reopen()
+				if err != nil {
+					log.With("error", err).Error("Can't reopen the log files")
+				}
+				for _, in := range instances {
+					err := in.reload(timeout, failCh)
+					if err != nil {
+						log.Errorf("%s : %s", in.cmp.name, err)
+						stopAll()
+						return 1
+					}
+				}
+			case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+				// Terminate the program, the exit code tells whether the work in flight was completed.
+				log.Info(sig)
+				return stopAll()
+			}
+		case err := <-failCh:
+			// A background goroutine failed, the instance can't keep working.
+			log.Errorf("Stopping after a fatal error in %s", err)
+			stopAll()
+			return 1
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Package health implements the `/healthz` and `/readyz` endpoints shared by all the components.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Check is a named condition that must hold for a component to be ready.
+// `Check` returns nil if the condition holds, or an error explaining why it doesn't.
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+// Result is the outcome of a `Check`.
+type Result struct {
+	Name  string
+	Ok    bool
+	Error string `json:",omitempty"`
+}
+
+// Report is the json document sent by the endpoints.
+type Report struct {
+	Status string
+	Checks []Result `json:",omitempty"`
+}
+
+// Run runs all `checks` and returns the report, as well as true if all checks passed.
+func Run(checks []Check) (Report, bool) {
+	report := Report{Status: "ok"}
+	ok := true
+	for _, check := range checks {
+		result := Result{Name: check.Name, Ok: true}
+		if err := check.Check(); err != nil {
+			result.Ok = false
+			result.Error = err.Error()
+			ok = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	if !ok {
+		report.Status = "fail"
+	}
+	return report, ok
+}
+
+// Handler returns a handler that runs `checks` on every request and answers with a json report.
+// The status code is 200 if all checks passed, 503 otherwise.
+func Handler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, ok := Run(checks)
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Register adds `/healthz` and `/readyz` to `mux`.
+// `/healthz` only tells that the process is alive, `/readyz` runs `checks`.
+func Register(mux *http.ServeMux, checks ...Check) {
+	mux.Handle("/healthz", Handler())
+	mux.Handle("/readyz", Handler(checks...))
+}
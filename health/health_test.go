@@ -0,0 +1,52 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+
+	failing := fmt.Errorf("database is closed")
+	checks := []Check{
+		{Name: "listener", Check: func() error { return nil }},
+		{Name: "database", Check: func() error { return failing }},
+	}
+	w = httptest.NewRecorder()
+	Handler(checks...).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusServiceUnavailable, w.Code)
+	}
+	report := Report{}
+	err := json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "fail" {
+		t.Fatalf("Status should be 'fail', instead is '%s'", report.Status)
+	}
+	if len(report.Checks) != 2 {
+		t.Fatalf("Report should have '2' checks, instead has '%d'", len(report.Checks))
+	}
+	if !report.Checks[0].Ok {
+		t.Fatalf("Check 'listener' should be ok")
+	}
+	if report.Checks[1].Ok || report.Checks[1].Error != "database is closed" {
+		t.Fatalf("Check 'database' should fail with 'database is closed', instead is '%v'", report.Checks[1])
+	}
+
+	failing = nil
+	w = httptest.NewRecorder()
+	Handler(checks...).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileConfig makes messages of every level be written to a file instead of `stdout` and `stderr`.
+type FileConfig struct {
+	// Path is the path of the file, created if it doesn't exist and appended to otherwise.
+	Path string
+	// MaxSize is the size in megabytes above which the file is rotated, 0 disables rotation.
+	MaxSize int
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them.
+	MaxBackups int
+	// Compress makes rotated files be compressed with gzip.
+	Compress bool
+}
+
+// Check returns the name of the first invalid setting of `cfg` along with the problem found,
+// or an empty name and nil if `cfg` is valid.
+func (cfg *FileConfig) Check() (string, error) {
+	if cfg.Path == "" {
+		return "Path", fmt.Errorf("can't be empty")
+	}
+	if cfg.MaxSize < 0 {
+		return "MaxSize", fmt.Errorf("can't be negative")
+	}
+	if cfg.MaxBackups < 0 {
+		return "MaxBackups", fmt.Errorf("can't be negative")
+	}
+	return "", nil
+}
+
+// retryDelay is the time waited before trying to open the log file again after it failed.
+const retryDelay = 10 * time.Second
+
+// rotatingFile is a writer appending to the file `cfg.Path`.
+// Once the file grows above `cfg.MaxSize`, it is renamed `<Path>.1`, previous backups being
+// renamed `<Path>.2`, `<Path>.3` and so on, and a new file is created.
+// Messages that can't be written to the file are written to `fallback` instead.
+type rotatingFile struct {
+	mu       sync.Mutex
+	cfg      FileConfig
+	file     *os.File
+	size     int64
+	retry    time.Time
+	failed   bool
+	closed   bool
+	fallback io.Writer
+}
+
+var (
+	filesMu sync.Mutex
+	// files are the files opened by the package, reopened by `Reopen`.
+	files = make(map[*rotatingFile]bool)
+)
+
+// NewFile returns a writer to the file described by `cfg`, for output that must be kept apart
+// from the messages of the log, such as an access log.
+// It rotates the file like the log file, writes to `stderr` as long as the file can't be written,
+// and is reopened by `Reopen`.
+func NewFile(cfg FileConfig) io.WriteCloser {
+	mu.RLock()
+	defer mu.RUnlock()
+	return newRotatingFile(cfg, errOutput)
+}
+
+// newRotatingFile returns a writer to the file described by `cfg`, writing to `fallback` as long
+// as the file can't be opened.
+func newRotatingFile(cfg FileConfig, fallback io.Writer) *rotatingFile {
+	f := &rotatingFile{cfg: cfg, fallback: fallback}
+	f.open()
+	filesMu.Lock()
+	files[f] = true
+	filesMu.Unlock()
+	return f
+}
+
+// Reopen closes the files opened by the package, the log file and the files returned by `NewFile`,
+// and opens them again, so that external tools such as logrotate can move them away.
+// It returns the first error met, the files that can't be opened are written to `stderr` instead.
+func Reopen() (err error) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	for f := range files {
+		if ferr := f.Reopen(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// open opens the file, or schedules another attempt if it fails.
+// It must be called with `mu` held, or before `f` is shared.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		var info os.FileInfo
+		info, err = file.Stat()
+		if err != nil {
+			file.Close()
+		} else {
+			f.file, f.size, f.failed = file, info.Size(), false
+			return nil
+		}
+	}
+	f.retry = time.Now().Add(retryDelay)
+	f.fail(err)
+	return err
+}
+
+// fail reports `err` on `fallback`, only once until the file can be written again.
+func (f *rotatingFile) fail(err error) {
+	if f.failed {
+		return
+	}
+	f.failed = true
+	fmt.Fprintf(f.fallback, "Can't write to log file '%s', writing to stderr instead : %s\n", f.cfg.Path, err)
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return f.fallback.Write(p)
+	}
+	if f.file == nil && time.Now().After(f.retry) {
+		f.open()
+	}
+	if f.file != nil && f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > int64(f.cfg.MaxSize)<<20 {
+		err := f.rotate()
+		if err != nil {
+			f.fail(err)
+		}
+	}
+	if f.file == nil {
+		return f.fallback.Write(p)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		f.fail(err)
+		return f.fallback.Write(p)
+	}
+	f.failed = false
+	return n, nil
+}
+
+// Reopen closes the file and opens it again, so that a file moved by an external tool is
+// replaced by a new one.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.close()
+	return f.open()
+}
+
+// Close closes the file, further messages are written to `fallback`.
+func (f *rotatingFile) Close() error {
+	filesMu.Lock()
+	delete(files, f)
+	filesMu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return f.close()
+}
+
+func (f *rotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// backup returns the name of the `n`-th rotated file.
+func (f *rotatingFile) backup(n int, compressed bool) string {
+	name := f.cfg.Path + "." + strconv.Itoa(n)
+	if compressed {
+		name += ".gz"
+	}
+	return name
+}
+
+// exists returns the name of the `n`-th rotated file, compressed or not, or an empty string if
+// there is none.
+func (f *rotatingFile) exists(n int) string {
+	for _, compressed := range []bool{false, true} {
+		if _, err := os.Stat(f.backup(n, compressed)); err == nil {
+			return f.backup(n, compressed)
+		}
+	}
+	return ""
+}
+
+// rotate renames the file `<Path>.1` after shifting the previous backups and opens a new file.
+// Backups above `MaxBackups` are removed.
+// It must be called with `mu` held.
+func (f *rotatingFile) rotate() error {
+	f.close()
+	last := 0
+	for f.exists(last+1) != "" {
+		last++
+	}
+	for n := last; n >= 1; n-- {
+		name := f.exists(n)
+		if f.cfg.MaxBackups > 0 && n >= f.cfg.MaxBackups {
+			os.Remove(name)
+			continue
+		}
+		os.Rename(name, f.backup(n+1, name == f.backup(n, true)))
+	}
+	err := os.Rename(f.cfg.Path, f.backup(1, false))
+	if err == nil && f.cfg.Compress {
+		err = compress(f.backup(1, false), f.backup(1, true))
+	}
+	if oerr := f.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// compress writes the file `src` compressed with gzip to `dst` and removes `src`.
+func compress(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
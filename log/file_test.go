@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filewatcher.log")
+	var fallback bytes.Buffer
+	f := newRotatingFile(FileConfig{Path: path, MaxSize: 1, MaxBackups: 2, Compress: true}, &fallback)
+	defer f.Close()
+
+	chunk := bytes.Repeat([]byte("a"), 600<<10)
+	for i := 0; i < 4; i++ {
+		_, err = f.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each write but the first one rotates the file, only two backups are kept.
+	for _, name := range []string{path, path + ".1.gz", path + ".2.gz"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == path && info.Size() != int64(len(chunk)) {
+			t.Fatalf("Size of '%s' should be '%d', instead is '%d'", name, len(chunk), info.Size())
+		}
+	}
+	if _, err = os.Stat(path + ".3.gz"); !os.IsNotExist(err) {
+		t.Fatalf("'%s' should have been removed", path+".3.gz")
+	}
+	file, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, chunk) {
+		t.Fatalf("'%s' should contain the rotated file, instead contains %d bytes", path+".1.gz", len(data))
+	}
+
+	// The file is moved away, as logrotate does, and reopened.
+	err = os.Rename(path, path+".moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("reopened\n"))
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "reopened\n" {
+		t.Fatalf("'%s' should be 'reopened', instead is '%s'", path, data)
+	}
+	if fallback.Len() != 0 {
+		t.Fatalf("Nothing should be written to the fallback, instead is '%s'", fallback.String())
+	}
+}
+
+func TestRotatingFileFallback(t *testing.T) {
+	var fallback bytes.Buffer
+	f := newRotatingFile(FileConfig{Path: "/nonexistent/filewatcher.log"}, &fallback)
+	defer f.Close()
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	lines := strings.Split(strings.TrimSpace(fallback.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "Can't write to log file") {
+		t.Fatalf("The failure should be reported once before the messages, instead fallback is '%s'", fallback.String())
+	}
+	if lines[1] != "first" || lines[2] != "second" {
+		t.Fatalf("Messages should be written to the fallback, instead fallback is '%s'", fallback.String())
+	}
+}
@@ -1,30 +1,323 @@
+// Package log writes leveled messages carrying key-value fields, encoded either as text or as
+// json.
+// Messages of level debug and info are written to `stdout`, warnings and errors to `stderr`,
+// unless a component configures a log file.
+// The level of a message is compared to the level of the package that logged it, which is, in
+// order of precedence : the level set for that package in `Config.Packages`, the level of the
+// component if the package is one, or the most verbose level configured otherwise.
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func Error(v ...interface{}) {
-	fmt.Fprintln(os.Stderr, format("Info", ""), v)
+// Level is the severity of a message.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named `name`, one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown level '%s', should be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Config is the logging configuration of a component.
+type Config struct {
+	// Level is the minimum level of the messages logged by the component, info by default.
+	Level string
+	// Format is either text, the default, or json. It applies to every component of the process.
+	Format string
+	// Packages overrides the level of some packages, keyed by the name of their directory.
+	Packages map[string]string
+	// File makes messages be written to a file. Like `Format`, it applies to every component of
+	// the process.
+	File *FileConfig
+}
+
+// Check returns the name of the first invalid setting of `cfg` along with the problem found,
+// or an empty name and nil if `cfg` is valid.
+func (cfg *Config) Check() (string, error) {
+	if cfg.Level != "" {
+		if _, err := ParseLevel(cfg.Level); err != nil {
+			return "Level", err
+		}
+	}
+	if cfg.Format != "" && cfg.Format != TextFormat && cfg.Format != JSONFormat {
+		return "Format", fmt.Errorf("Unknown format '%s', should be %s or %s", cfg.Format, TextFormat, JSONFormat)
+	}
+	for pkg, level := range cfg.Packages {
+		if _, err := ParseLevel(level); err != nil {
+			return "Packages", fmt.Errorf("'%s' : %s", pkg, err)
+		}
+	}
+	if cfg.File != nil {
+		if field, err := cfg.File.Check(); err != nil {
+			return "File." + field, err
+		}
+	}
+	return "", nil
+}
+
+// levels are the levels configured for a component.
+type levels struct {
+	level    Level
+	packages map[string]Level
+}
+
+var (
+	mu         sync.RWMutex
+	components           = make(map[string]levels)
+	format               = TextFormat
+	infoOutput io.Writer = os.Stdout
+	errOutput  io.Writer = os.Stderr
+	// sink is the log file, if any, configured by the component `sinkOwner`.
+	sink      *rotatingFile
+	sinkOwner string
+)
+
+// Configure applies `cfg` to the messages logged by the package of `component`.
+// A nil `cfg` restores the defaults of the component.
+// It returns an error, leaving the configuration untouched, if `cfg` is invalid.
+func Configure(component string, cfg *Config) error {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+	if field, err := cfg.Check(); err != nil {
+		return fmt.Errorf("Log.%s : %s", field, err)
+	}
+	l := levels{level: InfoLevel, packages: make(map[string]Level)}
+	if cfg.Level != "" {
+		l.level, _ = ParseLevel(cfg.Level)
+	}
+	for pkg, name := range cfg.Packages {
+		l.packages[pkg], _ = ParseLevel(name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	components[component] = l
+	if cfg.Format != "" {
+		format = cfg.Format
+	}
+	switch {
+	case cfg.File != nil && (sink == nil || sink.cfg != *cfg.File):
+		if sink != nil {
+			sink.Close()
+		}
+		sink, sinkOwner = newRotatingFile(*cfg.File, errOutput), component
+	case cfg.File == nil && sink != nil && sinkOwner == component:
+		sink.Close()
+		sink = nil
+	}
+	return nil
+}
+
+// SetOutputs makes debug and info messages be written to `info`, and warnings and errors to `err`.
+func SetOutputs(info, err io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	infoOutput, errOutput = info, err
+}
+
+// SetInfoOutput makes debug and info messages be written to `w`, which is `os.Stdout` by default.
+func SetInfoOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	infoOutput = w
+}
+
+// enabled returns true if messages of level `level` logged by the package `pkg` are written.
+// When several components configure the same package, the most verbose level wins.
+// It must be called with `mu` held.
+func enabled(level Level, pkg string) bool {
+	min, found := ErrorLevel, false
+	for _, l := range components {
+		if pl, ok := l.packages[pkg]; ok && pl <= min {
+			min, found = pl, true
+		}
+	}
+	if found {
+		return level >= min
+	}
+	if l, ok := components[pkg]; ok {
+		return level >= l.level
+	}
+	min = InfoLevel
+	for _, l := range components {
+		if l.level < min {
+			min = l.level
+		}
+	}
+	return level >= min
+}
+
+// Logger logs messages carrying its key-value fields.
+type Logger struct {
+	fields []interface{}
+}
+
+var std = new(Logger)
+
+// With returns a logger adding the key-value pairs `keyvals` to every message.
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
 }
 
-func Errorf(f string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format("Info", " ")+f+"\n", v)
+// With returns a logger adding the key-value pairs `keyvals` to the fields of `l`.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{fields: fields}
 }
 
-func Info(v ...interface{}) {
-	fmt.Fprintln(os.Stdout, format("Info", ""), v)
+func (l *Logger) Debug(v ...interface{})            { l.output(DebugLevel, sprint(v...)) }
+func (l *Logger) Debugf(f string, v ...interface{}) { l.output(DebugLevel, fmt.Sprintf(f, v...)) }
+func (l *Logger) Info(v ...interface{})             { l.output(InfoLevel, sprint(v...)) }
+func (l *Logger) Infof(f string, v ...interface{})  { l.output(InfoLevel, fmt.Sprintf(f, v...)) }
+func (l *Logger) Warn(v ...interface{})             { l.output(WarnLevel, sprint(v...)) }
+func (l *Logger) Warnf(f string, v ...interface{})  { l.output(WarnLevel, fmt.Sprintf(f, v...)) }
+func (l *Logger) Error(v ...interface{})            { l.output(ErrorLevel, sprint(v...)) }
+func (l *Logger) Errorf(f string, v ...interface{}) { l.output(ErrorLevel, fmt.Sprintf(f, v...)) }
+
+func Debug(v ...interface{})            { std.output(DebugLevel, sprint(v...)) }
+func Debugf(f string, v ...interface{}) { std.output(DebugLevel, fmt.Sprintf(f, v...)) }
+func Info(v ...interface{})             { std.output(InfoLevel, sprint(v...)) }
+func Infof(f string, v ...interface{})  { std.output(InfoLevel, fmt.Sprintf(f, v...)) }
+func Warn(v ...interface{})             { std.output(WarnLevel, sprint(v...)) }
+func Warnf(f string, v ...interface{})  { std.output(WarnLevel, fmt.Sprintf(f, v...)) }
+func Error(v ...interface{})            { std.output(ErrorLevel, sprint(v...)) }
+func Errorf(f string, v ...interface{}) { std.output(ErrorLevel, fmt.Sprintf(f, v...)) }
+
+// sprint formats `v` like `fmt.Println` does, without the trailing newline.
+func sprint(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+// output writes `msg` if `level` is enabled for the package of the caller.
+// It must be called directly by the exported functions and methods so that the caller is found.
+func (l *Logger) output(level Level, msg string) {
+	_, file, line, ok := runtime.Caller(2)
+	pkg, caller := "", "???"
+	if ok {
+		pkg = filepath.Base(filepath.Dir(file))
+		caller = fmt.Sprintf("%s/%s:%d", pkg, filepath.Base(file), line)
+	}
+	mu.RLock()
+	if !enabled(level, pkg) {
+		mu.RUnlock()
+		return
+	}
+	w, f := infoOutput, format
+	if level >= WarnLevel {
+		w = errOutput
+	}
+	if sink != nil {
+		w = sink
+	}
+	mu.RUnlock()
+
+	var buf bytes.Buffer
+	if f == JSONFormat {
+		encodeJSON(&buf, time.Now(), level, caller, msg, l.fields)
+	} else {
+		encodeText(&buf, time.Now(), level, caller, msg, l.fields)
+	}
+	writeMu.Lock()
+	w.Write(buf.Bytes())
+	writeMu.Unlock()
+}
+
+// writeMu keeps messages written concurrently from being interleaved.
+var writeMu sync.Mutex
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// pairs calls `fn` for every key-value pair of `fields`.
+// A key without a value is given the value `(MISSING)`.
+func pairs(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fn(key, value)
+	}
 }
 
-func Infof(f string, v ...interface{}) {
-	fmt.Fprintf(os.Stdout, format("Info", " ")+f+"\n", v)
+// encodeText writes a message in the form `time LEVEL caller message key=value`.
+// Values containing spaces, quotes or `=` are quoted.
+func encodeText(buf *bytes.Buffer, t time.Time, level Level, caller, msg string, fields []interface{}) {
+	fmt.Fprintf(buf, "%s %-5s %s %s", t.Format(timeFormat), strings.ToUpper(level.String()), caller, msg)
+	pairs(fields, func(key string, value interface{}) {
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(buf, " %s=%s", key, s)
+	})
+	buf.WriteByte('\n')
 }
 
-func format(prefix, suffix string) string {
-	_, file, line, _ := runtime.Caller(2)
-	file = filepath.Base(file)
-	return fmt.Sprintf("%s %s:%d:%s", prefix, file, line, suffix)
+// encodeJSON writes a message as a json object on a single line, its fields following the
+// `time`, `level`, `caller` and `msg` keys.
+// Values that can't be encoded as json are written as strings.
+func encodeJSON(buf *bytes.Buffer, t time.Time, level Level, caller, msg string, fields []interface{}) {
+	buf.WriteByte('{')
+	write := func(key string, value interface{}) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	write("time", t.Format(timeFormat))
+	write("level", level.String())
+	write("caller", caller)
+	write("msg", msg)
+	pairs(fields, write)
+	buf.WriteString("}\n")
 }
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture resets the configuration and returns the buffers that receive the messages.
+func capture() (*bytes.Buffer, *bytes.Buffer) {
+	info, errs := new(bytes.Buffer), new(bytes.Buffer)
+	mu.Lock()
+	components = make(map[string]levels)
+	format = TextFormat
+	mu.Unlock()
+	SetOutputs(info, errs)
+	return info, errs
+}
+
+func TestLevels(t *testing.T) {
+	defer SetOutputs(os.Stdout, os.Stderr)
+	info, errs := capture()
+	Debug("hidden")
+	Info("shown")
+	Error("failure")
+	if strings.Contains(info.String(), "hidden") {
+		t.Fatalf("Debug messages should be hidden by default, instead output is '%s'", info)
+	}
+	if !strings.Contains(info.String(), "INFO  log/log_test.go") || !strings.Contains(info.String(), "shown") {
+		t.Fatalf("Info messages should be written to the info output, instead output is '%s'", info)
+	}
+	if !strings.Contains(errs.String(), "ERROR log/log_test.go") {
+		t.Fatalf("Error messages should be written with the ERROR level, instead output is '%s'", errs)
+	}
+
+	// This package is configured as a component
+	info, errs = capture()
+	err := Configure("log", &Config{Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Info("hidden")
+	Warn("shown")
+	if info.Len() != 0 || !strings.Contains(errs.String(), "WARN") {
+		t.Fatalf("Only warnings should be written, instead outputs are '%s' and '%s'", info, errs)
+	}
+
+	// A package override wins over the level of the component
+	info, _ = capture()
+	err = Configure("other", &Config{Level: "error", Packages: map[string]string{"log": "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Debug("shown")
+	if !strings.Contains(info.String(), "DEBUG") {
+		t.Fatalf("Debug messages should be written once the package is overridden, instead output is '%s'", info)
+	}
+
+	err = Configure("other", &Config{Level: "verbose"})
+	if err == nil {
+		t.Fatalf("Configure should return an error on an unknown level")
+	}
+}
+
+func TestFields(t *testing.T) {
+	defer SetOutputs(os.Stdout, os.Stderr)
+	info, _ := capture()
+	With("node", "my node", "paths", 2).With("error", fmt.Errorf("broken")).Infof("Listed %s", "node")
+	line := info.String()
+	if !strings.Contains(line, `Listed node node="my node" paths=2 error=broken`) {
+		t.Fatalf("Fields should follow the message, instead output is '%s'", line)
+	}
+
+	info, _ = capture()
+	err := Configure("log", &Config{Format: JSONFormat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	With("node", "my", "odd").Info("Listed", "node")
+	var msg map[string]interface{}
+	err = json.Unmarshal(info.Bytes(), &msg)
+	if err != nil {
+		t.Fatalf("Output should be json, instead is '%s' : %s", info, err)
+	}
+	for key, value := range map[string]interface{}{"level": "info", "msg": "Listed node", "node": "my", "odd": "(MISSING)"} {
+		if msg[key] != value {
+			t.Fatalf("%s should be '%v', instead is '%v'", key, value, msg[key])
+		}
+	}
+}
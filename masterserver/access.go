@@ -0,0 +1,187 @@
+package masterserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/trace"
+)
+
+const (
+	CommonFormat   = "common"
+	CombinedFormat = "combined"
+	JSONFormat     = "json"
+)
+
+// AccessLogConfig makes masterserver write a line for every request it serves.
+type AccessLogConfig struct {
+	// Format is either common, the default, combined or json.
+	// common and combined are the Common and Combined Log Formats, followed by the id of the
+	// request and its duration in milliseconds.
+	Format string
+	// File is the file the access log is written to, `stdout` is used if it is unset.
+	File *log.FileConfig
+}
+
+// check returns the name of the first invalid setting of `cfg` along with the problem found.
+func (cfg *AccessLogConfig) check() (string, error) {
+	switch cfg.Format {
+	case "", CommonFormat, CombinedFormat, JSONFormat:
+	default:
+		return "Format", fmt.Errorf("Unknown format '%s', should be one of %s, %s or %s",
+			cfg.Format, CommonFormat, CombinedFormat, JSONFormat)
+	}
+	if cfg.File != nil {
+		if field, err := cfg.File.Check(); err != nil {
+			return "File." + field, err
+		}
+	}
+	return "", nil
+}
+
+// accessLogger writes the access log in `format` to `w`.
+type accessLogger struct {
+	format string
+	w      io.Writer
+}
+
+// newAccessLogger returns the access logger described by `cfg`, or nil if `cfg` is nil.
+func newAccessLogger(cfg *AccessLogConfig) *accessLogger {
+	if cfg == nil {
+		return nil
+	}
+	al := &accessLogger{format: cfg.Format, w: os.Stdout}
+	if al.format == "" {
+		al.format = CommonFormat
+	}
+	if cfg.File != nil {
+		al.w = log.NewFile(*cfg.File)
+	}
+	return al
+}
+
+// Close closes the file of the access log, if any.
+func (al *accessLogger) Close() error {
+	if al == nil {
+		return nil
+	}
+	if closer, ok := al.w.(io.Closer); ok && al.w != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// accessEntry is what is known about a request once it has been served.
+type accessEntry struct {
+	start     time.Time
+	duration  time.Duration
+	remote    string
+	principal string
+	request   string
+	r         *http.Request
+	status    int
+	bytes     int64
+}
+
+// write writes `e` as a single line.
+func (al *accessLogger) write(e *accessEntry) {
+	var buf bytes.Buffer
+	if al.format == JSONFormat {
+		json.NewEncoder(&buf).Encode(struct {
+			Time      time.Time
+			Remote    string
+			Principal string `json:",omitempty"`
+			Method    string
+			Path      string
+			Proto     string
+			Status    int
+			Bytes     int64
+			Duration  float64
+			RequestId string
+			Referer   string `json:",omitempty"`
+			UserAgent string `json:",omitempty"`
+		}{e.start, e.remote, e.principal, e.r.Method, e.r.URL.RequestURI(), e.r.Proto, e.status, e.bytes,
+			e.duration.Seconds(), e.request, e.r.Referer(), e.r.UserAgent()})
+	} else {
+		principal, size := dash(e.principal), "-"
+		if strings.ContainsAny(principal, " \t\"") {
+			principal = quote(principal)
+		}
+		if e.bytes > 0 {
+			size = strconv.FormatInt(e.bytes, 10)
+		}
+		fmt.Fprintf(&buf, "%s - %s [%s] %s %d %s", e.remote, principal, e.start.Format("02/Jan/2006:15:04:05 -0700"),
+			quote(e.r.Method+" "+e.r.URL.RequestURI()+" "+e.r.Proto), e.status, size)
+		if al.format == CombinedFormat {
+			fmt.Fprintf(&buf, " %s %s", quote(dash(e.r.Referer())), quote(dash(e.r.UserAgent())))
+		}
+		fmt.Fprintf(&buf, " %s %.3f\n", e.request, float64(e.duration)/float64(time.Millisecond))
+	}
+	al.w.Write(buf.Bytes())
+}
+
+// dash returns `s`, or `-` if it is empty.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote returns `s` between double quotes, escaping the double quotes, backslashes and control
+// characters it contains so that a line can't be forged.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// logAccess is a middleware that writes a line to the access log for every request, once it
+// has been served.
+// The principal is set by `authenticate` through the entry carried by the context of the request.
+func (srv *Server) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		al := srv.accessLogger()
+		if al == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := &accessEntry{start: time.Now(), remote: r.RemoteAddr, request: trace.IdFromContext(r.Context()), r: r}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			e.remote = host
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessKey, e)))
+		e.duration, e.status, e.bytes = time.Since(e.start), rec.status, rec.bytes
+		al.write(e)
+	})
+}
+
+// setPrincipal records `cred` as the principal of `r` in the access log.
+func setPrincipal(r *http.Request, cred *Credential) {
+	if e, ok := r.Context().Value(accessKey).(*accessEntry); ok {
+		e.principal = cred.principal()
+	}
+}
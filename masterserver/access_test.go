@@ -0,0 +1,73 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matarc/filewatcher/trace"
+)
+
+func Test_logAccess(t *testing.T) {
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18445"
+	srv.Credentials = []Credential{{Name: "web team", Token: "secret", Nodes: []string{"*"}}}
+	srv.Init()
+	var buf bytes.Buffer
+	router := srv.router()
+
+	for format, expected := range map[string]string{
+		CommonFormat:   `^192\.0\.2\.1 - "web team" \[.+\] "GET /list\?a=b HTTP/1\.1" 502 \d+ my-request \d+\.\d{3}\n$`,
+		CombinedFormat: `^192\.0\.2\.1 - "web team" \[.+\] "GET /list\?a=b HTTP/1\.1" 502 \d+ "-" "my \\"agent\\"" my-request \d+\.\d{3}\n$`,
+	} {
+		buf.Reset()
+		srv.access = &accessLogger{format: format, w: &buf}
+		r := httptest.NewRequest("GET", "/list?a=b", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("User-Agent", `my "agent"`)
+		r.Header.Set(trace.Header, "my-request")
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		if !regexp.MustCompile(expected).MatchString(buf.String()) {
+			t.Fatalf("%s access log should match '%s', instead is '%s'", format, expected, buf.String())
+		}
+	}
+
+	buf.Reset()
+	srv.access = &accessLogger{format: JSONFormat, w: &buf}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil))
+	var entry struct {
+		Remote, Principal, Method, Path, RequestId string
+		Status                                     int
+	}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Access log should be json, instead is '%s' : %s", buf.String(), err)
+	}
+	if entry.Remote != "192.0.2.1" || entry.Principal != "" || entry.Method != "GET" || entry.Path != "/list" ||
+		entry.Status != 401 || !trace.ValidId(entry.RequestId) {
+		t.Fatalf("Access log of an unauthorized request is wrong : '%s'", buf.String())
+	}
+
+	// The access log is disabled by default.
+	srv.access = nil
+	buf.Reset()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("Nothing should be written, instead access log is '%s'", buf.String())
+	}
+}
+
+func Test_quote(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":                  `""`,
+		"GET / HTTP/1.1":    `"GET / HTTP/1.1"`,
+		`a "b" \c`:          `"a \"b\" \\c"`,
+		"forged\n1.2.3.4 -": `"forged\x0a1.2.3.4 -"`,
+	} {
+		if quote(s) != expected {
+			t.Fatalf("quote('%s') should be '%s', instead is '%s'", s, expected, quote(s))
+		}
+	}
+}
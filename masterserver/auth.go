@@ -0,0 +1,174 @@
+package masterserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/shared"
+)
+
+// Credential grants access to the REST API to whoever presents `Token` as a bearer token, or
+// `Username` and `Password` through HTTP basic authentication.
+// `Nodes` lists the ids of the nodewatchers the credential is allowed to see, each entry can be
+// a glob such as `web-*`. A credential without any entry in `Nodes` doesn't see any node.
+// `ManageBaselines` allows the credential to pin and delete baselines, and `ManageSnapshots` to
+// take and delete snapshots if the credential also sees every node.
+// `Token` and `Password` are left out of the configuration printed by `-print-config`.
+type Credential struct {
+	Name            string
+	Token           string `secret:"true"`
+	Username        string
+	Password        string `secret:"true"`
+	Nodes           []string
+	ManageBaselines bool
+	ManageSnapshots bool
+}
+
+// validate returns an error if the credential can't be presented, if it has a `Username` without
+// a `Password`, which would let an empty password in, or if one of its `Nodes` is not a valid glob.
+func (c *Credential) validate() error {
+	if c.Token == "" && c.Username == "" {
+		return fmt.Errorf("credential '%s' has neither a Token nor a Username", c.Name)
+	}
+	if c.Username != "" && c.Password == "" {
+		return fmt.Errorf("credential '%s' has a Username but no Password", c.Name)
+	}
+	for _, pattern := range c.Nodes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("credential '%s' : '%s' : %s", c.Name, pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkCredentials returns the error of the first credential of `creds` that isn't valid.
+// Credentials are checked whether or not the configuration is loaded in strict mode, as an invalid
+// credential could let anyone in.
+func checkCredentials(creds []Credential) error {
+	for i := range creds {
+		if err := creds[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type contextKey int
+
+const (
+	credentialKey contextKey = iota
+	accessKey
+)
+
+// principal returns the name the credential is known by, its `Name` or its `Username` if it has
+// no name.
+func (c *Credential) principal() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Username
+}
+
+// unrestricted returns true if the credential sees every node, which is the case if one of the
+// entries of `Nodes` is `*`.
+func (c *Credential) unrestricted() bool {
+	for _, pattern := range c.Nodes {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the node `id` matches one of the entries of `Nodes`.
+func (c *Credential) Allows(id string) bool {
+	for _, pattern := range c.Nodes {
+		if ok, err := path.Match(pattern, id); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate is a middleware that rejects every request that doesn't carry one of the
+// credentials defined in `Credentials`.
+// The credential that was used is stored in the context of the request.
+// If no credential is defined, authentication is disabled and every request goes through.
+func (srv *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds := srv.credentials()
+		if len(creds) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cred := findCredential(creds, r)
+		if cred == nil {
+			log.With("remote", r.RemoteAddr, "path", r.URL.Path).Warn("Unauthorized request")
+			w.Header().Add("WWW-Authenticate", `Bearer realm="filewatcher"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="filewatcher"`)
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		setPrincipal(r, cred)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), credentialKey, cred)))
+	})
+}
+
+// findCredential returns the credential of `creds` matching the `Authorization` header of `r`,
+// or nil if there is none.
+// A credential without a `Password` never matches a basic authentication, nor one without a
+// `Token` a bearer token.
+func findCredential(creds []Credential, r *http.Request) *Credential {
+	if username, password, ok := r.BasicAuth(); ok {
+		for i := range creds {
+			cred := &creds[i]
+			if cred.Username != "" && cred.Password != "" && secureCompare(cred.Username, username) &&
+				secureCompare(cred.Password, password) {
+				return cred
+			}
+		}
+		return nil
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		token := strings.TrimSpace(header[len("Bearer "):])
+		for i := range creds {
+			cred := &creds[i]
+			if cred.Token != "" && secureCompare(cred.Token, token) {
+				return cred
+			}
+		}
+	}
+	return nil
+}
+
+// secureCompare compares `a` and `b` in constant time.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// credential returns the credential used to authenticate `r`, or nil if authentication is disabled.
+func credential(r *http.Request) *Credential {
+	cred, _ := r.Context().Value(credentialKey).(*Credential)
+	return cred
+}
+
+// allowedNodes returns the nodes of `nodes` that the credential used by `r` is allowed to see.
+func allowedNodes(r *http.Request, nodes []shared.Node) []shared.Node {
+	cred := credential(r)
+	if cred == nil {
+		return nodes
+	}
+	allowed := []shared.Node{}
+	for _, node := range nodes {
+		if cred.Allows(node.Id) {
+			allowed = append(allowed, node)
+		}
+	}
+	return allowed
+}
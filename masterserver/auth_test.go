@@ -0,0 +1,190 @@
+package masterserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestAllows(t *testing.T) {
+	cred := &Credential{Nodes: []string{"web-*", "db1"}}
+	if !cred.Allows("web-1") {
+		t.Fatalf("'web-1' should be allowed by 'web-*'")
+	}
+	if !cred.Allows("db1") {
+		t.Fatalf("'db1' should be allowed")
+	}
+	if cred.Allows("db2") {
+		t.Fatalf("'db2' should not be allowed")
+	}
+	cred = new(Credential)
+	if cred.Allows("web-1") {
+		t.Fatalf("A credential without nodes should not allow anything")
+	}
+}
+
+func TestCredentialValidate(t *testing.T) {
+	for _, test := range []struct {
+		cred  Credential
+		valid bool
+	}{
+		{Credential{Token: "s3cr3t"}, true},
+		{Credential{Username: "ops", Password: "s3cr3t"}, true},
+		{Credential{Name: "empty"}, false},
+		{Credential{Name: "ops", Username: "ops"}, false},
+		{Credential{Token: "s3cr3t", Nodes: []string{"web-["}}, false},
+	} {
+		if err := test.cred.validate(); (err == nil) != test.valid {
+			t.Fatalf("validate of '%+v' should be valid '%t', instead returns '%v'", test.cred, test.valid, err)
+		}
+	}
+	srv := &Server{Credentials: []Credential{{Name: "ops", Username: "ops"}}}
+	errs := srv.Validate()
+	if len(errs) != 1 || errs[0].Field != "Credentials" {
+		t.Fatalf("Validate should report 'Credentials', instead reports '%v'", errs)
+	}
+}
+
+func Test_authenticate(t *testing.T) {
+	var got *Credential
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = credential(r)
+	})
+	srv := new(Server)
+	srv.Init()
+
+	// No credentials, authentication is disabled
+	w := httptest.NewRecorder()
+	srv.authenticate(handler).ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+	if got != nil {
+		t.Fatalf("No credential should be set when authentication is disabled")
+	}
+
+	srv.Credentials = []Credential{
+		{Name: "team1", Token: "secret", Nodes: []string{"*"}},
+		{Name: "team2", Username: "user", Password: "pass", Nodes: []string{"*"}},
+	}
+	w = httptest.NewRecorder()
+	srv.authenticate(handler).ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	srv.authenticate(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	srv.authenticate(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+	if got == nil || got.Name != "team1" {
+		t.Fatalf("Credential should be 'team1', instead is '%v'", got)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.SetBasicAuth("user", "pass")
+	srv.authenticate(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+	if got == nil || got.Name != "team2" {
+		t.Fatalf("Credential should be 'team2', instead is '%v'", got)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.SetBasicAuth("user", "wrong")
+	srv.authenticate(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func Test_allowedNodes(t *testing.T) {
+	nodes := []shared.Node{{Id: "web-1"}, {Id: "web-2"}, {Id: "db-1"}}
+	srv := new(Server)
+	srv.Credentials = []Credential{{Token: "secret", Nodes: []string{"web-*"}}}
+	var allowed []shared.Node
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed = allowedNodes(r, nodes)
+	})
+	r := httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	srv.authenticate(handler).ServeHTTP(httptest.NewRecorder(), r)
+	if len(allowed) != 2 {
+		t.Fatalf("allowed should have '2' nodes, instead has '%d'", len(allowed))
+	}
+	if allowed[0].Id != "web-1" || allowed[1].Id != "web-2" {
+		t.Fatalf("allowed should be 'web-1' and 'web-2', instead is '%v'", allowed)
+	}
+}
+
+func TestEmptyPassword(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	cfgPath := filepath.Join(rootDir, "masterserver.json")
+	err = ioutil.WriteFile(cfgPath, []byte(`{"Credentials": [{"Username": "ops", "Nodes": ["*"]}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The configuration isn't loaded in strict mode, so the credential isn't checked by Load.
+	srv := new(Server)
+	cfg := &shared.Config{Path: cfgPath, Component: "masterserver", Environ: []string{}}
+	err = cfg.Load(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/list", nil)
+	r.SetBasicAuth("ops", "")
+	srv.authenticate(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+	err = srv.Run(context.Background())
+	if err == nil {
+		srv.Stop(context.Background())
+		t.Fatalf("Run should refuse a credential without a password")
+	}
+	err = srv.Reload(&Server{Address: srv.Address, Credentials: srv.Credentials})
+	if err == nil {
+		t.Fatalf("Reload should refuse a credential without a password")
+	}
+}
+
+func TestCredentialRedacted(t *testing.T) {
+	srv := &Server{Credentials: []Credential{
+		{Name: "team1", Token: "secret", Nodes: []string{"*"}},
+		{Name: "team2", Username: "user", Password: "pass"},
+	}}
+	redacted, err := shared.RedactSecrets(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := redacted.(*Server).Credentials
+	if creds[0].Token != "***" || creds[1].Password != "***" || creds[1].Username != "user" {
+		t.Fatalf("Token and Password should be replaced by '***', instead credentials are '%+v'", creds)
+	}
+}
@@ -0,0 +1,172 @@
+package masterserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+	// cacheStream is the result of a list too large to be cached, streamed from storage.
+	cacheStream = "stream"
+	// defaultMaxPaths is the number of paths a cached list can hold if `MaxPaths` is unset.
+	defaultMaxPaths = 100000
+	// tooLargeRetry is the minimum time after which a list too large to be cached is loaded again.
+	tooLargeRetry = time.Minute
+)
+
+// CacheConfig sets how long the list received from storage is reused.
+type CacheConfig struct {
+	// TTL is the number of seconds during which the list is served without asking storage,
+	// 0 asks storage on every request.
+	TTL int
+	// MaxStale is the number of seconds after `TTL` during which the list may still be served
+	// when storage can't be reached. -1 serves it however old it is, 0 never serves it.
+	MaxStale int
+	// MaxPaths is the maximum number of paths of a list kept in memory, 0 uses the default of
+	// 100000. Larger lists are streamed from storage on every request and are never served stale.
+	MaxPaths int
+}
+
+// maxPaths returns the maximum number of paths of a cached list.
+func (cfg CacheConfig) maxPaths() int {
+	if cfg.MaxPaths == 0 {
+		return defaultMaxPaths
+	}
+	return cfg.MaxPaths
+}
+
+// tooLargeRetry returns how long a list too large to be cached is streamed before masterserver
+// tries to cache it again.
+func (cfg CacheConfig) tooLargeRetry() time.Duration {
+	if ttl := time.Duration(cfg.TTL) * time.Second; ttl > tooLargeRetry {
+		return ttl
+	}
+	return tooLargeRetry
+}
+
+// check returns the name of the first invalid setting of `cfg` along with the problem found.
+func (cfg *CacheConfig) check() (string, error) {
+	if cfg.TTL < 0 {
+		return "TTL", fmt.Errorf("can't be negative")
+	}
+	if cfg.MaxStale < -1 {
+		return "MaxStale", fmt.Errorf("should be -1 or more")
+	}
+	if cfg.MaxPaths < 0 {
+		return "MaxPaths", fmt.Errorf("can't be negative")
+	}
+	return "", nil
+}
+
+// listing is a list received from storage, along with the revision read just before it.
+// As lists can only change after the revision is read, the list is at least as recent as the
+// revision.
+type listing struct {
+	nodes    []shared.Node
+	revision shared.Revision
+}
+
+// fetch is a call to storage in flight, shared by all the requests that missed the cache.
+type fetch struct {
+	done chan struct{}
+	list listing
+	err  error
+}
+
+// listCache is the last list received from storage.
+// Concurrent misses are collapsed into a single call to storage.
+// Once a list is too large to be cached, `get` returns `errTooLarge` without calling storage until
+// `setTooLarge` tells it that the list got smaller, or for `TTL` seconds but at least
+// `tooLargeRetry`, after which it tries to load the list again.
+type listCache struct {
+	mu         sync.Mutex
+	list       listing
+	fetched    time.Time
+	valid      bool
+	tooLarge   bool
+	tooLargeAt time.Time
+	inFlight   *fetch
+}
+
+// fresh returns the cached list and true if it is younger than `cfg.TTL`.
+func (c *listCache) fresh(cfg CacheConfig) (listing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list, c.valid && time.Since(c.fetched) < time.Duration(cfg.TTL)*time.Second
+}
+
+// get returns the list, from the cache if it is younger than `cfg.TTL` and from `load` otherwise.
+// If `load` fails, the cached list is returned if it is younger than `cfg.TTL + cfg.MaxStale`.
+// It also returns whether the list was a hit, a miss or stale, and the age of the list.
+// It returns the error of `load` if it failed, along with the stale list if it can be served, or
+// the error of `ctx` if it is done before the list is loaded.
+func (c *listCache) get(ctx context.Context, cfg CacheConfig, load func(context.Context) (listing, error)) (listing, string, time.Duration, error) {
+	c.mu.Lock()
+	if c.valid && time.Since(c.fetched) < time.Duration(cfg.TTL)*time.Second {
+		list, age := c.list, time.Since(c.fetched)
+		c.mu.Unlock()
+		return list, cacheHit, age, nil
+	}
+	if c.tooLarge && time.Since(c.tooLargeAt) < cfg.tooLargeRetry() {
+		c.mu.Unlock()
+		return listing{}, "", 0, errTooLarge
+	}
+	f := c.inFlight
+	if f == nil {
+		f = &fetch{done: make(chan struct{})}
+		c.inFlight = f
+		// The call isn't bound to the request that started it, as other requests wait for it,
+		// but it keeps its trace.
+		go c.load(f, trace.NewContext(context.Background(), trace.FromContext(ctx)), load)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return listing{}, "", 0, ctx.Err()
+	}
+	if f.err == nil {
+		return f.list, cacheMiss, 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	age := time.Since(c.fetched)
+	if c.valid && (cfg.MaxStale < 0 || age < time.Duration(cfg.TTL+cfg.MaxStale)*time.Second) {
+		return c.list, cacheStale, age, f.err
+	}
+	return listing{}, "", 0, f.err
+}
+
+// load calls `load` and stores the list it returns, waking up the requests waiting for `f`.
+func (c *listCache) load(f *fetch, ctx context.Context, load func(context.Context) (listing, error)) {
+	f.list, f.err = load(ctx)
+	c.mu.Lock()
+	if f.err == nil {
+		c.list, c.fetched, c.valid = f.list, time.Now(), true
+	} else if f.err == errTooLarge {
+		// The previous list is dropped as well, large lists are never kept in memory.
+		c.list, c.valid, c.tooLarge, c.tooLargeAt = listing{}, false, true, time.Now()
+	}
+	c.inFlight = nil
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// setTooLarge records whether the list is too large to be cached.
+func (c *listCache) setTooLarge(tooLarge bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tooLarge = tooLarge
+	if tooLarge {
+		c.tooLargeAt = time.Now()
+	}
+}
@@ -0,0 +1,159 @@
+package masterserver
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func Test_listCache(t *testing.T) {
+	var c listCache
+	var calls int32
+	var fail atomic.Value
+	fail.Store(false)
+	release := make(chan struct{})
+	load := func(ctx context.Context) (listing, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if fail.Load().(bool) {
+			return listing{}, fmt.Errorf("storage is down")
+		}
+		return listing{nodes: []shared.Node{{Id: "1"}}}, nil
+	}
+	cfg := CacheConfig{TTL: 60, MaxStale: 0}
+
+	// Concurrent misses make a single call.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			list, state, _, err := c.get(context.Background(), cfg, load)
+			if err != nil || state != cacheMiss || len(list.nodes) != 1 {
+				t.Errorf("get should be a miss, instead is '%s' : %v", state, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("load should have been called once, instead was called %d times", calls)
+	}
+
+	_, state, _, err := c.get(context.Background(), cfg, load)
+	if err != nil || state != cacheHit || calls != 1 {
+		t.Fatalf("get should be a hit, instead is '%s' : %v", state, err)
+	}
+
+	// Once the TTL is over, stale data is only served within MaxStale.
+	fail.Store(true)
+	c.fetched = time.Now().Add(-90 * time.Second)
+	_, state, _, err = c.get(context.Background(), cfg, load)
+	if err == nil || state != "" {
+		t.Fatalf("get should fail, instead is '%s'", state)
+	}
+	cfg.MaxStale = 60
+	list, state, age, err := c.get(context.Background(), cfg, load)
+	if err == nil || state != cacheStale || len(list.nodes) != 1 || age < 90*time.Second {
+		t.Fatalf("get should be stale, instead is '%s' : %v", state, err)
+	}
+	cfg.MaxStale = -1
+	c.fetched = time.Now().Add(-24 * time.Hour)
+	_, state, _, _ = c.get(context.Background(), cfg, load)
+	if state != cacheStale {
+		t.Fatalf("get should be stale, instead is '%s'", state)
+	}
+}
+
+func Test_listCacheTooLarge(t *testing.T) {
+	var c listCache
+	var calls int32
+	var tooLarge atomic.Value
+	tooLarge.Store(true)
+	load := func(ctx context.Context) (listing, error) {
+		atomic.AddInt32(&calls, 1)
+		if tooLarge.Load().(bool) {
+			return listing{}, errTooLarge
+		}
+		return listing{nodes: []shared.Node{{Id: "1"}}}, nil
+	}
+	cfg := CacheConfig{TTL: 60}
+
+	for i := 0; i < 2; i++ {
+		_, _, _, err := c.get(context.Background(), cfg, load)
+		if err != errTooLarge {
+			t.Fatalf("get should return '%s', instead returns '%v'", errTooLarge, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("load should have been called once, instead was called %d times", calls)
+	}
+
+	// Once the TTL is over, the list is loaded again and cached if it got smaller.
+	tooLarge.Store(false)
+	c.tooLargeAt = time.Now().Add(-90 * time.Second)
+	list, state, _, err := c.get(context.Background(), cfg, load)
+	if err != nil || state != cacheMiss || len(list.nodes) != 1 {
+		t.Fatalf("get should be a miss, instead is '%s' : %v", state, err)
+	}
+	_, state, _, err = c.get(context.Background(), cfg, load)
+	if err != nil || state != cacheHit || calls != 2 {
+		t.Fatalf("get should be a hit, instead is '%s' after %d calls : %v", state, calls, err)
+	}
+}
+
+func Test_listCacheTooLargeNoTTL(t *testing.T) {
+	var c listCache
+	var calls int32
+	load := func(ctx context.Context) (listing, error) {
+		atomic.AddInt32(&calls, 1)
+		return listing{}, errTooLarge
+	}
+	// Without a TTL, the list isn't loaded on every request only to be dropped again.
+	cfg := CacheConfig{TTL: 0}
+	for i := 0; i < 2; i++ {
+		_, _, _, err := c.get(context.Background(), cfg, load)
+		if err != errTooLarge {
+			t.Fatalf("get should return '%s', instead returns '%v'", errTooLarge, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("load should have been called once, instead was called %d times", calls)
+	}
+	// Once a stream finds that the list got smaller, it is loaded again.
+	c.setTooLarge(false)
+	c.get(context.Background(), cfg, load)
+	if calls != 2 {
+		t.Fatalf("load should have been called twice, instead was called %d times", calls)
+	}
+}
+
+func TestSendListCache(t *testing.T) {
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18482"
+	srv.Cache = &CacheConfig{TTL: 60, MaxStale: -1}
+	srv.Init()
+	srv.cache.list = listing{nodes: []shared.Node{{Id: "1", Files: []string{"/a"}}}}
+	srv.cache.fetched, srv.cache.valid = time.Now().Add(-5*time.Second), true
+
+	w := httptest.NewRecorder()
+	srv.SendList(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Header().Get("X-Cache") != cacheHit || w.Header().Get("Age") != "5" {
+		t.Fatalf("X-Cache and Age should be 'hit' and '5', instead are '%s' and '%s'", w.Header().Get("X-Cache"), w.Header().Get("Age"))
+	}
+
+	// Storage is down, the list is stale.
+	srv.cache.fetched = time.Now().Add(-65 * time.Second)
+	w = httptest.NewRecorder()
+	srv.SendList(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != 200 || w.Header().Get("X-Cache") != cacheStale || w.Header().Get("Age") != "65" {
+		t.Fatalf("X-Cache and Age should be 'stale' and '65', instead are '%s' and '%s'", w.Header().Get("X-Cache"), w.Header().Get("Age"))
+	}
+}
@@ -0,0 +1,79 @@
+package masterserver
+
+import (
+	"net/http"
+	"net/rpc"
+
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+// v2Diff is the comparison of the lists of two nodes, as sent by `/v2/diff`.
+type v2Diff struct {
+	A       string   `json:"a"`
+	B       string   `json:"b"`
+	Prefix  string   `json:"prefix"`
+	OnlyA   []string `json:"only_a"`
+	OnlyB   []string `json:"only_b"`
+	Changed []string `json:"changed"`
+}
+
+// isServerError returns true if `err` is the error `target` returned by the storage server.
+func isServerError(err, target error) bool {
+	serverErr, ok := err.(rpc.ServerError)
+	return ok && string(serverErr) == target.Error()
+}
+
+// DiffV2 compares the lists of the nodes given by the `a` and `b` query parameters and sends the
+// paths only on `a` and the paths only on `b`, restricted to the paths starting with the `prefix`
+// query parameter, in an `envelope` whose data is a `v2Diff`.
+// The comparison is paged like `/v2/list`, a page holding up to `limit` paths, and is done by
+// storage so that the lists are never loaded in masterserver.
+// Nodes the credential of the request isn't allowed to see are reported as unknown.
+func (srv *Server) DiffV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	query := r.URL.Query()
+	req := &shared.DiffRequest{RequestId: trace.IdFromContext(r.Context()), A: query.Get("a"), B: query.Get("b"), Prefix: query.Get("prefix")}
+	if req.A == "" || req.B == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Both a and b should be set")
+		return
+	}
+	var ok bool
+	req.Max, ok = pageLimit(w, r)
+	if !ok {
+		return
+	}
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+		return
+	}
+	req.After = cursor.After
+	if cred := credential(r); cred != nil && (!cred.Allows(req.A) || !cred.Allows(req.B)) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownNode.Error())
+		return
+	}
+
+	rev, err := srv.getRevision(r.Context())
+	diff := &shared.Diff{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.Diff", req, diff)
+	}
+	if isServerError(err, shared.ErrUnknownNode) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "compare the lists")
+		return
+	}
+	env := envelope{
+		Data: v2Diff{A: req.A, B: req.B, Prefix: req.Prefix,
+			OnlyA: nonNil(diff.OnlyA), OnlyB: nonNil(diff.OnlyB), Changed: nonNil(diff.Changed)},
+		Pagination: &pagination{Limit: req.Max, HasMore: !diff.Done},
+	}
+	if !diff.Done {
+		env.Pagination.NextCursor = encodeCursor(shared.ListCursor{After: diff.Next})
+	}
+	sendEnvelope(w, r, env, rev)
+}
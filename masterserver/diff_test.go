@@ -0,0 +1,101 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestDiffV2(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18494")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	for id, files := range map[string][]string{
+		"web-blue":  {"app/a", "app/b"},
+		"web-green": {"app/b", "app/c"},
+		"db-1":      {"app/a"},
+	} {
+		tr := &shared.Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, shared.Operation{Path: file, Event: shared.Create})
+		}
+		err = paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := &Server{StorageAddress: "localhost:18494", Credentials: []Credential{{Token: "web", Nodes: []string{"web-*"}}}}
+	srv.Init()
+	router := srv.router()
+	get := func(url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Authorization", "Bearer web")
+		router.ServeHTTP(w, r)
+		err := json.NewDecoder(w.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code
+	}
+
+	onlyA, onlyB, url := []string{}, []string{}, "/v2/diff?a=web-blue&b=web-green&limit=1"
+	for url != "" {
+		var env struct {
+			envelope
+			Data v2Diff `json:"data"`
+		}
+		if status := get(url, &env); status != http.StatusOK {
+			t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, status)
+		}
+		onlyA, onlyB = append(onlyA, env.Data.OnlyA...), append(onlyB, env.Data.OnlyB...)
+		url = ""
+		if env.Pagination.HasMore {
+			url = "/v2/diff?a=web-blue&b=web-green&limit=1&cursor=" + env.Pagination.NextCursor
+		}
+	}
+	if fmt.Sprint(onlyA, onlyB) != "[app/a] [app/c]" {
+		t.Fatalf("Diff should be '[app/a] [app/c]', instead is '%v %v'", onlyA, onlyB)
+	}
+
+	for url, code := range map[string]string{
+		"/v2/diff?a=web-blue":              codeBadRequest,
+		"/v2/diff?a=web-blue&b=db-1":       codeNotFound,
+		"/v2/diff?a=web-blue&b=web-purple": codeNotFound,
+	} {
+		var body apiError
+		get(url, &body)
+		if body.Error.Code != code {
+			t.Fatalf("Error of '%s' should have code '%s', instead is '%+v'", url, code, body.Error)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package masterserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+const (
+	// defaultDriftInterval is the number of seconds between two drift checks if `Interval` is unset.
+	defaultDriftInterval = 300
+	// maxBaselineBody is the maximum size of the body of `PUT /v2/baselines/{name}`, in bytes.
+	maxBaselineBody = 64 << 20
+)
+
+// DriftConfig sets the background check that compares the lists of the nodes with their
+// baselines and flags the nodes that drifted from them in `/v2/nodes`.
+type DriftConfig struct {
+	// Interval is the number of seconds between two checks, 0 uses the default of 300.
+	Interval int
+	// Threshold is the number of paths added and removed a node can have before it is flagged,
+	// 0 flags any drift.
+	Threshold int
+	// Baselines sets the baseline of the nodes, a node being compared to the first rule matching
+	// its id. Nodes matching no rule aren't checked.
+	Baselines []DriftBaseline
+}
+
+// DriftBaseline compares the nodes whose id matches one of `Nodes`, globs such as `web-*`, to the
+// baseline named `Baseline`.
+type DriftBaseline struct {
+	Nodes    []string
+	Baseline string
+}
+
+// interval returns the time between two checks.
+func (cfg DriftConfig) interval() time.Duration {
+	if cfg.Interval == 0 {
+		return defaultDriftInterval * time.Second
+	}
+	return time.Duration(cfg.Interval) * time.Second
+}
+
+// baseline returns the name of the baseline the node `id` is compared to, empty if none is set.
+func (cfg DriftConfig) baseline(id string) string {
+	for _, rule := range cfg.Baselines {
+		for _, pattern := range rule.Nodes {
+			if ok, err := path.Match(pattern, id); err == nil && ok {
+				return rule.Baseline
+			}
+		}
+	}
+	return ""
+}
+
+// check returns the name of the first invalid setting of `cfg` along with the problem found.
+func (cfg *DriftConfig) check() (string, error) {
+	if cfg.Interval < 0 {
+		return "Interval", fmt.Errorf("can't be negative")
+	}
+	if cfg.Threshold < 0 {
+		return "Threshold", fmt.Errorf("can't be negative")
+	}
+	for _, rule := range cfg.Baselines {
+		if err := shared.CheckBaselineName(rule.Baseline); err != nil {
+			return "Baselines", err
+		}
+		for _, pattern := range rule.Nodes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return "Baselines", fmt.Errorf("'%s' : %s", pattern, err)
+			}
+		}
+	}
+	return "", nil
+}
+
+// driftStatus is the result of the last check of a node.
+type driftStatus struct {
+	Baseline  string    `json:"baseline"`
+	Added     int       `json:"added"`
+	Removed   int       `json:"removed"`
+	Drifting  bool      `json:"drifting"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Error tells why the node couldn't be checked, such as its baseline not being pinned.
+	Error string `json:"error,omitempty"`
+}
+
+// driftStatuses holds the result of the last check of every node checked.
+type driftStatuses struct {
+	mu    sync.RWMutex
+	nodes map[string]driftStatus
+}
+
+// get returns the status of the node `id` and true if it was checked.
+func (ds *driftStatuses) get(id string) (driftStatus, bool) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	status, ok := ds.nodes[id]
+	return status, ok
+}
+
+// set replaces all the statuses with `nodes`.
+func (ds *driftStatuses) set(nodes map[string]driftStatus) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.nodes = nodes
+}
+
+func (srv *Server) driftingNodes() *metrics.Gauge {
+	return srv.metrics.Gauge("filewatcher_masterserver_drifting_nodes",
+		"Number of nodes whose drift from their baseline exceeds the threshold.")
+}
+
+// driftConfig returns the configuration of the drift check and false if it is disabled.
+func (srv *Server) driftConfig() (DriftConfig, bool) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if srv.Drift == nil {
+		return DriftConfig{}, false
+	}
+	return *srv.Drift, true
+}
+
+// callStorage sends the RPC `method` to the storage server within a span of the trace of `ctx`.
+// Failures to reach storage are counted, unlike the errors returned by the RPC itself.
+func (srv *Server) callStorage(ctx context.Context, method string, args, reply interface{}) error {
+	endSpan := trace.FromContext(ctx).Span(method)
+	err := srv.pool.Call(ctx, method, args, reply)
+	endSpan()
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		srv.storageFailures().Inc(method)
+	}
+	return err
+}
+
+// runDriftCheck checks the nodes against their baselines every `Drift.Interval`, reading the
+// configuration again before each check, until `done` is closed.
+// `Reload` wakes it up when `Drift` changes, so that a new configuration applies right away.
+func (srv *Server) runDriftCheck(done <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	for {
+		cfg, ok := srv.driftConfig()
+		if ok {
+			srv.checkDrift(ctx, cfg)
+		} else {
+			srv.drift.set(nil)
+			srv.driftingNodes().Set(0)
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(cfg.interval()):
+		case <-srv.driftCh:
+		}
+	}
+}
+
+// checkDrift compares the list of every node having a baseline in `cfg` with it, and records
+// the result in `srv.drift`.
+// The previous results are kept if storage can't be reached.
+func (srv *Server) checkDrift(ctx context.Context, cfg DriftConfig) {
+	start := time.Now()
+	nodes := []shared.NodeInfo{}
+	err := srv.callStorage(ctx, "Paths.Nodes", &struct{}{}, &nodes)
+	if err != nil {
+		log.With("error", err).Error("Can't get the nodes from storage to check their drift")
+		return
+	}
+	statuses, drifting := map[string]driftStatus{}, 0
+	for _, node := range nodes {
+		baseline := cfg.baseline(node.Id)
+		if baseline == "" {
+			continue
+		}
+		drift := &shared.Drift{}
+		err = srv.callStorage(ctx, "Paths.Drift", &shared.DriftRequest{Node: node.Id, Baseline: baseline, CountOnly: true}, drift)
+		if _, ok := err.(rpc.ServerError); err != nil && !ok {
+			log.With("error", err).Error("Can't check the drift of the nodes in storage")
+			return
+		}
+		status := driftStatus{Baseline: baseline, Added: drift.AddedCount, Removed: drift.RemovedCount, CheckedAt: time.Now().UTC()}
+		if err != nil {
+			log.With("node", node.Id, "baseline", baseline, "error", err).Warn("Can't check the drift of node")
+			status.Error = err.Error()
+		} else if status.Added+status.Removed > cfg.Threshold {
+			status.Drifting = true
+			drifting++
+		}
+		statuses[node.Id] = status
+	}
+	srv.drift.set(statuses)
+	srv.driftingNodes().Set(float64(drifting))
+	log.With("nodes", len(statuses), "drifting", drifting, "duration", time.Since(start)).Debug("Checked drift")
+}
+
+// v2Baseline is a baseline as sent by `/v2/baselines`.
+type v2Baseline struct {
+	Name      string    `json:"name"`
+	Node      string    `json:"node,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Paths     int       `json:"paths"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newV2Baseline returns `b` as sent by `/v2/baselines`.
+func newV2Baseline(b shared.Baseline) v2Baseline {
+	return v2Baseline{Name: b.Name, Node: b.Node, Owner: b.Owner, Paths: b.Paths, CreatedAt: b.Created}
+}
+
+// canSeeBaseline returns true if the credential `cred` is allowed to see the baseline `b`, which
+// is the case of the credentials allowed to see the node it was pinned from, or of the credential
+// that uploaded it if it was uploaded. Every baseline is seen if authentication is disabled.
+func canSeeBaseline(cred *Credential, b shared.Baseline) bool {
+	if cred == nil {
+		return true
+	}
+	if b.Node != "" {
+		return cred.Allows(b.Node)
+	}
+	return b.Owner != "" && b.Owner == cred.principal()
+}
+
+// getBaseline returns the baseline `name` and true if the credential of `r` is allowed to see it.
+// Otherwise it answers `r` with an error, `404 Not Found` if the baseline doesn't exist or can't be
+// seen, and returns false.
+func (srv *Server) getBaseline(w http.ResponseWriter, r *http.Request, name string) (shared.Baseline, bool) {
+	var baseline shared.Baseline
+	err := srv.callStorage(r.Context(), "Paths.Baseline", name, &baseline)
+	if isServerError(err, shared.ErrUnknownBaseline) || (err == nil && !canSeeBaseline(credential(r), baseline)) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownBaseline.Error())
+		return baseline, false
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "get the baseline")
+		return baseline, false
+	}
+	return baseline, true
+}
+
+// v2NodeInfo is a node as sent by `/v2/nodes`, along with the result of its last drift check.
+type v2NodeInfo struct {
+	Id    string       `json:"id"`
+	Paths int          `json:"paths"`
+	Drift *driftStatus `json:"drift,omitempty"`
+}
+
+// v2Drift is the drift of a node from a baseline, as sent by `/v2/nodes/{id}/drift`.
+type v2Drift struct {
+	Node     string   `json:"node"`
+	Baseline string   `json:"baseline"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+}
+
+// sendEnvelope sends `env` with the revisions `rev`, after setting its revision and generation
+// time.
+func sendEnvelope(w http.ResponseWriter, r *http.Request, env envelope, rev shared.Revision) {
+	env.Revision, env.GeneratedAt = revision(r, rev), time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(env)
+	if err != nil {
+		log.With("request", trace.IdFromContext(r.Context()), "error", err).Error("Can't send the response")
+	}
+}
+
+// storageUnavailable answers `r` with an error after `err` occurred while `doing` something in
+// storage.
+func storageUnavailable(w http.ResponseWriter, r *http.Request, err error, doing string) {
+	log.With("request", trace.IdFromContext(r.Context()), "error", err).Errorf("Can't %s in storage", doing)
+	writeError(w, r, http.StatusBadGateway, codeStorageUnavailable, "Server unreachable")
+}
+
+// ListNodes sends the nodes the credential of the request is allowed to see with the number of
+// paths in their lists and the result of their last drift check, in an `envelope` whose data is
+// an array of `v2NodeInfo`. Only the drifting nodes are sent if the `drifting` query parameter is
+// `true`.
+func (srv *Server) ListNodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	onlyDrifting := r.URL.Query().Get("drifting") == "true"
+	rev, err := srv.getRevision(r.Context())
+	nodes := []shared.NodeInfo{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.Nodes", &struct{}{}, &nodes)
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "get the nodes")
+		return
+	}
+	cred := credential(r)
+	result := []v2NodeInfo{}
+	for _, node := range nodes {
+		if cred != nil && !cred.Allows(node.Id) {
+			continue
+		}
+		info := v2NodeInfo{Id: node.Id, Paths: node.Paths}
+		if status, ok := srv.drift.get(node.Id); ok {
+			info.Drift = &status
+		}
+		if onlyDrifting && (info.Drift == nil || !info.Drift.Drifting) {
+			continue
+		}
+		result = append(result, info)
+	}
+	sendEnvelope(w, r, envelope{Data: result}, rev)
+}
+
+// DriftV2 sends the paths added to the list of the node of the URL and the paths removed from it
+// since the baseline given by the `baseline` query parameter, or the baseline set for the node by
+// `Drift.Baselines`, in an `envelope` whose data is a `v2Drift`.
+// The drift is paged like `/v2/list` and is computed by storage. Both the node and the baseline
+// must be seen by the credential of the request.
+func (srv *Server) DriftV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	query := r.URL.Query()
+	req := &shared.DriftRequest{RequestId: trace.IdFromContext(r.Context()), Node: mux.Vars(r)["id"], Baseline: query.Get("baseline")}
+	if req.Baseline == "" {
+		if cfg, ok := srv.driftConfig(); ok {
+			req.Baseline = cfg.baseline(req.Node)
+		}
+	}
+	if req.Baseline == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "baseline should be set, the node has none")
+		return
+	}
+	var ok bool
+	req.Max, ok = pageLimit(w, r)
+	if !ok {
+		return
+	}
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+		return
+	}
+	req.After = cursor.After
+	if cred := credential(r); cred != nil && !cred.Allows(req.Node) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownNode.Error())
+		return
+	}
+	if _, ok := srv.getBaseline(w, r, req.Baseline); !ok {
+		return
+	}
+	rev, err := srv.getRevision(r.Context())
+	drift := &shared.Drift{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.Drift", req, drift)
+	}
+	if isServerError(err, shared.ErrUnknownNode) || isServerError(err, shared.ErrUnknownBaseline) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "compare the list with its baseline")
+		return
+	}
+	env := envelope{
+		Data:       v2Drift{Node: req.Node, Baseline: req.Baseline, Added: nonNil(drift.Added), Removed: nonNil(drift.Removed)},
+		Pagination: &pagination{Limit: req.Max, HasMore: !drift.Done},
+	}
+	if !drift.Done {
+		env.Pagination.NextCursor = encodeCursor(shared.ListCursor{After: drift.Next})
+	}
+	sendEnvelope(w, r, env, rev)
+}
+
+// ListBaselines sends the baselines the credential of the request is allowed to see, in an
+// `envelope` whose data is an array of `v2Baseline`.
+func (srv *Server) ListBaselines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	rev, err := srv.getRevision(r.Context())
+	baselines := []shared.Baseline{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.Baselines", &struct{}{}, &baselines)
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "get the baselines")
+		return
+	}
+	cred, result := credential(r), []v2Baseline{}
+	for _, b := range baselines {
+		if canSeeBaseline(cred, b) {
+			result = append(result, newV2Baseline(b))
+		}
+	}
+	sendEnvelope(w, r, envelope{Data: result}, rev)
+}
+
+// canManageBaselines answers `r` with an error and returns false if its credential isn't allowed
+// to change baselines.
+func canManageBaselines(w http.ResponseWriter, r *http.Request) bool {
+	if cred := credential(r); cred != nil && !cred.ManageBaselines {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "The credential can't manage baselines")
+		return false
+	}
+	return true
+}
+
+// PinBaseline pins the baseline named in the URL from the json body of the request, which is
+// either `{"node": string}` to pin the current list of a node, or `{"paths": [string]}` to pin
+// an uploaded manifest, and sends it in an `envelope` whose data is a `v2Baseline`.
+// A baseline of the same name is answered with `409 Conflict`, unless the `replace` query
+// parameter is `true` and the credential of the request is allowed to see it.
+func (srv *Server) PinBaseline(w http.ResponseWriter, r *http.Request) {
+	if !canManageBaselines(w, r) {
+		return
+	}
+	req := &shared.PinRequest{
+		RequestId: trace.IdFromContext(r.Context()),
+		Name:      mux.Vars(r)["name"],
+		Replace:   r.URL.Query().Get("replace") == "true",
+	}
+	if err := shared.CheckBaselineName(req.Name); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var body struct {
+		Node  string   `json:"node"`
+		Paths []string `json:"paths"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBaselineBody)).Decode(&body)
+	if err != nil || (body.Node == "") == (body.Paths == nil) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The body should be either {\"node\": string} or {\"paths\": [string]}")
+		return
+	}
+	req.Node, req.Paths = body.Node, body.Paths
+	cred := credential(r)
+	if cred != nil {
+		if req.Node != "" && !cred.Allows(req.Node) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownNode.Error())
+			return
+		}
+		req.Owner = cred.principal()
+		if req.Node == "" && req.Owner == "" {
+			writeError(w, r, http.StatusForbidden, codeForbidden, "The credential needs a Name or a Username to own an uploaded baseline")
+			return
+		}
+	}
+	var existing shared.Baseline
+	err = srv.callStorage(r.Context(), "Paths.Baseline", req.Name, &existing)
+	switch {
+	case err == nil && !canSeeBaseline(cred, existing):
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownBaseline.Error())
+		return
+	case err == nil && !req.Replace:
+		writeError(w, r, http.StatusConflict, codeConflict, shared.ErrBaselineExists.Error()+", set replace=true to replace it")
+		return
+	case err != nil && !isServerError(err, shared.ErrUnknownBaseline):
+		storageUnavailable(w, r, err, "get the baseline")
+		return
+	}
+	rev, err := srv.getRevision(r.Context())
+	baseline := &shared.Baseline{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.PinBaseline", req, baseline)
+	}
+	if isServerError(err, shared.ErrUnknownNode) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if isServerError(err, shared.ErrBaselineExists) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "pin the baseline")
+		return
+	}
+	sendEnvelope(w, r, envelope{Data: newV2Baseline(*baseline)}, rev)
+}
+
+// DeleteBaseline deletes the baseline named in the URL and answers `204 No Content`.
+// Baselines the credential of the request isn't allowed to see are answered with `404 Not Found`.
+func (srv *Server) DeleteBaseline(w http.ResponseWriter, r *http.Request) {
+	if !canManageBaselines(w, r) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if _, ok := srv.getBaseline(w, r, name); !ok {
+		return
+	}
+	err := srv.callStorage(r.Context(), "Paths.DeleteBaseline", name, &struct{}{})
+	if isServerError(err, shared.ErrUnknownBaseline) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "delete the baseline")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,273 @@
+package masterserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestDriftConfig_baseline(t *testing.T) {
+	cfg := DriftConfig{Baselines: []DriftBaseline{
+		{Nodes: []string{"web-canary"}, Baseline: "canary"},
+		{Nodes: []string{"web-*", "api-*"}, Baseline: "web"},
+	}}
+	for id, baseline := range map[string]string{"web-canary": "canary", "web-1": "web", "api-2": "web", "db-1": ""} {
+		if got := cfg.baseline(id); got != baseline {
+			t.Fatalf("Baseline of '%s' should be '%s', instead is '%s'", id, baseline, got)
+		}
+	}
+	cfg.Baselines[0].Baseline = "../canary"
+	if field, err := cfg.check(); field != "Baselines" || err == nil {
+		t.Fatalf("check should refuse the baseline '../canary', instead returns '%s' '%v'", field, err)
+	}
+}
+
+func TestDriftV2(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18495")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	update := func(id string, event shared.Event, files ...string) {
+		tr := &shared.Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, shared.Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("web-1", shared.Create, "etc/a", "etc/b")
+	update("web-2", shared.Create, "etc/a", "etc/b")
+	update("db-1", shared.Create, "etc/a")
+
+	srv := &Server{
+		StorageAddress: "localhost:18495",
+		Credentials: []Credential{
+			{Token: "admin", Nodes: []string{"*"}, ManageBaselines: true},
+			{Token: "web", Nodes: []string{"web-*"}},
+			{Name: "web-team", Token: "web-team", Nodes: []string{"web-*"}, ManageBaselines: true},
+		},
+		Drift: &DriftConfig{Baselines: []DriftBaseline{{Nodes: []string{"web-*"}, Baseline: "web"}}},
+	}
+	srv.Init()
+	router := srv.router()
+	do := func(method, url, token, body string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, r)
+		if v != nil {
+			err := json.NewDecoder(w.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var pinned struct {
+		envelope
+		Data v2Baseline `json:"data"`
+	}
+	if status := do("PUT", "/v2/baselines/web", "admin", `{"node": "web-1"}`, &pinned); status != http.StatusOK || pinned.Data.Paths != 2 {
+		t.Fatalf("Pinning should answer '%d' with '2' paths, instead is '%d' with '%+v'", http.StatusOK, status, pinned.Data)
+	}
+	var e apiError
+	if status := do("PUT", "/v2/baselines/web", "web", `{"node": "web-1"}`, &e); status != http.StatusForbidden || e.Error.Code != codeForbidden {
+		t.Fatalf("Pinning without ManageBaselines should answer '%d', instead is '%d' with '%+v'", http.StatusForbidden, status, e.Error)
+	}
+	for _, body := range []string{`{}`, `{"node": "web-1", "paths": []}`} {
+		if status := do("PUT", "/v2/baselines/web", "admin", body, &e); status != http.StatusBadRequest {
+			t.Fatalf("Body '%s' should be refused with '%d', instead is '%d'", body, http.StatusBadRequest, status)
+		}
+	}
+	if status := do("PUT", "/v2/baselines/web", "admin", `{"node": "web-2"}`, &e); status != http.StatusConflict || e.Error.Code != codeConflict {
+		t.Fatalf("Pinning again should answer '%d', instead is '%d' with '%+v'", http.StatusConflict, status, e.Error)
+	}
+	if status := do("PUT", "/v2/baselines/web?replace=true", "admin", `{"node": "web-1"}`, &pinned); status != http.StatusOK {
+		t.Fatalf("Replacing should answer '%d', instead is '%d'", http.StatusOK, status)
+	}
+
+	// Baselines pinned from nodes a credential can't see, or uploaded by another credential, are
+	// hidden from it.
+	if status := do("PUT", "/v2/baselines/db", "admin", `{"node": "db-1"}`, nil); status != http.StatusOK {
+		t.Fatalf("Pinning should answer '%d', instead is '%d'", http.StatusOK, status)
+	}
+	if status := do("PUT", "/v2/baselines/manifest", "admin", `{"paths": ["etc/a"]}`, &e); status != http.StatusForbidden {
+		t.Fatalf("Uploading with a credential without a name should answer '%d', instead is '%d'", http.StatusForbidden, status)
+	}
+	if status := do("PUT", "/v2/baselines/manifest", "web-team", `{"paths": ["etc/a"]}`, &pinned); status != http.StatusOK || pinned.Data.Owner != "web-team" {
+		t.Fatalf("Uploading should answer '%d' with the owner 'web-team', instead is '%d' with '%+v'", http.StatusOK, status, pinned.Data)
+	}
+	for _, test := range []struct {
+		method, url, token, body string
+	}{
+		{"GET", "/v2/nodes/web-1/drift?baseline=db", "web", ""},
+		{"GET", "/v2/nodes/web-1/drift?baseline=manifest", "web", ""},
+		{"PUT", "/v2/baselines/db", "web-team", `{"node": "web-1"}`},
+		{"PUT", "/v2/baselines/db?replace=true", "web-team", `{"node": "web-1"}`},
+		{"DELETE", "/v2/baselines/db", "web-team", ""},
+	} {
+		if status := do(test.method, test.url, test.token, test.body, &e); status != http.StatusNotFound || e.Error.Code != codeNotFound {
+			t.Fatalf("%s '%s' with '%s' should answer '%d', instead is '%d' with '%+v'", test.method, test.url, test.token, http.StatusNotFound, status, e.Error)
+		}
+	}
+	var baselines struct {
+		envelope
+		Data []v2Baseline `json:"data"`
+	}
+	for token, expected := range map[string]string{"admin": "[db web]", "web": "[web]", "web-team": "[manifest web]"} {
+		do("GET", "/v2/baselines", token, "", &baselines)
+		names := []string{}
+		for _, b := range baselines.Data {
+			names = append(names, b.Name)
+		}
+		if fmt.Sprint(names) != expected {
+			t.Fatalf("Baselines seen by '%s' should be '%s', instead are '%v'", token, expected, names)
+		}
+	}
+
+	update("web-2", shared.Create, "etc/c", "etc/d")
+	update("web-2", shared.Remove, "etc/a")
+	srv.checkDrift(context.Background(), *srv.Drift)
+
+	var nodes struct {
+		envelope
+		Data []v2NodeInfo `json:"data"`
+	}
+	do("GET", "/v2/nodes?drifting=true", "web", "", &nodes)
+	if len(nodes.Data) != 1 || nodes.Data[0].Id != "web-2" || nodes.Data[0].Drift == nil ||
+		nodes.Data[0].Drift.Added != 2 || nodes.Data[0].Drift.Removed != 1 {
+		t.Fatalf("Only 'web-2' should be drifting with '2' paths added and '1' removed, instead nodes are '%+v'", nodes.Data)
+	}
+	do("GET", "/v2/nodes", "web", "", &nodes)
+	if len(nodes.Data) != 2 || nodes.Data[0].Drift == nil || nodes.Data[0].Drift.Drifting {
+		t.Fatalf("Nodes should be 'web-1' not drifting and 'web-2', instead are '%+v'", nodes.Data)
+	}
+
+	added, removed, url := []string{}, []string{}, "/v2/nodes/web-2/drift?limit=1"
+	for url != "" {
+		var env struct {
+			envelope
+			Data v2Drift `json:"data"`
+		}
+		if status := do("GET", url, "web", "", &env); status != http.StatusOK {
+			t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, status)
+		}
+		added, removed = append(added, env.Data.Added...), append(removed, env.Data.Removed...)
+		url = ""
+		if env.Pagination.HasMore {
+			url = "/v2/nodes/web-2/drift?limit=1&cursor=" + env.Pagination.NextCursor
+		}
+	}
+	if fmt.Sprint(added, removed) != "[etc/c etc/d] [etc/a]" {
+		t.Fatalf("Drift should be '[etc/c etc/d] [etc/a]', instead is '%v %v'", added, removed)
+	}
+
+	for url, code := range map[string]string{
+		"/v2/nodes/db-1/drift?baseline=web":     codeNotFound,
+		"/v2/nodes/web-1/drift?baseline=absent": codeNotFound,
+		"/v2/nodes/web-3/drift":                 codeNotFound,
+	} {
+		var body apiError
+		do("GET", url, "web", "", &body)
+		if body.Error.Code != code {
+			t.Fatalf("Error of '%s' should have code '%s', instead is '%+v'", url, code, body.Error)
+		}
+	}
+
+	if status := do("DELETE", "/v2/baselines/manifest", "admin", "", &e); status != http.StatusNotFound {
+		t.Fatalf("Deleting a manifest uploaded by another credential should answer '%d', instead is '%d'", http.StatusNotFound, status)
+	}
+	for name, token := range map[string]string{"web": "admin", "db": "admin", "manifest": "web-team"} {
+		if status := do("DELETE", "/v2/baselines/"+name, token, "", nil); status != http.StatusNoContent {
+			t.Fatalf("Deleting '%s' should answer '%d', instead is '%d'", name, http.StatusNoContent, status)
+		}
+	}
+	do("GET", "/v2/baselines", "web-team", "", &baselines)
+	if len(baselines.Data) != 0 {
+		t.Fatalf("Baselines should be empty, instead are '%+v'", baselines.Data)
+	}
+}
+
+func TestReloadDrift(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18498")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	err = paths.Update(&shared.Transaction{Id: "web-1", Operations: []shared.Operation{{Path: "etc/a", Event: shared.Create}}}, new(shared.Transaction))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{StorageAddress: "localhost:18498"}
+	srv.Init()
+	done := make(chan struct{})
+	defer close(done)
+	go srv.runDriftCheck(done)
+
+	// Enabling drift checks doesn't wait for the interval to pass.
+	cfg := &Server{StorageAddress: "localhost:18498", Drift: &DriftConfig{Baselines: []DriftBaseline{{Nodes: []string{"web-*"}, Baseline: "web"}}}}
+	cfg.Init()
+	err = srv.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status driftStatus
+	ok := false
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, ok = srv.drift.get("web-1")
+	}
+	if !ok {
+		t.Fatalf("'web-1' should have been checked once drift was enabled")
+	}
+	if status.Baseline != "web" || status.Error == "" {
+		t.Fatalf("'web-1' should have failed to be checked against the unpinned baseline 'web', instead is '%+v'", status)
+	}
+}
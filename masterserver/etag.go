@@ -0,0 +1,47 @@
+package masterserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+// etag returns the entity tag of the list sent to `r` in `rep` when the revisions are `rev`.
+// It only depends on the revisions of the nodes the credential of `r` is allowed to see, so that
+// changes to the other nodes don't make its clients download the list again.
+// Every representation has its own tag, only the uncompressed json list is tagged from the
+// revisions alone.
+func etag(r *http.Request, rep representation, rev shared.Revision) string {
+	cred := credential(r)
+	ids := make([]string, 0, len(rev.Nodes))
+	for id := range rev.Nodes {
+		if cred == nil || cred.Allows(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	h := fnv.New64a()
+	if rep != (representation{format: listJSON}) {
+		fmt.Fprintf(h, "%s+%s\x00", rep.format, rep.encoding)
+	}
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s\x00%d\x00", id, rev.Nodes[id])
+	}
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatches returns true if the `If-None-Match` header `header` matches `tag`, using the weak
+// comparison required for `If-None-Match`.
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package masterserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func Test_etag(t *testing.T) {
+	r := httptest.NewRequest("GET", "/list", nil)
+	cred := &Credential{Nodes: []string{"web-*"}}
+	restricted := r.WithContext(context.WithValue(r.Context(), credentialKey, cred))
+	rev := shared.Revision{Nodes: map[string]uint64{"web-1": 1, "db-1": 1}}
+	rep := representation{format: listJSON}
+	tag, restrictedTag := etag(r, rep, rev), etag(restricted, rep, rev)
+
+	if etag(r, representation{format: listJSON, encoding: "gzip"}, rev) == tag {
+		t.Fatalf("ETag should change with the representation")
+	}
+	rev.Nodes["db-1"] = 2
+	if etag(r, rep, rev) == tag {
+		t.Fatalf("ETag should change when a node changes")
+	}
+	if etag(restricted, rep, rev) != restrictedTag {
+		t.Fatalf("ETag shouldn't change when a node that isn't allowed changes")
+	}
+	rev.Nodes["web-1"] = 2
+	if etag(restricted, rep, rev) == restrictedTag {
+		t.Fatalf("ETag should change when an allowed node changes")
+	}
+
+	for header, match := range map[string]bool{
+		`"abc"`:        true,
+		`W/"abc"`:      true,
+		`"xyz", "abc"`: true,
+		`*`:            true,
+		`"xyz"`:        false,
+		`abc`:          false,
+	} {
+		if etagMatches(header, `"abc"`) != match {
+			t.Fatalf("etagMatches('%s') should be '%t', instead is '%t'", header, match, !match)
+		}
+	}
+}
+
+func TestSendListNotModified(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18483")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	update := func() {
+		err := paths.Update(&shared.Transaction{Id: "1", Operations: []shared.Operation{{Path: "/a", Event: shared.Create}}}, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update()
+
+	srv := &Server{StorageAddress: "localhost:18483"}
+	srv.Init()
+	get := func(inm string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/list", nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		srv.SendList(w, r)
+		return w
+	}
+	w := get("")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("The list should be sent with an ETag, instead status is '%d' and ETag '%s'", w.Code, tag)
+	}
+	w = get(tag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != tag {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusNotModified, w.Code)
+	}
+	update()
+	w = get(tag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == tag {
+		t.Fatalf("The new list should be sent with a new ETag, instead status is '%d' and ETag '%s'", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,298 @@
+package masterserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+// Formats of the list.
+const (
+	listJSON   = "json"
+	listNDJSON = "ndjson"
+	listCSV    = "csv"
+	listText   = "text"
+)
+
+var (
+	// contentTypes maps every format to the `Content-Type` it is sent with.
+	contentTypes = map[string]string{
+		listJSON:   "application/json",
+		listNDJSON: "application/x-ndjson",
+		listCSV:    "text/csv; charset=utf-8",
+		listText:   "text/plain; charset=utf-8",
+	}
+	// mediaTypes maps the media types accepted in the `Accept` header to formats.
+	mediaTypes = map[string]string{
+		"application/json":     listJSON,
+		"application/x-ndjson": listNDJSON,
+		"application/ndjson":   listNDJSON,
+		"text/csv":             listCSV,
+		"text/plain":           listText,
+	}
+	// encodings are the content codings accepted in the `Accept-Encoding` header.
+	encodings = map[string]string{
+		"gzip":    "gzip",
+		"deflate": "deflate",
+	}
+	// textEscaper escapes the characters that would break the lines of the text format.
+	textEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+)
+
+// representation is how the list is sent : its format and its content coding, empty if it isn't
+// compressed.
+type representation struct {
+	format   string
+	encoding string
+}
+
+// negotiate returns the representation asked by `r`, through the `format` query parameter or the
+// `Accept` header, and the `Accept-Encoding` header.
+// It returns an error if the `format` query parameter is unknown, an `Accept` header without any
+// known media type gets the json format.
+func negotiate(r *http.Request) (representation, error) {
+	rep := representation{format: listJSON}
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := contentTypes[format]; !ok {
+			return rep, fmt.Errorf("Unknown format '%s', should be one of %s, %s, %s or %s",
+				format, listJSON, listNDJSON, listCSV, listText)
+		}
+		rep.format = format
+	} else if format := preferred(r.Header.Get("Accept"), mediaTypes); format != "" {
+		rep.format = format
+	}
+	rep.encoding = preferred(r.Header.Get("Accept-Encoding"), encodings)
+	return rep, nil
+}
+
+// preferred returns the value in `values` of the entry of the list header `header` with the
+// highest quality, the first one listed on a tie, or an empty string if no entry is in `values`.
+// Entries with a quality of 0 are refused, wildcards are ignored.
+func preferred(header string, values map[string]string) string {
+	best, bestQ := "", 0.0
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		value, ok := values[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = value, q
+		}
+	}
+	return best
+}
+
+// compressor is a writer compressing what is written to it.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// output buffers what is written to a response, compressing it if needed.
+type output struct {
+	buf     *bufio.Writer
+	zw      compressor
+	flusher http.Flusher
+}
+
+// newOutput returns an `output` writing to `w`, compressed with `encoding` unless it is empty.
+func newOutput(w io.Writer, encoding string) *output {
+	out := &output{}
+	out.flusher, _ = w.(http.Flusher)
+	switch encoding {
+	case "gzip":
+		out.zw = gzip.NewWriter(w)
+	case "deflate":
+		out.zw = zlib.NewWriter(w)
+	}
+	if out.zw != nil {
+		w = out.zw
+	}
+	out.buf = bufio.NewWriter(w)
+	return out
+}
+
+// flush sends what has been written so far to the client.
+func (out *output) flush() error {
+	if err := out.buf.Flush(); err != nil {
+		return err
+	}
+	if out.zw != nil {
+		if err := out.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	if out.flusher != nil {
+		out.flusher.Flush()
+	}
+	return nil
+}
+
+// close sends what remains to the client, ending the compressed stream.
+func (out *output) close() error {
+	if err := out.buf.Flush(); err != nil {
+		return err
+	}
+	if out.zw != nil {
+		if err := out.zw.Close(); err != nil {
+			return err
+		}
+	}
+	if out.flusher != nil {
+		out.flusher.Flush()
+	}
+	return nil
+}
+
+// writeString writes `s` as a json string.
+func (out *output) writeString(s string) {
+	b, _ := json.Marshal(s)
+	out.buf.Write(b)
+}
+
+// listEncoder writes lists received in parts, a part continuing the previous one if it has the
+// same id. Write errors are sticky and returned by `flush` and `end`.
+type listEncoder interface {
+	write(part shared.Node)
+	flush() error
+	end() error
+}
+
+// newListEncoder sets the headers of `w` for `rep` and returns the encoder writing the list to it.
+func newListEncoder(w http.ResponseWriter, rep representation) listEncoder {
+	w.Header().Set("Content-Type", contentTypes[rep.format])
+	if rep.encoding != "" {
+		w.Header().Set("Content-Encoding", rep.encoding)
+	}
+	return newEncoder(w, rep)
+}
+
+// newEncoder returns the encoder writing the list to `w` as described by `rep`.
+func newEncoder(w io.Writer, rep representation) listEncoder {
+	out := newOutput(w, rep.encoding)
+	switch rep.format {
+	case listNDJSON:
+		return &rowEncoder{output: out, row: func(node, path string) {
+			out.buf.WriteString(`{"node":`)
+			out.writeString(node)
+			out.buf.WriteString(`,"path":`)
+			out.writeString(path)
+			out.buf.WriteString("}\n")
+		}}
+	case listCSV:
+		cw := csv.NewWriter(out.buf)
+		cw.Write([]string{"node", "path"})
+		return &rowEncoder{output: out, row: func(node, path string) {
+			cw.Write([]string{node, path})
+		}, flushRows: cw.Flush}
+	case listText:
+		return &rowEncoder{output: out, row: func(node, path string) {
+			out.buf.WriteString(textEscaper.Replace(node))
+			out.buf.WriteByte('\t')
+			out.buf.WriteString(textEscaper.Replace(path))
+			out.buf.WriteByte('\n')
+		}}
+	}
+	out.buf.WriteByte('[')
+	return &jsonEncoder{output: out}
+}
+
+// jsonEncoder writes the list as the json array `json.Encoder` writes for `[]shared.Node`.
+type jsonEncoder struct {
+	*output
+	started bool
+	current string
+	nodes   int
+	files   int
+}
+
+func (enc *jsonEncoder) write(part shared.Node) {
+	if !enc.started || part.Id != enc.current {
+		enc.closeNode()
+		enc.started, enc.current = true, part.Id
+		if enc.nodes > 0 {
+			enc.buf.WriteByte(',')
+		}
+		enc.buf.WriteString(`{"Id":`)
+		enc.writeString(part.Id)
+		enc.buf.WriteString(`,"Files":`)
+		enc.nodes++
+		enc.files = 0
+	}
+	for _, file := range part.Files {
+		if enc.files == 0 {
+			enc.buf.WriteByte('[')
+		} else {
+			enc.buf.WriteByte(',')
+		}
+		enc.writeString(file)
+		enc.files++
+	}
+}
+
+// closeNode ends the node being written, if any. A node without paths has `null` files, as
+// encoded by `json.Encoder`.
+func (enc *jsonEncoder) closeNode() {
+	if !enc.started {
+		return
+	}
+	if enc.files == 0 {
+		enc.buf.WriteString("null")
+	} else {
+		enc.buf.WriteByte(']')
+	}
+	enc.buf.WriteByte('}')
+}
+
+func (enc *jsonEncoder) end() error {
+	enc.closeNode()
+	enc.buf.WriteString("]\n")
+	return enc.close()
+}
+
+// rowEncoder writes a row for every path with `row`, nodes without paths being left out.
+// `flushRows`, if set, is called before the output is flushed.
+type rowEncoder struct {
+	*output
+	row       func(node, path string)
+	flushRows func()
+}
+
+func (enc *rowEncoder) write(part shared.Node) {
+	for _, file := range part.Files {
+		enc.row(part.Id, file)
+	}
+}
+
+func (enc *rowEncoder) flush() error {
+	if enc.flushRows != nil {
+		enc.flushRows()
+	}
+	return enc.output.flush()
+}
+
+func (enc *rowEncoder) end() error {
+	if enc.flushRows != nil {
+		enc.flushRows()
+	}
+	return enc.close()
+}
@@ -0,0 +1,163 @@
+package masterserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func Test_negotiate(t *testing.T) {
+	for _, test := range []struct {
+		url, accept, acceptEncoding string
+		rep                         representation
+	}{
+		{"/list", "", "", representation{listJSON, ""}},
+		{"/list", "*/*", "*", representation{listJSON, ""}},
+		{"/list?format=csv", "application/x-ndjson", "", representation{listCSV, ""}},
+		{"/list", "application/x-ndjson", "gzip", representation{listNDJSON, "gzip"}},
+		{"/list", "text/csv;q=0.5, text/plain", "gzip;q=0.2, deflate", representation{listText, "deflate"}},
+		{"/list", "text/html", "gzip;q=0, br", representation{listJSON, ""}},
+	} {
+		r := httptest.NewRequest("GET", test.url, nil)
+		r.Header.Set("Accept", test.accept)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rep, err := negotiate(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep != test.rep {
+			t.Fatalf("Representation of '%s' should be '%v', instead is '%v'", test.url, test.rep, rep)
+		}
+	}
+	_, err := negotiate(httptest.NewRequest("GET", "/list?format=xml", nil))
+	if err == nil {
+		t.Fatalf("Format 'xml' should be refused")
+	}
+}
+
+func Test_newEncoder(t *testing.T) {
+	parts := []shared.Node{
+		{Id: "db-1", Files: []string{"/a"}},
+		{Id: "db-1", Files: []string{"/b", "/<c>"}},
+		{Id: "web-1"},
+		{Id: "web-2", Files: []string{"/d\te,f"}},
+	}
+	nodes := []shared.Node{
+		{Id: "db-1", Files: []string{"/a", "/b", "/<c>"}},
+		{Id: "web-1"},
+		{Id: "web-2", Files: []string{"/d\te,f"}},
+	}
+	var list bytes.Buffer
+	json.NewEncoder(&list).Encode(nodes)
+	for format, expected := range map[string]string{
+		listJSON: list.String(),
+		listNDJSON: `{"node":"db-1","path":"/a"}` + "\n" + `{"node":"db-1","path":"/b"}` + "\n" +
+			`{"node":"db-1","path":"/\u003cc\u003e"}` + "\n" + `{"node":"web-2","path":"/d\te,f"}` + "\n",
+		listCSV:  "node,path\ndb-1,/a\ndb-1,/b\ndb-1,/<c>\nweb-2,\"/d\te,f\"\n",
+		listText: "db-1\t/a\ndb-1\t/b\ndb-1\t/<c>\nweb-2\t/d\\te,f\n",
+	} {
+		for _, encoding := range []string{"", "gzip", "deflate"} {
+			var buf bytes.Buffer
+			enc := newEncoder(&buf, representation{format, encoding})
+			for _, part := range parts {
+				enc.write(part)
+				if err := enc.flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := enc.end()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r io.Reader = &buf
+			switch encoding {
+			case "gzip":
+				r, err = gzip.NewReader(r)
+			case "deflate":
+				r, err = zlib.NewReader(r)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != expected {
+				t.Fatalf("The list in %s with encoding '%s' should be '%s', instead is '%s'", format, encoding, expected, b)
+			}
+		}
+	}
+}
+
+func TestSendListFormat(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18491")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	err = paths.Update(&shared.Transaction{Id: "1", Operations: []shared.Operation{{Path: "/a", Event: shared.Create}}}, new(shared.Transaction))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxPaths := range []int{0, 1} {
+		srv := &Server{StorageAddress: "localhost:18491", Cache: &CacheConfig{MaxPaths: maxPaths}}
+		srv.Init()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/list?format=text", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		srv.SendList(w, r)
+		if w.Header().Get("Content-Type") != contentTypes[listText] {
+			t.Fatalf("Content-Type should be '%s', instead is '%s'", contentTypes[listText], w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Content-Encoding should be 'gzip', instead is '%s'", w.Header().Get("Content-Encoding"))
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "1\t/a\n" {
+			t.Fatalf("The list should be '1\t/a', instead is '%s'", b)
+		}
+
+		w = httptest.NewRecorder()
+		srv.SendList(w, httptest.NewRequest("GET", "/list?format=xml", nil))
+		if w.Code != 400 {
+			t.Fatalf("Status should be '400', instead is '%d'", w.Code)
+		}
+	}
+}
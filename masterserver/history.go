@@ -0,0 +1,86 @@
+package masterserver
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+// v2PathEvent is a change of a path, as sent by `/v2/nodes/{id}/history`.
+type v2PathEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// v2History is the changes of a path, as sent by `/v2/nodes/{id}/history`.
+type v2History struct {
+	Node string `json:"node"`
+	Path string `json:"path"`
+	// Since is the time from which changes are recorded, absent if none were recorded.
+	Since  *time.Time    `json:"since,omitempty"`
+	Events []v2PathEvent `json:"events"`
+}
+
+// HistoryV2 sends every change recorded in the journal of storage for the path given by the
+// `path` query parameter on the node of the URL, in order, in an `envelope` whose data is a
+// `v2History`.
+// The history is paged like `/v2/list`, `limit` being a number of events, and is read from an
+// index of the journal by path.
+func (srv *Server) HistoryV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	query := r.URL.Query()
+	req := &shared.HistoryRequest{RequestId: trace.IdFromContext(r.Context()), Node: mux.Vars(r)["id"], Path: query.Get("path")}
+	if req.Path == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "path should be set")
+		return
+	}
+	var ok bool
+	req.Max, ok = pageLimit(w, r)
+	if !ok {
+		return
+	}
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err == nil {
+		_, err = hex.DecodeString(cursor.After)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+		return
+	}
+	req.After = cursor.After
+	if cred := credential(r); cred != nil && !cred.Allows(req.Node) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownNode.Error())
+		return
+	}
+	rev, err := srv.getRevision(r.Context())
+	history := &shared.History{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.History", req, history)
+	}
+	if isServerError(err, shared.ErrUnknownNode) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "read the history of the path")
+		return
+	}
+	data := v2History{Node: req.Node, Path: req.Path, Events: []v2PathEvent{}}
+	if !history.Since.IsZero() {
+		data.Since = &history.Since
+	}
+	for _, e := range history.Events {
+		data.Events = append(data.Events, v2PathEvent{Event: strings.ToLower(e.Event.String()), Time: e.Time})
+	}
+	env := envelope{Data: data, Pagination: &pagination{Limit: req.Max, HasMore: !history.Done}}
+	if !history.Done {
+		env.Pagination.NextCursor = encodeCursor(shared.ListCursor{After: history.Next})
+	}
+	sendEnvelope(w, r, env, rev)
+}
@@ -0,0 +1,114 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestHistoryV2(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18497")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	update := func(id string, event shared.Event, files ...string) {
+		tr := &shared.Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, shared.Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	update("web-1", shared.Create, "etc/a", "etc/b")
+	update("web-1", shared.Remove, "etc/a")
+	update("web-1", shared.Create, "etc/a")
+	update("db-1", shared.Create, "etc/a")
+
+	srv := &Server{
+		StorageAddress: "localhost:18497",
+		Credentials:    []Credential{{Token: "web", Nodes: []string{"web-*"}}},
+	}
+	srv.Init()
+	router := srv.router()
+	get := func(url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Authorization", "Bearer web")
+		router.ServeHTTP(w, r)
+		err := json.NewDecoder(w.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code
+	}
+
+	events, url := []string{}, "/v2/nodes/web-1/history?path=etc/a&limit=1"
+	var since *time.Time
+	for url != "" {
+		var env struct {
+			envelope
+			Data v2History `json:"data"`
+		}
+		if status := get(url, &env); status != http.StatusOK {
+			t.Fatalf("Status of '%s' should be '%d', instead is '%d'", url, http.StatusOK, status)
+		}
+		for _, e := range env.Data.Events {
+			events = append(events, e.Event)
+		}
+		since = env.Data.Since
+		url = ""
+		if env.Pagination.HasMore {
+			url = "/v2/nodes/web-1/history?path=etc/a&limit=1&cursor=" + env.Pagination.NextCursor
+		}
+	}
+	if fmt.Sprint(events) != "[create remove create]" {
+		t.Fatalf("History should be '[create remove create]', instead is '%v'", events)
+	}
+	if since == nil {
+		t.Fatalf("Since should be set")
+	}
+
+	for url, code := range map[string]string{
+		"/v2/nodes/web-1/history":                                           codeBadRequest,
+		"/v2/nodes/web-1/history?path=etc/a&cursor=absent":                  codeBadRequest,
+		"/v2/nodes/web-1/history?path=etc/a&cursor=eyJhZnRlciI6ImV0Yy9hIn0": codeBadRequest,
+		"/v2/nodes/db-1/history?path=etc/a":                                 codeNotFound,
+		"/v2/nodes/web-2/history?path=etc/a":                                codeNotFound,
+	} {
+		var body apiError
+		get(url, &body)
+		if body.Error.Code != code {
+			t.Fatalf("Error of '%s' should have code '%s', instead is '%+v'", url, code, body.Error)
+		}
+	}
+}
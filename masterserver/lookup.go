@@ -0,0 +1,92 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+const (
+	// maxLookupPaths is the maximum number of paths looked up by a single request.
+	maxLookupPaths = 1000
+	// maxLookupBody is the maximum size of the body of `/v2/paths/lookup`, in bytes.
+	maxLookupBody = 8 << 20
+)
+
+// v2PathNodes is a path and the nodes having it, as sent by `/v2`.
+type v2PathNodes struct {
+	Path  string   `json:"path"`
+	Nodes []string `json:"nodes"`
+}
+
+// lookup gets from the storage server the nodes having each of `paths`, along with the revisions
+// read before, and leaves out the nodes the credential of `r` isn't allowed to see.
+func (srv *Server) lookup(r *http.Request, paths []string) ([]v2PathNodes, shared.Revision, error) {
+	rev, err := srv.getRevision(r.Context())
+	if err != nil {
+		return nil, rev, err
+	}
+	found := []shared.PathNodes{}
+	err = srv.callStorage(r.Context(), "Paths.Lookup", &shared.LookupRequest{RequestId: trace.IdFromContext(r.Context()), Paths: paths}, &found)
+	if err != nil {
+		return nil, rev, err
+	}
+	cred := credential(r)
+	result := make([]v2PathNodes, 0, len(found))
+	for _, pn := range found {
+		nodes := []string{}
+		for _, id := range pn.Nodes {
+			if cred == nil || cred.Allows(id) {
+				nodes = append(nodes, id)
+			}
+		}
+		result = append(result, v2PathNodes{Path: pn.Path, Nodes: nodes})
+	}
+	return result, rev, nil
+}
+
+// sendLookup sends `paths` looked up for `r`, `one` being true if a single path was asked and is
+// sent on its own rather than in an array.
+func (srv *Server) sendLookup(w http.ResponseWriter, r *http.Request, paths []string, one bool) {
+	w.Header().Set("Vary", "Authorization")
+	found, rev, err := srv.lookup(r, paths)
+	if err != nil {
+		storageUnavailable(w, r, err, "look up paths")
+		return
+	}
+	env := envelope{Data: found}
+	if one {
+		env.Data = found[0]
+	}
+	sendEnvelope(w, r, env, rev)
+}
+
+// NodesOfPath sends the ids of the nodes having the path of the URL, among the nodes the
+// credential of the request is allowed to see, in an `envelope` whose data is a `v2PathNodes`.
+func (srv *Server) NodesOfPath(w http.ResponseWriter, r *http.Request) {
+	srv.sendLookup(w, r, []string{mux.Vars(r)["path"]}, true)
+}
+
+// LookupPaths sends the ids of the nodes having each of the paths of the json body of the
+// request, `{"paths": [string]}`, in an `envelope` whose data is an array of `v2PathNodes` in the
+// order of the paths asked. Up to `maxLookupPaths` paths can be looked up at once.
+func (srv *Server) LookupPaths(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Paths []string `json:"paths"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLookupBody)).Decode(&body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The body should be {\"paths\": [string]}")
+		return
+	}
+	if len(body.Paths) == 0 || len(body.Paths) > maxLookupPaths {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Between 1 and "+strconv.Itoa(maxLookupPaths)+" paths can be looked up")
+		return
+	}
+	srv.sendLookup(w, r, body.Paths, false)
+}
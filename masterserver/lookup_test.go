@@ -0,0 +1,96 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestLookupPaths(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18493")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	for _, id := range []string{"db-1", "web-1", "web-2"} {
+		tr := &shared.Transaction{Id: id, Operations: []shared.Operation{{Path: "etc/nginx/sites-enabled/foo.conf", Event: shared.Create}}}
+		err = paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := &Server{StorageAddress: "localhost:18493", Credentials: []Credential{{Token: "web", Nodes: []string{"web-*"}}}}
+	srv.Init()
+	router := srv.router()
+	do := func(method, url, body string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer web")
+		router.ServeHTTP(w, r)
+		err := json.NewDecoder(w.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code
+	}
+
+	var one struct {
+		envelope
+		Data v2PathNodes `json:"data"`
+	}
+	status := do("GET", "/v2/paths/etc/nginx/sites-enabled/foo.conf/nodes", "", &one)
+	if status != http.StatusOK || one.Revision == "" {
+		t.Fatalf("Status should be '%d' with a revision, instead is '%d' with '%s'", http.StatusOK, status, one.Revision)
+	}
+	if got := fmt.Sprint(one.Data); got != "{etc/nginx/sites-enabled/foo.conf [web-1 web-2]}" {
+		t.Fatalf("The path should be on 'web-1' and 'web-2', instead is '%s'", got)
+	}
+
+	var many struct {
+		envelope
+		Data []v2PathNodes `json:"data"`
+	}
+	status = do("POST", "/v2/paths/lookup", `{"paths": ["etc/missing", "etc/nginx/sites-enabled/foo.conf"]}`, &many)
+	if status != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, status)
+	}
+	if got := fmt.Sprint(many.Data); got != "[{etc/missing []} {etc/nginx/sites-enabled/foo.conf [web-1 web-2]}]" {
+		t.Fatalf("The paths should be looked up in order, instead the result is '%s'", got)
+	}
+
+	for _, body := range []string{`{"paths": []}`, `["etc"]`} {
+		var e apiError
+		status = do("POST", "/v2/paths/lookup", body, &e)
+		if status != http.StatusBadRequest || e.Error.Code != codeBadRequest {
+			t.Fatalf("Body '%s' should be refused with code '%s', instead status is '%d'", body, codeBadRequest, status)
+		}
+	}
+}
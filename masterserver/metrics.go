@@ -0,0 +1,109 @@
+package masterserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
+	"github.com/matarc/filewatcher/trace"
+)
+
+func (srv *Server) requestsTotal() *metrics.Counter {
+	return srv.metrics.Counter("filewatcher_masterserver_http_requests_total",
+		"Number of HTTP requests handled, by route, method and status code.", "route", "method", "code")
+}
+
+func (srv *Server) requestDuration() *metrics.Histogram {
+	return srv.metrics.Histogram("filewatcher_masterserver_http_request_duration_seconds",
+		"Time spent handling HTTP requests, by route and method.", metrics.DefaultBuckets, "route", "method")
+}
+
+func (srv *Server) storageFailures() *metrics.Counter {
+	return srv.metrics.Counter("filewatcher_masterserver_storage_rpc_failures_total",
+		"Number of RPCs to the storage server that failed, by method.", "method")
+}
+
+func (srv *Server) cacheResults() *metrics.Counter {
+	return srv.metrics.Counter("filewatcher_masterserver_cache_requests_total",
+		"Number of lists served, by cache result.", "result")
+}
+
+// statusRecorder records the status code and the number of bytes sent by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client, if the wrapped writer supports it.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument is a middleware that counts requests and measures how long they take per route.
+func (srv *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := routeTemplate(r)
+		srv.requestsTotal().Inc(route, r.Method, strconv.Itoa(rec.status))
+		srv.requestDuration().Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// traceRequest is a middleware that gives every request an id, taken from the `X-Request-ID`
+// header if it holds a valid one, and sends it back in the same header.
+// The request is traced and its trace is kept for `/debug/traces`.
+func (srv *Server) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(trace.Header)
+		if !trace.ValidId(id) {
+			id = trace.NewId()
+		}
+		w.Header().Set(trace.Header, id)
+		t := trace.New(id, r.Method+" "+r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(trace.NewContext(r.Context(), t)))
+		log.With("request", id, "method", r.Method, "path", r.URL.Path, "duration", t.Finish()).Debug("Request handled")
+		srv.traces.Record(t)
+	})
+}
+
+// SendTraces sends the traces of the last requests, see `trace.Recorder`.
+// As the names of the traces hold the nodes and paths that were asked for, only credentials that
+// see every node can read them.
+func (srv *Server) SendTraces(w http.ResponseWriter, r *http.Request) {
+	if cred := credential(r); cred != nil && !cred.unrestricted() {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "Traces can only be read by a credential seeing every node")
+		return
+	}
+	srv.traces.ServeHTTP(w, r)
+}
+
+// routeTemplate returns the template of the route matched by `r`, such as `/list`, so that
+// metrics don't get a new series for every distinct URL.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,101 @@
+package masterserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matarc/filewatcher/trace"
+)
+
+func Test_instrument(t *testing.T) {
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18445"
+	srv.Credentials = []Credential{{Token: "secret", Nodes: []string{"*"}}}
+	srv.Init()
+	router := srv.router()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/list", nil)
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusBadGateway, w.Code)
+	}
+
+	// Metrics don't require authentication
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		`filewatcher_masterserver_http_requests_total{route="/list",method="GET",code="401"} 1`,
+		`filewatcher_masterserver_http_requests_total{route="/list",method="GET",code="502"} 1`,
+		`filewatcher_masterserver_http_request_duration_seconds_count{route="/list",method="GET"} 2`,
+		`filewatcher_masterserver_storage_rpc_failures_total{method="Paths.Revision"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics should contain '%s', instead are '%s'", expected, body)
+		}
+	}
+}
+
+func Test_traceRequest(t *testing.T) {
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18445"
+	srv.Credentials = []Credential{
+		{Token: "all", Nodes: []string{"*"}},
+		{Token: "web", Nodes: []string{"web-*"}},
+	}
+	srv.Init()
+	router := srv.router()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set(trace.Header, "my-request")
+	r.Header.Set("Authorization", "Bearer all")
+	router.ServeHTTP(w, r)
+	if id := w.Header().Get(trace.Header); id != "my-request" {
+		t.Fatalf("%s should be 'my-request', instead is '%s'", trace.Header, id)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set(trace.Header, "not a valid id")
+	router.ServeHTTP(w, r)
+	if id := w.Header().Get(trace.Header); !trace.ValidId(id) || id == "not a valid id" {
+		t.Fatalf("%s should be a new id, instead is '%s'", trace.Header, id)
+	}
+
+	// Traces hold the paths asked for, so only a credential seeing every node can read them.
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"web", http.StatusForbidden},
+		{"all", http.StatusOK},
+	} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/debug/traces?id=my-request", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		router.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Fatalf("Status of the traces for '%s' should be '%d', instead is '%d'", test.token, test.status, w.Code)
+		}
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"Name":"GET /list"`) || !strings.Contains(body, `"Name":"dial storage"`) {
+		t.Fatalf("Traces should contain the request and its spans, instead are '%s'", body)
+	}
+}
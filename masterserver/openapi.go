@@ -0,0 +1,579 @@
+package masterserver
+
+// openAPI is the OpenAPI document served on `/v2/openapi.json`.
+// Every route of the REST API should be described in it.
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "filewatcher masterserver",
+    "description": "Lists the files watched by the nodewatchers. Responses of /v2 are wrapped in an envelope and errors are json objects with a code.",
+    "version": "2.0.0"
+  },
+  "security": [{"bearer": []}, {"basic": []}],
+  "paths": {
+    "/list": {
+      "get": {
+        "summary": "List the files of every node (v1)",
+        "description": "Version 1 of the list, a bare array. /v1/list is an alias.",
+        "parameters": [
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "ndjson", "csv", "text"], "default": "json"}},
+          {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The list, in the format asked by the format parameter or the Accept header.",
+            "headers": {
+              "ETag": {"schema": {"type": "string"}},
+              "X-Cache": {"schema": {"type": "string", "enum": ["hit", "miss", "stale", "stream"]}},
+              "Age": {"schema": {"type": "integer"}}
+            },
+            "content": {
+              "application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/V1Node"}}},
+              "application/x-ndjson": {"schema": {"type": "string"}},
+              "text/csv": {"schema": {"type": "string"}},
+              "text/plain": {"schema": {"type": "string"}}
+            }
+          },
+          "304": {"description": "The list didn't change since the ETag sent in If-None-Match."},
+          "400": {"description": "Unknown format."},
+          "401": {"description": "Missing or invalid credential."},
+          "502": {"description": "Storage can't be reached and no cached list can be served."}
+        }
+      }
+    },
+    "/v1/list": {"$ref": "#/paths/~1list"},
+    "/v2/list": {
+      "get": {
+        "summary": "List the files of every node, a page at a time",
+        "description": "A node may be split over several pages, and a page may hold fewer paths than limit even if it isn't the last one.",
+        "parameters": [
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 1000}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of the list.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Node"}}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/diff": {
+      "get": {
+        "summary": "Compare the lists of two nodes",
+        "description": "Paged like /v2/list, a page may be empty even if it isn't the last one.",
+        "parameters": [
+          {"name": "a", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "b", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "prefix", "in": "query", "description": "Only compares the paths starting with it.", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 1000}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The paths only on a and the paths only on b.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/Diff"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/paths/{path}/nodes": {
+      "get": {
+        "summary": "Nodes having a path",
+        "parameters": [{"name": "path", "in": "path", "required": true, "description": "The path as stored, such as etc/nginx/nginx.conf, which may hold slashes.", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {
+            "description": "The nodes having the path among the nodes the credential can see.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/PathNodes"}}}
+              ]
+            }}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/paths/lookup": {
+      "post": {
+        "summary": "Nodes having each of several paths",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["paths"],
+            "properties": {"paths": {"type": "array", "minItems": 1, "maxItems": 1000, "items": {"type": "string"}}}
+          }}}
+        },
+        "responses": {
+          "200": {
+            "description": "The nodes having each path among the nodes the credential can see, in the order of the paths asked.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/PathNodes"}}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/nodes": {
+      "get": {
+        "summary": "Nodes and their drift from their baselines",
+        "parameters": [{"name": "drifting", "in": "query", "description": "Only sends the nodes flagged by the last drift check.", "schema": {"type": "boolean"}}],
+        "responses": {
+          "200": {
+            "description": "The nodes the credential can see, sorted by id.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/NodeInfo"}}}}
+              ]
+            }}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/nodes/{id}/drift": {
+      "get": {
+        "summary": "Paths added to and removed from the list of a node since a baseline",
+        "description": "Paged like /v2/list, a page may be empty even if it isn't the last one.",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "baseline", "in": "query", "description": "Defaults to the baseline set for the node in the configuration.", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 1000}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The drift of the node.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/Drift"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/nodes/{id}/files": {
+      "get": {
+        "summary": "List of a node in the past",
+        "description": "Either at or snapshot should be set. Paged like /v2/list.",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "at", "in": "query", "description": "Rebuilds the list as it was at that time from the journal of storage.", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "snapshot", "in": "query", "description": "Reads the list from a snapshot.", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 1000}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of the list.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/NodeFiles"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "410": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/nodes/{id}/history": {
+      "get": {
+        "summary": "Changes of a path on a node",
+        "description": "Every change of the path recorded in the journal, in order. Paged like /v2/list, limit being a number of events.",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "path", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 1000}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of the history.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/History"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/snapshots": {
+      "get": {
+        "summary": "Snapshots taken",
+        "responses": {
+          "200": {
+            "description": "The snapshots, sorted by name, the nodes and paths counting only the nodes the credential is allowed to see.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Snapshot"}}}}
+              ]
+            }}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/snapshots/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[A-Za-z0-9._-]{1,128}$"}}],
+      "put": {
+        "summary": "Take a snapshot",
+        "description": "Copies the lists of all nodes, now or as they were at a past time, replacing the snapshot of the same name unless it is being taken. Requires a credential allowed to manage snapshots and to see every node.",
+        "requestBody": {
+          "required": false,
+          "content": {"application/json": {"schema": {"type": "object", "properties": {"at": {"type": "string", "format": "date-time"}}}}}
+        },
+        "responses": {
+          "200": {
+            "description": "The snapshot taken.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/Snapshot"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a snapshot",
+        "description": "Requires a credential allowed to manage snapshots and to see every node.",
+        "responses": {
+          "204": {"description": "The snapshot was deleted."},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/baselines": {
+      "get": {
+        "summary": "Baselines pinned",
+        "description": "Only the baselines the credential is allowed to see: those pinned from a node it sees, and the manifests it uploaded.",
+        "responses": {
+          "200": {
+            "description": "The baselines, sorted by name.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Baseline"}}}}
+              ]
+            }}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/baselines/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[A-Za-z0-9._-]{1,128}$"}}],
+      "put": {
+        "summary": "Pin a baseline",
+        "description": "Pins the current list of a node, or an uploaded manifest. A baseline of the same name is only replaced if replace is true and the credential is allowed to see it. Requires a credential allowed to manage baselines.",
+        "parameters": [
+          {"name": "replace", "in": "query", "description": "Replaces the baseline of the same name instead of answering 409.", "schema": {"type": "boolean", "default": false}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "oneOf": [
+              {"type": "object", "required": ["node"], "properties": {"node": {"type": "string"}}},
+              {"type": "object", "required": ["paths"], "properties": {"paths": {"type": "array", "items": {"type": "string"}}}}
+            ]
+          }}}
+        },
+        "responses": {
+          "200": {
+            "description": "The baseline pinned.",
+            "content": {"application/json": {"schema": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Envelope"},
+                {"type": "object", "properties": {"data": {"$ref": "#/components/schemas/Baseline"}}}
+              ]
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a baseline",
+        "description": "Requires a credential allowed to manage baselines and to see the baseline.",
+        "responses": {
+          "204": {"description": "The baseline was deleted."},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "security": [],
+        "responses": {"200": {"description": "The OpenAPI document.", "content": {"application/json": {}}}}
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness check",
+        "security": [],
+        "responses": {"200": {"description": "masterserver is running."}}
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness check",
+        "security": [],
+        "responses": {
+          "200": {"description": "Storage can be reached."},
+          "503": {"description": "Storage can't be reached."}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Prometheus metrics",
+        "security": [],
+        "responses": {"200": {"description": "Metrics in the Prometheus text format.", "content": {"text/plain": {}}}}
+      }
+    },
+    "/debug/traces": {
+      "get": {
+        "summary": "Last requests traced",
+        "parameters": [{"name": "id", "in": "query", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The traces, the most recent first.", "content": {"application/json": {}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"},
+      "basic": {"type": "http", "scheme": "basic"}
+    },
+    "schemas": {
+      "V1Node": {
+        "type": "object",
+        "properties": {
+          "Id": {"type": "string"},
+          "Files": {"type": "array", "nullable": true, "items": {"type": "string"}}
+        }
+      },
+      "Node": {
+        "type": "object",
+        "required": ["id", "files"],
+        "properties": {
+          "id": {"type": "string"},
+          "files": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "Diff": {
+        "type": "object",
+        "required": ["a", "b", "prefix", "only_a", "only_b", "changed"],
+        "properties": {
+          "a": {"type": "string"},
+          "b": {"type": "string"},
+          "prefix": {"type": "string"},
+          "only_a": {"type": "array", "items": {"type": "string"}},
+          "only_b": {"type": "array", "items": {"type": "string"}},
+          "changed": {"type": "array", "description": "Paths on both nodes whose metadata differ, always empty as lists don't hold metadata yet.", "items": {"type": "string"}}
+        }
+      },
+      "PathNodes": {
+        "type": "object",
+        "required": ["path", "nodes"],
+        "properties": {
+          "path": {"type": "string"},
+          "nodes": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "Baseline": {
+        "type": "object",
+        "required": ["name", "paths", "created_at"],
+        "properties": {
+          "name": {"type": "string"},
+          "node": {"type": "string", "description": "The node whose list was pinned, absent if a manifest was uploaded."},
+          "owner": {"type": "string", "description": "The name of the credential that pinned the baseline, absent if authentication is disabled."},
+          "paths": {"type": "integer"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "NodeInfo": {
+        "type": "object",
+        "required": ["id", "paths"],
+        "properties": {
+          "id": {"type": "string"},
+          "paths": {"type": "integer"},
+          "drift": {
+            "type": "object",
+            "description": "The last drift check of the node, absent if it has no baseline or wasn't checked yet.",
+            "required": ["baseline", "added", "removed", "drifting", "checked_at"],
+            "properties": {
+              "baseline": {"type": "string"},
+              "added": {"type": "integer"},
+              "removed": {"type": "integer"},
+              "drifting": {"type": "boolean", "description": "True if more paths were added and removed than the threshold."},
+              "checked_at": {"type": "string", "format": "date-time"},
+              "error": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Drift": {
+        "type": "object",
+        "required": ["node", "baseline", "added", "removed"],
+        "properties": {
+          "node": {"type": "string"},
+          "baseline": {"type": "string"},
+          "added": {"type": "array", "items": {"type": "string"}},
+          "removed": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "NodeFiles": {
+        "type": "object",
+        "required": ["id", "files"],
+        "properties": {
+          "id": {"type": "string"},
+          "at": {"type": "string", "format": "date-time"},
+          "snapshot": {"type": "string"},
+          "files": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "History": {
+        "type": "object",
+        "required": ["node", "path", "events"],
+        "properties": {
+          "node": {"type": "string"},
+          "path": {"type": "string"},
+          "since": {"type": "string", "format": "date-time", "description": "The time from which changes are recorded, absent if the journal of the node wasn't started."},
+          "events": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["event", "time"],
+              "properties": {
+                "event": {"type": "string", "enum": ["create", "remove"], "description": "Nodewatchers report a move as the removal of the old path and the creation of the new one, and don't report modifications."},
+                "time": {"type": "string", "format": "date-time"}
+              }
+            }
+          }
+        }
+      },
+      "Snapshot": {
+        "type": "object",
+        "required": ["name", "at", "created_at", "nodes", "paths"],
+        "properties": {
+          "name": {"type": "string"},
+          "at": {"type": "string", "format": "date-time", "description": "The time of the lists copied."},
+          "created_at": {"type": "string", "format": "date-time"},
+          "nodes": {"type": "integer"},
+          "paths": {"type": "integer"}
+        }
+      },
+      "Envelope": {
+        "type": "object",
+        "required": ["data", "revision", "generated_at", "stale"],
+        "properties": {
+          "data": {},
+          "revision": {"type": "string", "description": "Changes whenever the lists the data comes from change."},
+          "generated_at": {"type": "string", "format": "date-time"},
+          "stale": {"type": "boolean", "description": "True if storage couldn't be reached and the data comes from an old cached list."},
+          "pagination": {"$ref": "#/components/schemas/Pagination"}
+        }
+      },
+      "Pagination": {
+        "type": "object",
+        "required": ["limit", "has_more"],
+        "properties": {
+          "limit": {"type": "integer"},
+          "next_cursor": {"type": "string"},
+          "has_more": {"type": "boolean"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"type": "string", "enum": ["bad_request", "unauthorized", "forbidden", "not_found", "conflict", "gone", "storage_unavailable"]},
+              "message": {"type": "string"},
+              "request_id": {"type": "string"}
+            }
+          }
+        }
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "An error.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    }
+  }
+}
+`
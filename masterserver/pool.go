@@ -0,0 +1,240 @@
+package masterserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
+	"github.com/matarc/filewatcher/trace"
+)
+
+const (
+	// poolSize is the maximum number of connections kept open to the storage server.
+	poolSize = 4
+	// callTimeout is the time given to an RPC to complete once it has a connection.
+	callTimeout = 10 * time.Second
+	// snapshotTimeout is the time given to `Paths.TakeSnapshot`, which copies the lists of all nodes.
+	snapshotTimeout = 10 * time.Minute
+	// dialTimeout is the time given to the storage server to accept a connection.
+	dialTimeout = 2 * time.Second
+	// healthInterval is the time between two health checks of the idle connections.
+	healthInterval = 30 * time.Second
+	// minBackoff and maxBackoff bound the time during which no connection is attempted after a
+	// failed one.
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// errBackoff is returned when a connection isn't attempted because the last one failed recently.
+type errBackoff struct {
+	err   error
+	retry time.Time
+}
+
+func (e *errBackoff) Error() string {
+	return fmt.Sprintf("%s (next attempt in %s)", e.err, time.Until(e.retry).Round(time.Millisecond))
+}
+
+// pooledClient is a connection to the storage server, `address` being the address it was dialed on.
+type pooledClient struct {
+	*rpc.Client
+	address string
+}
+
+// rpcPool keeps up to `size` long-lived connections to the storage server and lends them to RPCs.
+// Connections that fail or time out are closed, and a new one is dialed when needed. After a
+// failed dial, no connection is attempted for a delay doubling from `minBackoff` to `maxBackoff`.
+type rpcPool struct {
+	mu      sync.Mutex
+	address func() string
+	slots   chan struct{}
+	idle    []*pooledClient
+	inUse   int
+	backoff time.Duration
+	retry   time.Time
+	lastErr error
+	closed  bool
+	metrics *metrics.Registry
+}
+
+// newRPCPool returns a pool dialing the address returned by `address`, which may change over time.
+func newRPCPool(address func() string, size int, registry *metrics.Registry) *rpcPool {
+	p := &rpcPool{address: address, slots: make(chan struct{}, size), metrics: registry}
+	registry.Collect(p.collectMetrics)
+	return p
+}
+
+// Call calls the RPC `method` on one of the connections of the pool.
+// It returns an error if no connection is available before `ctx` is done, if the connection
+// can't be established or if the call doesn't complete within `callTimeout`, or `snapshotTimeout`
+// for `Paths.TakeSnapshot`.
+func (p *rpcPool) Call(ctx context.Context, method string, args, reply interface{}) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	clt, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	timeout := callTimeout
+	if method == "Paths.TakeSnapshot" {
+		timeout = snapshotTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	call := clt.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		p.metrics.Counter("filewatcher_masterserver_storage_pool_timeouts_total",
+			"Number of RPCs to the storage server that timed out.").Inc()
+		err = fmt.Errorf("%s timed out after %s", method, timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Errors returned by the storage server leave the connection usable, any other error closes it.
+	_, serverErr := err.(rpc.ServerError)
+	p.put(clt, err == nil || serverErr)
+	return err
+}
+
+// get returns an idle connection, or dials a new one.
+func (p *rpcPool) get(ctx context.Context) (*pooledClient, error) {
+	address := p.address()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("The connection pool is closed")
+	}
+	for len(p.idle) > 0 {
+		clt := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if clt.address != address {
+			// `StorageAddress` changed since the connection was established.
+			clt.Close()
+			continue
+		}
+		p.inUse++
+		p.mu.Unlock()
+		return clt, nil
+	}
+	if time.Now().Before(p.retry) {
+		err := &errBackoff{err: p.lastErr, retry: p.retry}
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.inUse++
+	p.mu.Unlock()
+
+	endSpan := trace.FromContext(ctx).Span("dial storage")
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	endSpan()
+	p.metrics.Counter("filewatcher_masterserver_storage_pool_dials_total",
+		"Number of connections to the storage server dialed, by result.", "result").Inc(result(err))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.inUse--
+		p.backoff *= 2
+		if p.backoff < minBackoff {
+			p.backoff = minBackoff
+		} else if p.backoff > maxBackoff {
+			p.backoff = maxBackoff
+		}
+		p.retry, p.lastErr = time.Now().Add(p.backoff), err
+		log.With("address", address, "error", err, "backoff", p.backoff).Warn("Can't dial storage")
+		return nil, err
+	}
+	p.backoff = 0
+	return &pooledClient{Client: rpc.NewClient(conn), address: address}, nil
+}
+
+// put gives `clt` back to the pool, it is closed if it isn't `healthy` or if the pool is closed.
+func (p *rpcPool) put(clt *pooledClient, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse--
+	if !healthy || p.closed {
+		clt.Close()
+		return
+	}
+	p.idle = append(p.idle, clt)
+}
+
+// checkIdle pings the idle connections and closes the ones that don't answer, so that a
+// connection dropped by the storage server isn't lent to an RPC.
+func (p *rpcPool) checkIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.inUse += len(idle)
+	p.mu.Unlock()
+	for _, clt := range idle {
+		call := clt.Go("Paths.Ping", &struct{}{}, &struct{}{}, make(chan *rpc.Call, 1))
+		var err error
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(dialTimeout):
+			err = fmt.Errorf("Paths.Ping timed out after %s", dialTimeout)
+		}
+		if err != nil {
+			p.metrics.Counter("filewatcher_masterserver_storage_pool_health_check_failures_total",
+				"Number of idle connections to the storage server closed after failing a health check.").Inc()
+			log.With("address", clt.address, "error", err).Debug("Closing unhealthy connection to storage")
+		}
+		p.put(clt, err == nil)
+	}
+}
+
+// run checks the idle connections every `healthInterval` until `done` is closed.
+func (p *rpcPool) run(done <-chan struct{}) error {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkIdle()
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Close closes the idle connections, the connections in use are closed once their RPC completes.
+func (p *rpcPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, clt := range p.idle {
+		clt.Close()
+	}
+	p.idle = nil
+}
+
+func (p *rpcPool) collectMetrics() {
+	p.mu.Lock()
+	idle, inUse := len(p.idle), p.inUse
+	p.mu.Unlock()
+	conns := p.metrics.Gauge("filewatcher_masterserver_storage_pool_connections",
+		"Number of connections to the storage server, by state.", "state")
+	conns.Set(float64(idle), "idle")
+	conns.Set(float64(inUse), "in_use")
+}
+
+// result returns the label describing the outcome of an operation that returned `err`.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,130 @@
+package masterserver
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matarc/filewatcher/metrics"
+)
+
+// Slow is an RPC receiver whose calls take `Delay`.
+type Slow struct {
+	Delay time.Duration
+}
+
+func (s *Slow) Ping(_ *struct{}, _ *struct{}) error {
+	time.Sleep(s.Delay)
+	return nil
+}
+
+// serve serves the RPCs of `Slow` on `address` and returns the listener along with the number of
+// connections accepted.
+func serve(t *testing.T, address string, delay time.Duration) (net.Listener, *int32) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcSrv := rpc.NewServer()
+	rpcSrv.RegisterName("Paths", &Slow{Delay: delay})
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go rpcSrv.ServeConn(conn)
+		}
+	}()
+	return listener, accepted
+}
+
+func TestRPCPool(t *testing.T) {
+	registry := metrics.NewRegistry()
+	pool := newRPCPool(func() string { return "localhost:18480" }, 2, registry)
+	defer pool.Close()
+
+	// Storage is down, the dial fails and the next one isn't attempted until the backoff is over.
+	err := pool.Call(context.Background(), "Paths.Ping", &struct{}{}, &struct{}{})
+	if err == nil {
+		t.Fatalf("Call should fail while storage is down")
+	}
+	listener, accepted := serve(t, "localhost:18480", 0)
+	defer listener.Close()
+	err = pool.Call(context.Background(), "Paths.Ping", &struct{}{}, &struct{}{})
+	if _, ok := err.(*errBackoff); !ok {
+		t.Fatalf("Call should fail with errBackoff, instead returns '%v'", err)
+	}
+	time.Sleep(minBackoff)
+
+	// Connections are reused.
+	for i := 0; i < 5; i++ {
+		err = pool.Call(context.Background(), "Paths.Ping", &struct{}{}, &struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("A single connection should have been accepted, instead %d were", n)
+	}
+
+	// Unknown methods are server errors, which leave the connection usable.
+	err = pool.Call(context.Background(), "Paths.Unknown", &struct{}{}, &struct{}{})
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Fatalf("Call should fail with a ServerError, instead returns '%v'", err)
+	}
+	pool.checkIdle()
+	if len(pool.idle) != 1 || atomic.LoadInt32(accepted) != 1 {
+		t.Fatalf("The connection should be idle after its health check")
+	}
+
+	var buf strings.Builder
+	registry.WriteTo(&buf)
+	for _, expected := range []string{
+		`filewatcher_masterserver_storage_pool_dials_total{result="error"} 1`,
+		`filewatcher_masterserver_storage_pool_dials_total{result="ok"} 1`,
+		`filewatcher_masterserver_storage_pool_connections{state="idle"} 1`,
+		`filewatcher_masterserver_storage_pool_connections{state="in_use"} 0`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("Metrics should contain '%s', instead are '%s'", expected, buf.String())
+		}
+	}
+}
+
+func TestRPCPoolCancel(t *testing.T) {
+	listener, accepted := serve(t, "localhost:18481", time.Second)
+	defer listener.Close()
+	pool := newRPCPool(func() string { return "localhost:18481" }, 1, nil)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := pool.Call(ctx, "Paths.Ping", &struct{}{}, &struct{}{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Call should fail with '%s', instead returns '%v'", context.DeadlineExceeded, err)
+	}
+	// The connection of the abandoned call is closed, so that its reply isn't read by another call.
+	if len(pool.idle) != 0 {
+		t.Fatalf("The connection should have been closed")
+	}
+
+	// The single slot of the pool is taken, callers wait for it until their context is done.
+	pool.slots <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = pool.Call(ctx, "Paths.Ping", &struct{}{}, &struct{}{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Call should fail with '%s', instead returns '%v'", context.DeadlineExceeded, err)
+	}
+	<-pool.slots
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("A single connection should have been accepted, instead %d were", n)
+	}
+}
@@ -1,23 +1,46 @@
 package masterserver
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
-	"net/rpc"
-	"sort"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/matarc/filewatcher/health"
 	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
 	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
 )
 
 type Server struct {
 	Address        string
 	StorageAddress string
-	nodes          []shared.Node
-	listener       net.Listener
+	Credentials    []Credential
+	TLS            *TLSConfig
+	Log            *log.Config
+	AccessLog      *AccessLogConfig
+	Cache          *CacheConfig
+	Drift          *DriftConfig
+	cache          listCache
+	drift          driftStatuses
+	driftCh        chan struct{}
+	httpSrv        *http.Server
+	redirect       *http.Server
+	certs          *certLoader
+	access         *accessLogger
+	pool           *rpcPool
+	mu             sync.RWMutex
+	metrics        *metrics.Registry
+	traces         *trace.Recorder
+	lifecycle      shared.Lifecycle
 }
 
 // Init initialize the server.
@@ -30,79 +53,423 @@ func (srv *Server) Init() {
 		log.Infof("StorageAddress is unset, using default address '%s'", shared.DefaultStorageAddress)
 		srv.StorageAddress = shared.DefaultStorageAddress
 	}
+	if srv.Cache == nil {
+		log.Info("Cache is unset, asking storage on every request and serving the cached list however old it is if storage can't be reached")
+		srv.Cache = &CacheConfig{MaxStale: -1}
+	}
+	if srv.Drift == nil {
+		log.Info("Drift is unset, nodes aren't checked against their baselines")
+	} else if srv.Drift.Interval == 0 {
+		log.Infof("Drift.Interval is unset, using default interval of %d seconds", defaultDriftInterval)
+		srv.Drift.Interval = defaultDriftInterval
+	}
+	if srv.TLS != nil && srv.TLS.MinVersion == "" {
+		log.Infof("TLS.MinVersion is unset, using default version '%s'", shared.DefaultTLSMinVersion)
+		srv.TLS.MinVersion = shared.DefaultTLSMinVersion
+	}
+	srv.driftCh = make(chan struct{}, 1)
+	srv.metrics = metrics.NewRegistry()
+	srv.traces = trace.NewRecorder(shared.TracesKept)
+	srv.pool = newRPCPool(srv.storageAddress, poolSize, srv.metrics)
+}
+
+// Validate checks the settings of the server that are set.
+func (srv *Server) Validate() (errs []shared.FieldError) {
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, shared.FieldError{Field: field, Err: err})
+		}
+	}
+	if srv.Address != "" {
+		check("Address", shared.CheckAddress(srv.Address))
+	}
+	if srv.StorageAddress != "" {
+		check("StorageAddress", shared.CheckAddress(srv.StorageAddress))
+	}
+	for i := range srv.Credentials {
+		check("Credentials", srv.Credentials[i].validate())
+	}
+	if srv.TLS != nil {
+		if srv.TLS.CertFile == "" {
+			check("TLS.CertFile", fmt.Errorf("is required to enable HTTPS"))
+		} else {
+			check("TLS.CertFile", shared.CheckReadable(srv.TLS.CertFile))
+		}
+		if srv.TLS.KeyFile == "" {
+			check("TLS.KeyFile", fmt.Errorf("is required to enable HTTPS"))
+		} else {
+			check("TLS.KeyFile", shared.CheckReadable(srv.TLS.KeyFile))
+		}
+		if srv.TLS.MinVersion != "" {
+			_, err := tlsVersion(srv.TLS.MinVersion)
+			check("TLS.MinVersion", err)
+		}
+		if srv.TLS.RedirectAddress != "" {
+			check("TLS.RedirectAddress", shared.CheckAddress(srv.TLS.RedirectAddress))
+		}
+	}
+	if srv.Log != nil {
+		if field, err := srv.Log.Check(); err != nil {
+			check("Log."+field, err)
+		}
+		if srv.Log.File != nil && srv.Log.File.Path != "" {
+			check("Log.File.Path", shared.CheckWritable(srv.Log.File.Path))
+		}
+	}
+	if srv.Cache != nil {
+		if field, err := srv.Cache.check(); err != nil {
+			check("Cache."+field, err)
+		}
+	}
+	if srv.Drift != nil {
+		if field, err := srv.Drift.check(); err != nil {
+			check("Drift."+field, err)
+		}
+	}
+	if srv.AccessLog != nil {
+		if field, err := srv.AccessLog.check(); err != nil {
+			check("AccessLog."+field, err)
+		}
+		if srv.AccessLog.File != nil && srv.AccessLog.File.Path != "" {
+			check("AccessLog.File.Path", shared.CheckWritable(srv.AccessLog.File.Path))
+		}
+	}
+	return errs
 }
 
 // Run starts the masterserver by creating routes to our REST API and waiting for incoming requests.
-// It returns an error if it fails to listen.
-func (srv *Server) Run() (err error) {
-	router := mux.NewRouter()
-	// Create a route for our REST API on the method GET for list.
-	router.HandleFunc("/list", srv.SendList).Methods("GET")
-	srv.listener, err = net.Listen("tcp", srv.Address)
+// If `TLS` is set, requests are served over HTTPS.
+// The server fails if it can no longer serve requests or once `ctx` is done.
+// It returns an error if one of the credentials isn't valid, or if it fails to listen or to load
+// the certificate.
+func (srv *Server) Run(ctx context.Context) (err error) {
+	err = log.Configure("masterserver", srv.Log)
+	if err != nil {
+		return err
+	}
+	err = checkCredentials(srv.Credentials)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	var tlsCfg *tls.Config
+	if srv.TLS != nil {
+		tlsCfg, err = srv.tlsConfig()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", srv.Address)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	go http.Serve(srv.listener, router)
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+	srv.access = newAccessLogger(srv.AccessLog)
+	srv.httpSrv = &http.Server{Handler: srv.router()}
+	srv.lifecycle.Bind(ctx)
+	srv.lifecycle.Go("http server", func() error { return srv.httpSrv.Serve(listener) })
+	srv.lifecycle.Go("storage pool", func() error { return srv.pool.run(srv.lifecycle.Done()) })
+	srv.lifecycle.Go("drift check", func() error { return srv.runDriftCheck(srv.lifecycle.Done()) })
+	if srv.TLS == nil {
+		return nil
+	}
+	if srv.TLS.RedirectAddress != "" {
+		redirect, err := net.Listen("tcp", srv.TLS.RedirectAddress)
+		if err != nil {
+			log.Error(err)
+			srv.httpSrv.Close()
+			return err
+		}
+		srv.redirect = &http.Server{Handler: redirectHandler(srv.Address)}
+		srv.lifecycle.Go("redirect server", func() error { return srv.redirect.Serve(redirect) })
+	}
 	return nil
 }
 
-// Stop stops the master server and closes the listener.
-func (srv *Server) Stop() {
-	if srv.listener != nil {
-		srv.listener.Close()
+// router returns the routes of our REST API.
+func (srv *Server) router() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(srv.traceRequest, srv.logAccess, srv.instrument)
+	// Metrics and health checks are left out of authentication so that they can be scraped.
+	router.Handle("/metrics", srv.metrics).Methods("GET")
+	router.Handle("/healthz", health.Handler()).Methods("GET")
+	router.Handle("/readyz", health.Handler(health.Check{Name: "storage", Check: srv.pingStorage})).Methods("GET")
+	router.HandleFunc("/v2/openapi.json", sendOpenAPI).Methods("GET")
+	// Unmatched requests don't go through the middlewares of the router.
+	router.NotFoundHandler = srv.traceRequest(srv.logAccess(srv.instrument(http.HandlerFunc(notFound))))
+	api := router.PathPrefix("/").Subrouter()
+	api.Use(srv.authenticate)
+	// Create a route for our REST API on the method GET for list, `/list` being the first version.
+	api.HandleFunc("/debug/traces", srv.SendTraces).Methods("GET")
+	api.HandleFunc("/list", srv.SendList).Methods("GET")
+	api.HandleFunc("/v1/list", srv.SendList).Methods("GET")
+	api.HandleFunc("/v2/list", srv.ListV2).Methods("GET")
+	api.HandleFunc("/v2/diff", srv.DiffV2).Methods("GET")
+	api.HandleFunc("/v2/paths/lookup", srv.LookupPaths).Methods("POST")
+	api.HandleFunc("/v2/paths/{path:.+}/nodes", srv.NodesOfPath).Methods("GET")
+	api.HandleFunc("/v2/nodes", srv.ListNodes).Methods("GET")
+	api.HandleFunc("/v2/nodes/{id}/drift", srv.DriftV2).Methods("GET")
+	api.HandleFunc("/v2/nodes/{id}/files", srv.FilesV2).Methods("GET")
+	api.HandleFunc("/v2/nodes/{id}/history", srv.HistoryV2).Methods("GET")
+	api.HandleFunc("/v2/baselines", srv.ListBaselines).Methods("GET")
+	api.HandleFunc("/v2/baselines/{name}", srv.PinBaseline).Methods("PUT")
+	api.HandleFunc("/v2/baselines/{name}", srv.DeleteBaseline).Methods("DELETE")
+	api.HandleFunc("/v2/snapshots", srv.ListSnapshots).Methods("GET")
+	api.HandleFunc("/v2/snapshots/{name}", srv.TakeSnapshot).Methods("PUT")
+	api.HandleFunc("/v2/snapshots/{name}", srv.DeleteSnapshot).Methods("DELETE")
+	return router
+}
+
+// tlsConfig loads the certificate and returns the TLS configuration of the server.
+func (srv *Server) tlsConfig() (*tls.Config, error) {
+	minVersion, err := tlsVersion(srv.TLS.MinVersion)
+	if err != nil {
+		return nil, err
 	}
+	srv.certs, err = newCertLoader(srv.TLS.CertFile, srv.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: minVersion, GetCertificate: srv.certs.getCertificate}, nil
+}
+
+// Reload applies the configuration of `cfg`, which must be an initialised `*Server`, without
+// dropping the connections nor the cached list.
+// `StorageAddress`, `Credentials`, `Cache`, `Drift`, `Log` and `AccessLog` are replaced and the certificate
+// is read from disk again, even if its path didn't change.
+// It returns `shared.ErrRestartRequired` without applying anything if `Address` or the rest of
+// `TLS` changed, and an error without applying anything if one of the credentials isn't valid.
+func (srv *Server) Reload(cfg shared.Runnable) error {
+	newSrv, ok := cfg.(*Server)
+	if !ok {
+		return fmt.Errorf("Can't reload a masterserver with a configuration of type '%T'", cfg)
+	}
+	if err := checkCredentials(newSrv.Credentials); err != nil {
+		return err
+	}
+	if newSrv.Address != srv.Address || (newSrv.TLS == nil) != (srv.TLS == nil) {
+		return shared.ErrRestartRequired
+	}
+	if srv.TLS != nil {
+		if newSrv.TLS.MinVersion != srv.TLS.MinVersion || newSrv.TLS.RedirectAddress != srv.TLS.RedirectAddress {
+			return shared.ErrRestartRequired
+		}
+		log.Infof("Reloading certificate '%s'", newSrv.TLS.CertFile)
+		err := srv.certs.load(newSrv.TLS.CertFile, newSrv.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if newSrv.StorageAddress != srv.StorageAddress {
+		log.Infof("StorageAddress changed from '%s' to '%s'", srv.StorageAddress, newSrv.StorageAddress)
+		srv.StorageAddress = newSrv.StorageAddress
+	}
+	if !reflect.DeepEqual(newSrv.Credentials, srv.Credentials) {
+		log.Infof("Credentials changed, %d credentials are now defined", len(newSrv.Credentials))
+		srv.Credentials = newSrv.Credentials
+	}
+	if srv.TLS != nil {
+		srv.TLS.CertFile, srv.TLS.KeyFile = newSrv.TLS.CertFile, newSrv.TLS.KeyFile
+	}
+	if !reflect.DeepEqual(newSrv.Cache, srv.Cache) {
+		log.Infof("Cache changed, TTL is now %d seconds and MaxStale %d seconds", newSrv.Cache.TTL, newSrv.Cache.MaxStale)
+		srv.Cache = newSrv.Cache
+	}
+	if !reflect.DeepEqual(newSrv.Drift, srv.Drift) {
+		log.Info("Drift changed, checking the nodes again")
+		srv.Drift = newSrv.Drift
+		select {
+		case srv.driftCh <- struct{}{}:
+		default:
+		}
+	}
+	if !reflect.DeepEqual(newSrv.AccessLog, srv.AccessLog) {
+		log.Info("AccessLog changed, reopening the access log")
+		srv.access.Close()
+		srv.AccessLog, srv.access = newSrv.AccessLog, newAccessLogger(newSrv.AccessLog)
+	}
+	srv.Log = newSrv.Log
+	return log.Configure("masterserver", srv.Log)
+}
+
+// storageAddress returns the address of the storage server.
+func (srv *Server) storageAddress() string {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.StorageAddress
+}
+
+// accessLogger returns the access logger of the server, nil if the access log is disabled.
+func (srv *Server) accessLogger() *accessLogger {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.access
+}
+
+// cacheConfig returns the configuration of the cache of the list.
+func (srv *Server) cacheConfig() CacheConfig {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if srv.Cache == nil {
+		return CacheConfig{MaxStale: -1}
+	}
+	return *srv.Cache
+}
+
+// credentials returns the credentials accepted by the server.
+func (srv *Server) credentials() []Credential {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.Credentials
+}
+
+// Stop stops the master server, it closes the listeners and waits for the requests in flight
+// to complete.
+// It returns an error if the requests in flight didn't complete before `ctx` is done, in which
+// case their connections are closed.
+func (srv *Server) Stop(ctx context.Context) (err error) {
+	srv.lifecycle.Stop()
+	if srv.redirect != nil {
+		srv.redirect.Close()
+	}
+	if srv.httpSrv != nil {
+		err = srv.httpSrv.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("Requests in flight didn't complete : %s", err)
+			srv.httpSrv.Close()
+		}
+	}
+	srv.pool.Close()
+	srv.mu.Lock()
+	srv.access.Close()
+	srv.mu.Unlock()
+	return err
+}
+
+// Done returns a channel that is closed when the server fails or is stopped.
+func (srv *Server) Done() <-chan struct{} {
+	return srv.lifecycle.Done()
+}
+
+// Err returns the error that made the server fail, or nil if it didn't fail.
+func (srv *Server) Err() error {
+	return srv.lifecycle.Err()
 }
 
 // SendList is a handler for the GET `/list` method in our REST API.
-// It contacts the storage server to ask for a list of all the files watched by the nodewatchers.
-// If it fails to do so, it will just send back the last list cached.
-// If there is none it returns an error.
-// The list is json encoded and follows this format : {[Id : string, Files : [string]]}
+// It contacts the storage server to ask for a list of all the files watched by the nodewatchers,
+// unless the list it received last is younger than `Cache.TTL`.
+// If it fails to do so, it will send back the last list cached if it isn't older than allowed by
+// `Cache.MaxStale`, otherwise it returns an error.
+// The `X-Cache` header tells whether the list was a `hit`, a `miss` or `stale`, and `Age` how old
+// it is in seconds.
+// The list is sent with an `ETag` computed from the revisions of its nodes. If the request carries
+// an `If-None-Match` header matching the current revisions, it answers `304 Not Modified` without
+// fetching the list.
+// Only the nodes the credential of the request is allowed to see are sent.
+// The list is json encoded by default and follows this format : {[Id : string, Files : [string]]}
+// The `format` query parameter or the `Accept` header select another format, see `negotiate`,
+// and the list is compressed if the `Accept-Encoding` header allows it.
 func (srv *Server) SendList(w http.ResponseWriter, r *http.Request) {
-	nodes, err := srv.getList()
+	logger := log.With("request", trace.IdFromContext(r.Context()))
+	cfg := srv.cacheConfig()
+	w.Header().Set("Vary", "Authorization, Accept, Accept-Encoding")
+	rep, err := negotiate(r)
 	if err != nil {
-		// If for some reason we can't access the storage server, we'll send the list we have in cache
-		// if we have one.
-		log.Error(err)
-		if len(srv.nodes) > 0 {
-			err = json.NewEncoder(w).Encode(srv.nodes)
-			if err != nil {
-				log.Error(err)
-				http.Error(w, "Encoding issue", http.StatusInternalServerError)
-			}
-		} else {
-			http.Error(w, "Server unreachable", http.StatusBadGateway)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if tag, ok := srv.notModified(r, rep, cfg, inm); ok {
+			srv.cacheResults().Inc("not_modified")
+			w.Header().Set("ETag", tag)
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
+	}
+	list, state, age, err := srv.cache.get(r.Context(), cfg, srv.loadList)
+	if err == errTooLarge {
+		srv.streamList(w, r, rep, cfg)
 		return
 	}
-	// We cache the result in case the storage server falls.
-	srv.nodes = nodes
-	err = json.NewEncoder(w).Encode(nodes)
-	if err != nil {
-		log.Error(err)
-		http.Error(w, "Encoding issue", http.StatusInternalServerError)
+	if err != nil && state != cacheStale {
+		logger.With("error", err).Error("Can't get the list from storage")
+		http.Error(w, "Server unreachable", http.StatusBadGateway)
 		return
 	}
+	if err != nil {
+		logger.With("error", err, "age", age).Warn("Can't get the list from storage, serving the cached list")
+	}
+	srv.cacheResults().Inc(state)
+	w.Header().Set("X-Cache", state)
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	w.Header().Set("ETag", etag(r, rep, list.revision))
+	endSpan := trace.FromContext(r.Context()).Span("encode list")
+	enc := newListEncoder(w, rep)
+	for _, node := range allowedNodes(r, list.nodes) {
+		enc.write(node)
+	}
+	err = enc.end()
+	endSpan()
+	if err != nil {
+		logger.With("error", err).Error("Can't send the list")
+	}
 }
 
-// getList sends a request to the storage server to get a list of all
-func (srv *Server) getList() ([]shared.Node, error) {
-	conn, err := net.Dial("tcp", srv.StorageAddress)
+// notModified returns the entity tag of the current revisions in `rep` and true if the `If-None-Match`
+// header `inm` of `r` matches it.
+// The revisions are taken from the cache if it is fresh, from storage otherwise. If storage can't
+// be reached, it returns false so that the list is served as usual.
+func (srv *Server) notModified(r *http.Request, rep representation, cfg CacheConfig, inm string) (string, bool) {
+	list, fresh := srv.cache.fresh(cfg)
+	rev := list.revision
+	if !fresh {
+		var err error
+		rev, err = srv.getRevision(r.Context())
+		if err != nil {
+			return "", false
+		}
+	}
+	tag := etag(r, rep, rev)
+	return tag, etagMatches(inm, tag)
+}
+
+// loadList gets the revisions and then the list from the storage server.
+// It returns `errTooLarge` if the list can't be cached.
+func (srv *Server) loadList(ctx context.Context) (listing, error) {
+	rev, err := srv.getRevision(ctx)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return listing{}, err
 	}
-	rpcClt := rpc.NewClient(conn)
-	defer rpcClt.Close()
-	nodes := []shared.Node{}
-	err = rpcClt.Call("Paths.ListFiles", &struct{}{}, &nodes)
+	nodes, err := srv.getList(ctx, srv.cacheConfig().maxPaths())
 	if err != nil {
-		log.Error(err)
-		return []shared.Node{}, err
+		return listing{}, err
 	}
-	for i := range nodes {
-		sort.Strings(nodes[i].Files)
+	return listing{nodes: nodes, revision: rev}, nil
+}
+
+// getRevision sends a `Paths.Revision` RPC to the storage server.
+func (srv *Server) getRevision(ctx context.Context) (shared.Revision, error) {
+	rev := shared.Revision{}
+	endSpan := trace.FromContext(ctx).Span("Paths.Revision")
+	err := srv.pool.Call(ctx, "Paths.Revision", &struct{}{}, &rev)
+	endSpan()
+	if err != nil {
+		srv.storageFailures().Inc("Paths.Revision")
 	}
-	return nodes, nil
+	return rev, err
+}
+
+// pingStorage makes a `Paths.Ping` RPC to the storage server.
+// It returns an error if the storage server doesn't answer within `shared.PingTimeout`.
+func (srv *Server) pingStorage() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shared.PingTimeout)
+	defer cancel()
+	return srv.pool.Call(ctx, "Paths.Ping", &struct{}{}, &struct{}{})
 }
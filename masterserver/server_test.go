@@ -1,11 +1,13 @@
 package masterserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/rpc"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
 
 	"github.com/boltdb/bolt"
 	"github.com/matarc/filewatcher/log"
@@ -76,16 +79,21 @@ func Test_getList(t *testing.T) {
 	rpcSrv := rpc.NewServer()
 	paths := new(shared.Paths)
 	paths.Db = db
+	paths.Traces = trace.NewRecorder(1)
 	rpcSrv.Register(paths)
 	go rpcSrv.Accept(listener)
 	srv := new(Server)
 	shared.LoadConfig("", srv)
 
 	// Test
-	nodes, err := srv.getList()
+	tr := trace.New("my-request", "GET /list")
+	nodes, err := srv.getList(trace.NewContext(context.Background(), tr), defaultMaxPaths)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if traces := paths.Traces.Traces(); len(traces) != 1 || traces[0].Id != "my-request" {
+		t.Fatalf("Storage should have traced the request 'my-request'")
+	}
 	if len(nodes) != 1 {
 		t.Fatalf("nodes should have '1' node, instead has '%d'", len(nodes))
 	}
@@ -130,8 +138,8 @@ func TestSendList(t *testing.T) {
 	}
 	srv := new(Server)
 	shared.LoadConfig("", srv)
-	err = srv.Run()
-	defer srv.Stop()
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,6 +165,8 @@ func TestSendList(t *testing.T) {
 	paths.Db = db
 	rpcSrv.Register(paths)
 	go rpcSrv.Accept(listener)
+	// No connection is attempted until the backoff following the failed one is over.
+	time.Sleep(minBackoff)
 
 	// Test
 	res, err = http.Get(fmt.Sprintf("http://%s/list", shared.DefaultMasterserverAddress))
@@ -222,3 +232,82 @@ func TestSendList(t *testing.T) {
 		t.Fatalf("Cache wasn't saved, Status should be '%d', instead is '%s'", http.StatusOK, res.Status)
 	}
 }
+
+func TestReadyz(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18460"
+	shared.LoadConfig("", srv)
+	router := srv.router()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusServiceUnavailable, w.Code)
+	}
+
+	listener, err := net.Listen("tcp", srv.StorageAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := new(shared.Paths)
+	paths.Db = db
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	time.Sleep(minBackoff)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, w.Code)
+	}
+}
+
+func TestReload(t *testing.T) {
+	srv := new(Server)
+	srv.StorageAddress = "localhost:18461"
+	shared.LoadConfig("", srv)
+	router := srv.router()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusBadGateway, w.Code)
+	}
+
+	cfg := &Server{Address: "localhost:18462", StorageAddress: srv.StorageAddress}
+	cfg.Init()
+	err := srv.Reload(cfg)
+	if err != shared.ErrRestartRequired {
+		t.Fatalf("Reload should return '%s' when Address changes, instead returns '%v'", shared.ErrRestartRequired, err)
+	}
+
+	cfg = &Server{StorageAddress: "localhost:18463", Credentials: []Credential{{Name: "my", Token: "secret"}}}
+	cfg.Init()
+	err = srv.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.storageAddress() != "localhost:18463" {
+		t.Fatalf("StorageAddress should be 'localhost:18463', instead is '%s'", srv.storageAddress())
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/rpc"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+// maxSnapshotBody is the maximum size of the body of `PUT /v2/snapshots/{name}`, in bytes.
+const maxSnapshotBody = 1 << 10
+
+// v2NodeFiles is the list of a node in the past, as sent by `/v2/nodes/{id}/files`.
+type v2NodeFiles struct {
+	Id       string     `json:"id"`
+	At       *time.Time `json:"at,omitempty"`
+	Snapshot string     `json:"snapshot,omitempty"`
+	Files    []string   `json:"files"`
+}
+
+// v2Snapshot is a snapshot as sent by `/v2/snapshots`.
+type v2Snapshot struct {
+	Name      string    `json:"name"`
+	At        time.Time `json:"at"`
+	CreatedAt time.Time `json:"created_at"`
+	Nodes     int       `json:"nodes"`
+	Paths     int       `json:"paths"`
+}
+
+// newV2Snapshot returns `s` as sent by `/v2/snapshots` to the credential `cred`, the nodes and
+// the paths counting only the nodes it is allowed to see.
+func newV2Snapshot(s shared.Snapshot, cred *Credential) v2Snapshot {
+	snapshot := v2Snapshot{Name: s.Name, At: s.At, CreatedAt: s.Created, Nodes: s.Nodes, Paths: s.Paths}
+	if cred == nil || cred.unrestricted() {
+		return snapshot
+	}
+	snapshot.Nodes, snapshot.Paths = 0, 0
+	for id, paths := range s.NodePaths {
+		if cred.Allows(id) {
+			snapshot.Nodes++
+			snapshot.Paths += paths
+		}
+	}
+	return snapshot
+}
+
+// FilesV2 sends the list of the node of the URL as it was at the time given by the `at` query
+// parameter, in RFC 3339, or as it is in the snapshot given by the `snapshot` query parameter, in
+// an `envelope` whose data is a `v2NodeFiles`.
+// The list is paged like `/v2/list`. Storage rebuilds it from the journal, unless it comes from
+// a snapshot. A time the journal doesn't go back to is answered with `410 Gone`.
+func (srv *Server) FilesV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	query := r.URL.Query()
+	req := &shared.FilesRequest{RequestId: trace.IdFromContext(r.Context()), Node: mux.Vars(r)["id"], Snapshot: query.Get("snapshot")}
+	if (query.Get("at") == "") == (req.Snapshot == "") {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Either at or snapshot should be set")
+		return
+	}
+	data := v2NodeFiles{Id: req.Node, Snapshot: req.Snapshot}
+	if v := query.Get("at"); v != "" {
+		at, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "at should be a time in RFC 3339")
+			return
+		}
+		req.At, data.At = at, &at
+	}
+	var ok bool
+	req.Max, ok = pageLimit(w, r)
+	if !ok {
+		return
+	}
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+		return
+	}
+	req.After = cursor.After
+	if cred := credential(r); cred != nil && !cred.Allows(req.Node) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, shared.ErrUnknownNode.Error())
+		return
+	}
+	rev, err := srv.getRevision(r.Context())
+	files := &shared.Files{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.FilesAt", req, files)
+	}
+	switch {
+	case isServerError(err, shared.ErrBeforeJournal):
+		writeError(w, r, http.StatusGone, codeGone, err.Error())
+		return
+	case isServerError(err, shared.ErrUnknownNode) || isServerError(err, shared.ErrUnknownSnapshot):
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	case err != nil:
+		storageUnavailable(w, r, err, "list the files in the past")
+		return
+	}
+	data.Files = nonNil(files.Paths)
+	env := envelope{Data: data, Pagination: &pagination{Limit: req.Max, HasMore: !files.Done}}
+	if !files.Done {
+		env.Pagination.NextCursor = encodeCursor(shared.ListCursor{After: files.Next})
+	}
+	sendEnvelope(w, r, env, rev)
+}
+
+// ListSnapshots sends all the snapshots, in an `envelope` whose data is an array of `v2Snapshot`
+// counting only the nodes the credential of the request is allowed to see.
+func (srv *Server) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Authorization")
+	rev, err := srv.getRevision(r.Context())
+	snapshots := []shared.Snapshot{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.Snapshots", &struct{}{}, &snapshots)
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "get the snapshots")
+		return
+	}
+	cred, result := credential(r), []v2Snapshot{}
+	for _, s := range snapshots {
+		result = append(result, newV2Snapshot(s, cred))
+	}
+	sendEnvelope(w, r, envelope{Data: result}, rev)
+}
+
+// canManageSnapshots answers `r` with an error and returns false if its credential isn't allowed
+// to change snapshots. As snapshots hold the lists of all nodes, only credentials seeing every
+// node can take and delete them.
+func canManageSnapshots(w http.ResponseWriter, r *http.Request) bool {
+	if cred := credential(r); cred != nil && !(cred.ManageSnapshots && cred.unrestricted()) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "The credential can't manage snapshots, which requires ManageSnapshots and seeing every node")
+		return false
+	}
+	return true
+}
+
+// TakeSnapshot takes the snapshot named in the URL of the lists of all nodes, at the time given
+// by the optional json body of the request, `{"at": string}`, or now, and sends it in an
+// `envelope` whose data is a `v2Snapshot`.
+// A snapshot of the same name is replaced, unless it is being taken, which is answered with
+// `409 Conflict`.
+func (srv *Server) TakeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !canManageSnapshots(w, r) {
+		return
+	}
+	req := &shared.SnapshotRequest{RequestId: trace.IdFromContext(r.Context()), Name: mux.Vars(r)["name"]}
+	if err := shared.CheckSnapshotName(req.Name); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var body struct {
+		At time.Time `json:"at"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSnapshotBody)).Decode(&body)
+	if err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The body should be empty or {\"at\": string}, the time being in RFC 3339")
+		return
+	}
+	req.At = body.At
+	rev, err := srv.getRevision(r.Context())
+	snapshot := &shared.Snapshot{}
+	if err == nil {
+		err = srv.callStorage(r.Context(), "Paths.TakeSnapshot", req, snapshot)
+	}
+	if isServerError(err, shared.ErrSnapshotInProgress) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "take the snapshot")
+		return
+	}
+	sendEnvelope(w, r, envelope{Data: newV2Snapshot(*snapshot, credential(r))}, rev)
+}
+
+// DeleteSnapshot deletes the snapshot named in the URL and answers `204 No Content`, or
+// `409 Conflict` if it is being taken.
+func (srv *Server) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !canManageSnapshots(w, r) {
+		return
+	}
+	err := srv.callStorage(r.Context(), "Paths.DeleteSnapshot", mux.Vars(r)["name"], &struct{}{})
+	if isServerError(err, shared.ErrUnknownSnapshot) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if isServerError(err, shared.ErrSnapshotInProgress) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		storageUnavailable(w, r, err, "delete the snapshot")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestFilesV2(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18496")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	update := func(id string, event shared.Event, files ...string) {
+		tr := &shared.Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, shared.Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	update("web-1", shared.Create, "etc/a", "etc/b", "etc/c")
+	update("db-1", shared.Create, "var/lib/db")
+	before := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	update("web-1", shared.Remove, "etc/b")
+
+	srv := &Server{
+		StorageAddress: "localhost:18496",
+		Credentials: []Credential{
+			{Token: "admin", Nodes: []string{"*"}, ManageSnapshots: true},
+			{Token: "web", Nodes: []string{"web-*"}},
+			{Token: "web-ops", Nodes: []string{"web-*"}, ManageSnapshots: true},
+		},
+	}
+	srv.Init()
+	router := srv.router()
+	do := func(method, url, token, body string, v interface{}) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, r)
+		if v != nil {
+			err := json.NewDecoder(w.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	list := func(query string) []string {
+		files, url := []string{}, "/v2/nodes/web-1/files?limit=1&"+query
+		for url != "" {
+			var env struct {
+				envelope
+				Data v2NodeFiles `json:"data"`
+			}
+			if status := do("GET", url, "web", "", &env); status != http.StatusOK {
+				t.Fatalf("Status of '%s' should be '%d', instead is '%d'", url, http.StatusOK, status)
+			}
+			files = append(files, env.Data.Files...)
+			url = ""
+			if env.Pagination.HasMore {
+				url = "/v2/nodes/web-1/files?limit=1&" + query + "&cursor=" + env.Pagination.NextCursor
+			}
+		}
+		return files
+	}
+
+	at := "at=" + url.QueryEscape(before.Format(time.RFC3339Nano))
+	if files := list(at); fmt.Sprint(files) != "[etc/a etc/b etc/c]" {
+		t.Fatalf("List before the removal should be '[etc/a etc/b etc/c]', instead is '%v'", files)
+	}
+
+	body := fmt.Sprintf(`{"at": "%s"}`, before.Format(time.RFC3339Nano))
+	var e apiError
+	for _, token := range []string{"web", "web-ops"} {
+		if status := do("PUT", "/v2/snapshots/before", token, body, &e); status != http.StatusForbidden || e.Error.Code != codeForbidden {
+			t.Fatalf("Taking a snapshot with '%s' should answer '%d', instead is '%d' with '%+v'", token, http.StatusForbidden, status, e.Error)
+		}
+	}
+	var taken struct {
+		envelope
+		Data v2Snapshot `json:"data"`
+	}
+	if status := do("PUT", "/v2/snapshots/before", "admin", body, &taken); status != http.StatusOK || taken.Data.Nodes != 2 || taken.Data.Paths != 4 {
+		t.Fatalf("Snapshot should answer '%d' with '2' nodes and '4' paths, instead is '%d' with '%+v'", http.StatusOK, status, taken.Data)
+	}
+	if status := do("PUT", "/v2/snapshots/now", "admin", "", &taken); status != http.StatusOK || taken.Data.Paths != 3 {
+		t.Fatalf("Snapshot without a body should answer '%d' with '3' paths, instead is '%d' with '%+v'", http.StatusOK, status, taken.Data)
+	}
+	if files := list("snapshot=before"); fmt.Sprint(files) != "[etc/a etc/b etc/c]" {
+		t.Fatalf("List in the snapshot should be '[etc/a etc/b etc/c]', instead is '%v'", files)
+	}
+	var snapshots struct {
+		envelope
+		Data []v2Snapshot `json:"data"`
+	}
+	do("GET", "/v2/snapshots", "web", "", &snapshots)
+	if len(snapshots.Data) != 2 || snapshots.Data[0].Name != "before" {
+		t.Fatalf("Snapshots should be 'before' and 'now', instead are '%+v'", snapshots.Data)
+	}
+	// Only the nodes the credential sees are counted.
+	if s := snapshots.Data[0]; s.Nodes != 1 || s.Paths != 3 {
+		t.Fatalf("Snapshot 'before' should have '1' node and '3' paths for 'web', instead is '%+v'", s)
+	}
+	do("GET", "/v2/snapshots", "admin", "", &snapshots)
+	if s := snapshots.Data[0]; s.Nodes != 2 || s.Paths != 4 {
+		t.Fatalf("Snapshot 'before' should have '2' nodes and '4' paths for 'admin', instead is '%+v'", s)
+	}
+
+	for url, code := range map[string]string{
+		"/v2/nodes/web-1/files":                                      codeBadRequest,
+		"/v2/nodes/web-1/files?at=yesterday":                         codeBadRequest,
+		"/v2/nodes/web-1/files?at=2001-01-01T00:00:00Z":              codeGone,
+		"/v2/nodes/web-1/files?snapshot=absent":                      codeNotFound,
+		"/v2/nodes/db-1/files?snapshot=before":                       codeNotFound,
+		"/v2/nodes/web-1/files?snapshot=now&at=2001-01-01T00:00:00Z": codeBadRequest,
+	} {
+		var body apiError
+		do("GET", url, "web", "", &body)
+		if body.Error.Code != code {
+			t.Fatalf("Error of '%s' should have code '%s', instead is '%+v'", url, code, body.Error)
+		}
+	}
+
+	if status := do("DELETE", "/v2/snapshots/before", "web-ops", "", &e); status != http.StatusForbidden {
+		t.Fatalf("Deleting with 'web-ops' should answer '%d', instead is '%d'", http.StatusForbidden, status)
+	}
+	if status := do("DELETE", "/v2/snapshots/before", "admin", "", nil); status != http.StatusNoContent {
+		t.Fatalf("Deleting should answer '%d', instead is '%d'", http.StatusNoContent, status)
+	}
+	if status := do("DELETE", "/v2/snapshots/before", "admin", "", &e); status != http.StatusNotFound {
+		t.Fatalf("Deleting again should answer '%d', instead is '%d'", http.StatusNotFound, status)
+	}
+}
@@ -0,0 +1,103 @@
+package masterserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+// errTooLarge is returned when a list has more paths than a cached list can hold.
+var errTooLarge = errors.New("The list is too large to be cached")
+
+// listChunks gets the lists from the storage server one `Paths.ListChunk` RPC at a time, calling
+// `fn` with every chunk. At most `shared.MaxChunkPaths` paths are held in memory at once.
+// It stops at the first error returned by storage or by `fn`.
+func (srv *Server) listChunks(ctx context.Context, fn func(*shared.ListChunk) error) error {
+	req := &shared.ListChunkRequest{RequestId: trace.IdFromContext(ctx), Max: shared.MaxChunkPaths}
+	for {
+		chunk := &shared.ListChunk{}
+		err := srv.pool.Call(ctx, "Paths.ListChunk", req, chunk)
+		if err != nil {
+			srv.storageFailures().Inc("Paths.ListChunk")
+			return err
+		}
+		err = fn(chunk)
+		if err != nil || chunk.Done {
+			return err
+		}
+		req.Next = chunk.Next
+	}
+}
+
+// streamList writes the list to `w` in `rep` as it is received from the storage server, flushing it after
+// every chunk, so that the memory used doesn't depend on the size of the list.
+// As the status is sent before the list is received, an error from storage can only cut the
+// response short, which clients see as invalid json.
+// Once the list is sent, the cache is told whether it could hold it.
+func (srv *Server) streamList(w http.ResponseWriter, r *http.Request, rep representation, cfg CacheConfig) {
+	logger := log.With("request", trace.IdFromContext(r.Context()))
+	rev, err := srv.getRevision(r.Context())
+	if err != nil {
+		logger.With("error", err).Error("Can't get the list from storage")
+		http.Error(w, "Server unreachable", http.StatusBadGateway)
+		return
+	}
+	srv.cacheResults().Inc(cacheStream)
+	w.Header().Set("X-Cache", cacheStream)
+	w.Header().Set("Age", "0")
+	w.Header().Set("ETag", etag(r, rep, rev))
+	cred := credential(r)
+	enc := newListEncoder(w, rep)
+	paths := 0
+	endSpan := trace.FromContext(r.Context()).Span("stream list")
+	err = srv.listChunks(r.Context(), func(chunk *shared.ListChunk) error {
+		for _, part := range chunk.Parts {
+			paths += len(part.Files)
+			if cred == nil || cred.Allows(part.Id) {
+				enc.write(part)
+			}
+		}
+		return enc.flush()
+	})
+	if err == nil {
+		err = enc.end()
+	}
+	endSpan()
+	if err != nil {
+		logger.With("error", err, "paths", paths).Error("Can't stream the list")
+		return
+	}
+	srv.cache.setTooLarge(paths > cfg.maxPaths())
+}
+
+// getList gets the lists of all nodes from the storage server.
+// It returns `errTooLarge` if they hold more than `maxPaths` paths.
+func (srv *Server) getList(ctx context.Context, maxPaths int) ([]shared.Node, error) {
+	nodes := []shared.Node{}
+	paths := 0
+	endSpan := trace.FromContext(ctx).Span("Paths.ListChunk")
+	err := srv.listChunks(ctx, func(chunk *shared.ListChunk) error {
+		for _, part := range chunk.Parts {
+			paths += len(part.Files)
+			if paths > maxPaths {
+				return errTooLarge
+			}
+			if len(nodes) > 0 && nodes[len(nodes)-1].Id == part.Id {
+				last := &nodes[len(nodes)-1]
+				last.Files = append(last.Files, part.Files...)
+			} else {
+				nodes = append(nodes, part)
+			}
+		}
+		return nil
+	})
+	endSpan()
+	if err != nil {
+		return []shared.Node{}, err
+	}
+	return nodes, nil
+}
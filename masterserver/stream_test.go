@@ -0,0 +1,74 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func TestSendListStream(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18490")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	update := func(event shared.Event, files ...string) {
+		tr := &shared.Transaction{Id: "1"}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, shared.Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(shared.Create, "/a", "/b", "/c")
+
+	srv := &Server{StorageAddress: "localhost:18490", Cache: &CacheConfig{TTL: 60, MaxPaths: 2}}
+	srv.Init()
+	get := func(state string, files int) {
+		w := httptest.NewRecorder()
+		srv.SendList(w, httptest.NewRequest("GET", "/list", nil))
+		if w.Header().Get("X-Cache") != state {
+			t.Fatalf("X-Cache should be '%s', instead is '%s'", state, w.Header().Get("X-Cache"))
+		}
+		nodes := []shared.Node{}
+		err := json.NewDecoder(w.Body).Decode(&nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 1 || len(nodes[0].Files) != files {
+			t.Fatalf("The list should have '1' node with '%d' files, instead is '%v'", files, nodes)
+		}
+	}
+	get(cacheStream, 3)
+	get(cacheStream, 3)
+	update(shared.Remove, "/c")
+	get(cacheStream, 2)
+	get(cacheMiss, 2)
+	get(cacheHit, 2)
+}
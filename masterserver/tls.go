@@ -0,0 +1,93 @@
+package masterserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// TLSConfig enables HTTPS on the REST API.
+// `MinVersion` is the minimum version of TLS accepted, one of `1.0`, `1.1`, `1.2` or `1.3`.
+// If `RedirectAddress` is set, masterserver also listens for plain HTTP requests on it and
+// redirects them to HTTPS.
+type TLSConfig struct {
+	CertFile        string
+	KeyFile         string
+	MinVersion      string
+	RedirectAddress string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersion returns the TLS version matching `version`.
+// It returns an error if `version` is not a known TLS version.
+func tlsVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("'%s' is not a valid TLS version", version)
+	}
+	return v, nil
+}
+
+// certLoader holds the certificate served by masterserver and allows it to be replaced while
+// the server is running.
+type certLoader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertLoader returns a `certLoader` holding the key pair `certFile` and `keyFile`.
+// It returns an error if the key pair can't be loaded.
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	cl := new(certLoader)
+	err := cl.load(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// load reads the key pair `certFile` and `keyFile` and serves it from then on.
+// If it fails to do so, the previous key pair is kept and an error is returned.
+func (cl *certLoader) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cl.mu.Lock()
+	cl.cert = &cert
+	cl.mu.Unlock()
+	return nil
+}
+
+// getCertificate returns the current certificate, it is meant to be used as
+// `tls.Config.GetCertificate` so that new handshakes pick up a reloaded certificate while
+// established connections are left untouched.
+func (cl *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.cert, nil
+}
+
+// redirectHandler returns a handler that redirects every request to the same URL over HTTPS
+// on the port of `address`.
+func redirectHandler(address string) http.Handler {
+	_, port, _ := net.SplitHostPort(address)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,204 @@
+package masterserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+// writeKeyPair writes a self-signed certificate for `commonName` in `dir` and returns the paths
+// to the certificate and the key.
+func writeKeyPair(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_tlsVersion(t *testing.T) {
+	v, err := tlsVersion("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != tls.VersionTLS12 {
+		t.Fatalf("version should be '%d', instead is '%d'", tls.VersionTLS12, v)
+	}
+	_, err = tlsVersion("1.4")
+	if err == nil {
+		t.Fatalf("tlsVersion should return an error on an unknown version")
+	}
+}
+
+// commonName returns the common name of the certificate served by `srv`.
+func commonName(t *testing.T, srv *Server) string {
+	cert, _ := srv.certs.getCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloadCertificate(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	_, err = newCertLoader(filepath.Join(rootDir, "cert.pem"), filepath.Join(rootDir, "key.pem"))
+	if err == nil {
+		t.Fatalf("newCertLoader should return an error when the key pair doesn't exist")
+	}
+
+	certFile, keyFile := writeKeyPair(t, rootDir, "first")
+	config := func() *Server {
+		srv := &Server{StorageAddress: "localhost:18444", TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}}
+		srv.Init()
+		return srv
+	}
+	srv := config()
+	srv.certs, err = newCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, srv); name != "first" {
+		t.Fatalf("CommonName should be 'first', instead is '%s'", name)
+	}
+
+	// The certificate is read again even though its path didn't change.
+	writeKeyPair(t, rootDir, "second")
+	err = srv.Reload(config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, srv); name != "second" {
+		t.Fatalf("CommonName should be 'second', instead is '%s'", name)
+	}
+
+	// A failed reload keeps the previous certificate
+	cert, _ := srv.certs.getCertificate(nil)
+	os.Remove(keyFile)
+	err = srv.Reload(config())
+	if err == nil {
+		t.Fatalf("Reload should return an error when the key is missing")
+	}
+	if c, _ := srv.certs.getCertificate(nil); c != cert {
+		t.Fatalf("The previous certificate should have been kept")
+	}
+}
+
+func Test_redirectHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectHandler("localhost:8443").ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8080/list?a=b", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("Status should be '%d', instead is '%d'", http.StatusMovedPermanently, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://example.com:8443/list?a=b" {
+		t.Fatalf("Location should be 'https://example.com:8443/list?a=b', instead is '%s'", loc)
+	}
+
+	w = httptest.NewRecorder()
+	redirectHandler(":443").ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/list", nil))
+	if loc := w.Header().Get("Location"); loc != "https://example.com/list" {
+		t.Fatalf("Location should be 'https://example.com/list', instead is '%s'", loc)
+	}
+}
+
+func TestRunTLS(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	certFile, keyFile := writeKeyPair(t, rootDir, "localhost")
+	srv := new(Server)
+	srv.Address = "localhost:18443"
+	srv.StorageAddress = "localhost:18444"
+	srv.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile, RedirectAddress: "localhost:18080"}
+	shared.LoadConfig("", srv)
+	if srv.TLS.MinVersion != shared.DefaultTLSMinVersion {
+		t.Fatalf("MinVersion should be '%s', instead is '%s'", shared.DefaultTLSMinVersion, srv.TLS.MinVersion)
+	}
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := clt.Get("https://localhost:18443/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Status should be '%d', instead is '%s'", http.StatusBadGateway, res.Status)
+	}
+
+	res, err = clt.Get("http://localhost:18080/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("Status should be '%d', instead is '%s'", http.StatusMovedPermanently, res.Status)
+	}
+	if loc := res.Header.Get("Location"); loc != "https://localhost:18443/list" {
+		t.Fatalf("Location should be 'https://localhost:18443/list', instead is '%s'", loc)
+	}
+
+	tooOld := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS11,
+	}}}
+	_, err = tooOld.Get("https://localhost:18443/list")
+	if err == nil {
+		t.Fatalf("A client limited to TLS 1.1 should not be able to connect")
+	}
+}
@@ -0,0 +1,264 @@
+package masterserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
+)
+
+// v2Prefix starts the paths of the second version of the REST API, whose responses and errors
+// are json envelopes.
+const v2Prefix = "/v2/"
+
+// defaultPageSize is the number of paths of a page of `/v2/list` if `limit` is unset.
+const defaultPageSize = 1000
+
+// Codes of the errors of the REST API.
+const (
+	codeBadRequest         = "bad_request"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codeGone               = "gone"
+	codeStorageUnavailable = "storage_unavailable"
+)
+
+// envelope wraps every successful response of `/v2`.
+type envelope struct {
+	Data interface{} `json:"data"`
+	// Revision tags the lists the data comes from, as seen by the credential of the request.
+	Revision    string      `json:"revision"`
+	GeneratedAt time.Time   `json:"generated_at"`
+	Stale       bool        `json:"stale"`
+	Pagination  *pagination `json:"pagination,omitempty"`
+}
+
+// pagination tells how to get the page following the one sent.
+type pagination struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// apiError is the body of every error of `/v2`.
+type apiError struct {
+	Error struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestId string `json:"request_id,omitempty"`
+	} `json:"error"`
+}
+
+// v2Node is a node as sent by `/v2`.
+type v2Node struct {
+	Id    string   `json:"id"`
+	Files []string `json:"files"`
+}
+
+// writeError answers `r` with `status`, as an `apiError` with `code` and `message` if `r` is a
+// request to `/v2`, or as plain text `message` otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if !strings.HasPrefix(r.URL.Path, v2Prefix) {
+		http.Error(w, message, status)
+		return
+	}
+	body := apiError{}
+	body.Error.Code, body.Error.Message, body.Error.RequestId = code, message, trace.IdFromContext(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// revision returns the revision of the envelopes sent to `r` when the revisions are `rev`, which
+// is the entity tag of the json list without its quotes.
+func revision(r *http.Request, rev shared.Revision) string {
+	return strings.Trim(etag(r, representation{format: listJSON}, rev), `"`)
+}
+
+// notFound answers requests that don't match any route.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, v2Prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	writeError(w, r, http.StatusNotFound, codeNotFound, "No such endpoint")
+}
+
+// nonNil returns `s`, or an empty slice if it is nil, so that it is encoded as an empty array.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// pageLimit returns the `limit` query parameter of `r`, `defaultPageSize` if it is unset.
+// It answers `r` with an error and returns false if it is invalid.
+func pageLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultPageSize, true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 || limit > shared.MaxChunkPaths {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit should be a number between 1 and "+strconv.Itoa(shared.MaxChunkPaths))
+		return 0, false
+	}
+	return limit, true
+}
+
+// encodeCursor returns the opaque cursor sent to clients for `c`.
+func encodeCursor(c shared.ListCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the position `cursor` stands for, the beginning of the lists if it is empty.
+func decodeCursor(cursor string) (shared.ListCursor, error) {
+	c := shared.ListCursor{}
+	if cursor == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(b, &c)
+}
+
+// page returns the parts of `nodes` holding up to `limit` paths from `next`, as `Paths.ListChunk`
+// returns them, along with where the next page starts and whether there is one.
+// `nodes` are sorted by id and their files are sorted.
+func page(nodes []shared.Node, next shared.ListCursor, limit int) ([]shared.Node, shared.ListCursor, bool) {
+	parts, count := []shared.Node{}, 0
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i].Id >= next.Node })
+	for ; i < len(nodes); i++ {
+		files := nodes[i].Files
+		if nodes[i].Id == next.Node && next.After != "" {
+			files = files[sort.SearchStrings(files, next.After):]
+			if len(files) > 0 && files[0] == next.After {
+				files = files[1:]
+			}
+		}
+		part := shared.Node{Id: nodes[i].Id}
+		for _, file := range files {
+			if count == limit {
+				cursor := shared.ListCursor{Node: part.Id}
+				if len(part.Files) > 0 {
+					parts = append(parts, part)
+					cursor.After = part.Files[len(part.Files)-1]
+				}
+				return parts, cursor, true
+			}
+			part.Files = append(part.Files, file)
+			count++
+		}
+		parts = append(parts, part)
+	}
+	return parts, shared.ListCursor{}, false
+}
+
+// ListV2 sends a page of the list of the nodes the credential of the request is allowed to see,
+// in an `envelope` whose data is an array of `v2Node`.
+// The `limit` query parameter is the maximum number of paths of the page, 1000 by default and
+// `shared.MaxChunkPaths` at most, and `cursor` is the `next_cursor` of the previous page.
+// A node may be split over several pages, and a page may hold fewer paths than `limit` even if
+// it isn't the last one.
+// Lists too large to be cached are paged straight from storage.
+func (srv *Server) ListV2(w http.ResponseWriter, r *http.Request) {
+	logger := log.With("request", trace.IdFromContext(r.Context()))
+	w.Header().Set("Vary", "Authorization")
+	limit, ok := pageLimit(w, r)
+	if !ok {
+		return
+	}
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+		return
+	}
+
+	cfg := srv.cacheConfig()
+	list, state, age, err := srv.cache.get(r.Context(), cfg, srv.loadList)
+	var parts []shared.Node
+	var next shared.ListCursor
+	var more bool
+	if err == errTooLarge {
+		state, age = cacheStream, 0
+		list.revision, err = srv.getRevision(r.Context())
+		if err == nil {
+			parts, next, more, err = srv.getPage(r, cursor, limit)
+		}
+	} else if err == nil || state == cacheStale {
+		if err != nil {
+			logger.With("error", err, "age", age).Warn("Can't get the list from storage, serving the cached list")
+		}
+		parts, next, more = page(allowedNodes(r, list.nodes), cursor, limit)
+		err = nil
+	}
+	if err != nil {
+		logger.With("error", err).Error("Can't get the list from storage")
+		writeError(w, r, http.StatusBadGateway, codeStorageUnavailable, "Server unreachable")
+		return
+	}
+	srv.cacheResults().Inc(state)
+	w.Header().Set("X-Cache", state)
+
+	nodes := make([]v2Node, 0, len(parts))
+	for _, part := range parts {
+		nodes = append(nodes, v2Node{Id: part.Id, Files: nonNil(part.Files)})
+	}
+	env := envelope{
+		Data:        nodes,
+		Revision:    revision(r, list.revision),
+		GeneratedAt: time.Now().Add(-age).UTC(),
+		Stale:       state == cacheStale,
+		Pagination:  &pagination{Limit: limit, HasMore: more},
+	}
+	if more {
+		env.Pagination.NextCursor = encodeCursor(next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(env)
+	if err != nil {
+		logger.With("error", err).Error("Can't send the list")
+	}
+}
+
+// getPage gets a page of up to `limit` paths starting at `next` from the storage server, leaving
+// out the nodes the credential of `r` isn't allowed to see.
+func (srv *Server) getPage(r *http.Request, next shared.ListCursor, limit int) ([]shared.Node, shared.ListCursor, bool, error) {
+	req := &shared.ListChunkRequest{RequestId: trace.IdFromContext(r.Context()), Next: next, Max: limit}
+	chunk := &shared.ListChunk{}
+	endSpan := trace.FromContext(r.Context()).Span("Paths.ListChunk")
+	err := srv.pool.Call(r.Context(), "Paths.ListChunk", req, chunk)
+	endSpan()
+	if err != nil {
+		srv.storageFailures().Inc("Paths.ListChunk")
+		return nil, next, false, err
+	}
+	cred := credential(r)
+	parts := []shared.Node{}
+	for _, part := range chunk.Parts {
+		if cred == nil || cred.Allows(part.Id) {
+			parts = append(parts, part)
+		}
+	}
+	return parts, chunk.Next, !chunk.Done, nil
+}
+
+// sendOpenAPI sends the OpenAPI document describing the REST API.
+func sendOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPI))
+}
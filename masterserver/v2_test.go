@@ -0,0 +1,186 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+
+	"github.com/matarc/filewatcher/shared"
+)
+
+func Test_page(t *testing.T) {
+	nodes := []shared.Node{
+		{Id: "1", Files: []string{"/a", "/b", "/c"}},
+		{Id: "2"},
+		{Id: "3", Files: []string{"/e", "/f"}},
+	}
+	for _, limit := range []int{1, 2, 3, 100} {
+		list, next, pages := []shared.Node{}, shared.ListCursor{}, 0
+		for more := true; more; pages++ {
+			var parts []shared.Node
+			parts, next, more = page(nodes, next, limit)
+			for _, part := range parts {
+				if len(list) > 0 && list[len(list)-1].Id == part.Id {
+					list[len(list)-1].Files = append(list[len(list)-1].Files, part.Files...)
+				} else {
+					list = append(list, part)
+				}
+			}
+		}
+		if fmt.Sprint(list) != fmt.Sprint(nodes) {
+			t.Fatalf("Pages of '%d' paths should add up to '%v', instead add up to '%v'", limit, nodes, list)
+		}
+		if limit == 1 && pages != 5 {
+			t.Fatalf("There should be '5' pages of '1' path, instead there are '%d'", pages)
+		}
+	}
+}
+
+func TestListV2(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", "localhost:18492")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcSrv := rpc.NewServer()
+	paths := &shared.Paths{Db: db}
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	for _, id := range []string{"db-1", "web-1", "web-2"} {
+		tr := &shared.Transaction{Id: id, Operations: []shared.Operation{{Path: "/a", Event: shared.Create}, {Path: "/b", Event: shared.Create}}}
+		err = paths.Update(tr, new(shared.Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, maxPaths := range []int{0, 1} {
+		srv := &Server{StorageAddress: "localhost:18492", Cache: &CacheConfig{MaxPaths: maxPaths},
+			Credentials: []Credential{{Token: "web", Nodes: []string{"web-*"}}}}
+		srv.Init()
+		router := srv.router()
+		get := func(url string, v interface{}) int {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", url, nil)
+			r.Header.Set("Authorization", "Bearer web")
+			router.ServeHTTP(w, r)
+			err := json.NewDecoder(w.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return w.Code
+		}
+
+		files, url := 0, "/v2/list?limit=1"
+		for url != "" {
+			var env struct {
+				envelope
+				Data []v2Node `json:"data"`
+			}
+			if status := get(url, &env); status != http.StatusOK {
+				t.Fatalf("Status should be '%d', instead is '%d'", http.StatusOK, status)
+			}
+			if env.Revision == "" || env.GeneratedAt.IsZero() || env.Stale || env.Pagination == nil {
+				t.Fatalf("The envelope should be filled, instead is '%+v'", env.envelope)
+			}
+			for _, node := range env.Data {
+				if node.Id == "db-1" {
+					t.Fatalf("Node 'db-1' shouldn't be sent")
+				}
+				files += len(node.Files)
+			}
+			url = ""
+			if env.Pagination.HasMore {
+				url = "/v2/list?limit=1&cursor=" + env.Pagination.NextCursor
+			}
+		}
+		if files != 4 {
+			t.Fatalf("Pages should hold '4' files, instead hold '%d'", files)
+		}
+
+		for url, code := range map[string]string{
+			"/v2/list?limit=0":       codeBadRequest,
+			"/v2/list?cursor=%21%21": codeBadRequest,
+			"/v2/unknown":            codeNotFound,
+		} {
+			var body apiError
+			get(url, &body)
+			if body.Error.Code != code || body.Error.RequestId == "" {
+				t.Fatalf("Error of '%s' should have code '%s' and a request id, instead is '%+v'", url, code, body.Error)
+			}
+		}
+	}
+}
+
+func TestListV2Unauthorized(t *testing.T) {
+	srv := &Server{Credentials: []Credential{{Token: "web", Nodes: []string{"*"}}}}
+	srv.Init()
+	router := srv.router()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/list", nil))
+	var body apiError
+	err := json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnauthorized || body.Error.Code != codeUnauthorized {
+		t.Fatalf("Status should be '%d' with code '%s', instead is '%d' with '%s'", http.StatusUnauthorized, codeUnauthorized, w.Code, body.Error.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Body.String() != "Unauthorized\n" {
+		t.Fatalf("Errors of /list should be plain text, instead are '%s'", w.Body.String())
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	srv := new(Server)
+	srv.Init()
+	router := srv.router()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/openapi.json", nil))
+	var doc struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || tpl == "/" {
+			return nil
+		}
+		// Variables are written without their pattern in the document.
+		tpl = regexp.MustCompile(`\{(\w+):[^}]*\}`).ReplaceAllString(tpl, "{$1}")
+		if _, ok := doc.Paths[tpl]; !ok {
+			return fmt.Errorf("Route '%s' isn't described by the OpenAPI document", tpl)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,320 @@
+// Package metrics implements counters, gauges and histograms that can be exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, used by histograms measuring durations.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Registry holds a set of metrics and writes them in the Prometheus text format.
+// All methods are safe for concurrent use, and can be called on a nil `Registry` in which case
+// they do nothing.
+type Registry struct {
+	mu         sync.Mutex
+	families   map[string]*family
+	collectors []func()
+}
+
+// NewRegistry returns an empty `Registry`.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a metric and all its series, one for every combination of label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+// Counter is a metric that only goes up.
+type Counter struct{ f *family }
+
+// Gauge is a metric that can go up and down.
+type Gauge struct{ f *family }
+
+// Histogram counts observations in buckets.
+type Histogram struct{ f *family }
+
+// Counter returns the counter `name`, registering it if it doesn't exist yet.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	f := r.register(name, help, counterType, nil, labels)
+	if f == nil {
+		return nil
+	}
+	return &Counter{f}
+}
+
+// Gauge returns the gauge `name`, registering it if it doesn't exist yet.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	f := r.register(name, help, gaugeType, nil, labels)
+	if f == nil {
+		return nil
+	}
+	return &Gauge{f}
+}
+
+// Histogram returns the histogram `name` using `buckets` as upper bounds, registering it if it
+// doesn't exist yet.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	f := r.register(name, help, histogramType, buckets, labels)
+	if f == nil {
+		return nil
+	}
+	return &Histogram{f}
+}
+
+// Collect registers `collect` to be called before every export of the registry.
+// It allows gauges that are expensive to keep up to date to be computed only when needed.
+func (r *Registry) Collect(collect func()) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.collectors = append(r.collectors, collect)
+	r.mu.Unlock()
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series matching `labelValues`, creating it if needed.
+// It must be called with `f.mu` held.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: '%s' expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == histogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter by `v`.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.get(labelValues).value += v
+	c.f.mu.Unlock()
+}
+
+// Set sets the gauge to `v`.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.get(labelValues).value = v
+	g.f.mu.Unlock()
+}
+
+// Add adds `v` to the gauge, `v` can be negative.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.get(labelValues).value += v
+	g.f.mu.Unlock()
+}
+
+// Reset removes all the series of the gauge.
+func (g *Gauge) Reset() {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.series = make(map[string]*series)
+	g.f.mu.Unlock()
+}
+
+// Observe adds the observation `v` to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.f.mu.Lock()
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	h.f.mu.Unlock()
+}
+
+// WriteTo writes all the metrics of the registry to `w` in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	err := cw.w.Flush()
+	if cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP exposes the registry over HTTP, it's meant to be served on `/metrics`.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func (f *family) write(w *countingWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != histogramType {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelPairs(s.labelValues, "", 0), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, "le", bound), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelPairs(s.labelValues, "", 0), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelPairs(s.labelValues, "", 0), s.count)
+	}
+}
+
+// labelPairs formats the labels of a series, `extra` is an additional label with the value
+// `bound` such as the `le` label of histogram buckets.
+func (f *family) labelPairs(labelValues []string, extra string, bound float64) string {
+	if len(labelValues) == 0 && extra == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], escape(value, true)))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra, formatFloat(bound)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes `s` so that it can be used as a help text, or as a label value if `quote` is true.
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Number of requests.", "route", "code")
+	c.Inc("/list", "200")
+	c.Inc("/list", "200")
+	c.Add(3, "/list", "502")
+	if r.Counter("requests_total", "Number of requests.", "route", "code").f != c.f {
+		t.Fatalf("Registering a counter twice should return the same counter")
+	}
+	buf := new(bytes.Buffer)
+	_, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/list",code="200"} 2
+requests_total{route="/list",code="502"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Output should be '%s', instead is '%s'", expected, buf.String())
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.Gauge("paths", "Number of paths.", "node")
+	r.Collect(func() {
+		g.Reset()
+		g.Set(42, "a\"b")
+	})
+	g.Set(1, "gone")
+	buf := new(bytes.Buffer)
+	r.WriteTo(buf)
+	expected := `# HELP paths Number of paths.
+# TYPE paths gauge
+paths{node="a\"b"} 42
+`
+	if buf.String() != expected {
+		t.Fatalf("Output should be '%s', instead is '%s'", expected, buf.String())
+	}
+
+	queued := r.Gauge("queued", "Queued operations.")
+	queued.Add(5)
+	queued.Add(-2)
+	buf.Reset()
+	r.WriteTo(buf)
+	if !strings.Contains(buf.String(), "\nqueued 3\n") {
+		t.Fatalf("Output should contain 'queued 3', instead is '%s'", buf.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/list")
+	h.Observe(0.5, "/list")
+	h.Observe(2, "/list")
+	buf := new(bytes.Buffer)
+	r.WriteTo(buf)
+	expected := `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/list",le="0.1"} 1
+duration_seconds_bucket{route="/list",le="1"} 2
+duration_seconds_bucket{route="/list",le="+Inf"} 3
+duration_seconds_sum{route="/list"} 2.55
+duration_seconds_count{route="/list"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Output should be '%s', instead is '%s'", expected, buf.String())
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	r.Counter("a", "").Inc()
+	r.Gauge("b", "").Set(1)
+	r.Histogram("c", "", DefaultBuckets).Observe(1)
+	r.Collect(func() {})
+	n, err := r.WriteTo(new(bytes.Buffer))
+	if n != 0 || err != nil {
+		t.Fatalf("A nil registry should not write anything")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("a_total", "A.").Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type should be the Prometheus text format, instead is '%s'", ct)
+	}
+	if !strings.Contains(w.Body.String(), "a_total 1") {
+		t.Fatalf("Body should contain 'a_total 1', instead is '%s'", w.Body.String())
+	}
+}
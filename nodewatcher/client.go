@@ -1,27 +1,45 @@
 package nodewatcher
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/boltdb/bolt"
-
+	"github.com/matarc/filewatcher/health"
 	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
 	"github.com/matarc/filewatcher/shared"
 )
 
+// flushInterval is how often `Stop` checks whether pending operations have been sent.
+const flushInterval = 50 * time.Millisecond
+
 type Client struct {
 	StorageAddress string
+	mu             sync.Mutex
+	conn           net.Conn
+	redialCh       chan struct{}
 	quitCh         chan struct{}
+	quitOnce       sync.Once
 	buf            []shared.Operation
+	dialed         bool
+	walkAcked      int32
 	Id             string
 	Dir            string
+	MonitorAddress string
+	Log            *log.Config
 	watcher        *Watcher
 	pm             *PathManager
+	monitor        net.Listener
+	metrics        *metrics.Registry
+	lifecycle      shared.Lifecycle
 }
 
 // Init initialize the client.
@@ -44,92 +62,243 @@ func (clt *Client) Init() {
 		clt.StorageAddress = shared.DefaultStorageAddress
 	}
 	clt.quitCh = make(chan struct{})
+	clt.redialCh = make(chan struct{}, 1)
 	clt.Dir = filepath.Clean(clt.Dir)
+	clt.metrics = metrics.NewRegistry()
+	clt.metrics.Collect(clt.collectMetrics)
 }
 
-// Stop stops the client, it no longer monitor the directory after that.
-func (clt *Client) Stop() {
-	if clt.quitCh != nil {
-		close(clt.quitCh)
-		clt.quitCh = nil
+// Validate checks the settings of the client that are set.
+func (clt *Client) Validate() (errs []shared.FieldError) {
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, shared.FieldError{Field: field, Err: err})
+		}
+	}
+	if clt.StorageAddress != "" {
+		check("StorageAddress", shared.CheckAddress(clt.StorageAddress))
+	}
+	if clt.MonitorAddress != "" {
+		check("MonitorAddress", shared.CheckAddress(clt.MonitorAddress))
+	}
+	if clt.Dir != "" {
+		check("Dir", shared.CheckDir(clt.Dir))
+	}
+	if clt.Log != nil {
+		if field, err := clt.Log.Check(); err != nil {
+			check("Log."+field, err)
+		}
+		if clt.Log.File != nil && clt.Log.File.Path != "" {
+			check("Log.File.Path", shared.CheckWritable(clt.Log.File.Path))
+		}
 	}
+	return errs
+}
+
+// collectMetrics updates the gauges of the client.
+func (clt *Client) collectMetrics() {
+	clt.metrics.Gauge("filewatcher_nodewatcher_queued_operations",
+		"Number of operations waiting to be sent to the storage server.").Set(float64(clt.pending()))
+	if clt.watcher != nil {
+		clt.metrics.Gauge("filewatcher_nodewatcher_watches",
+			"Number of directories watched.").Set(float64(clt.watcher.Watches()))
+	}
+}
+
+// Stop stops the client, it no longer monitor the directory after that.
+// It waits for the operations that are still pending to be acknowledged by the storage server
+// before closing the connection.
+// It returns an error if some operations couldn't be sent before `ctx` is done.
+func (clt *Client) Stop(ctx context.Context) (err error) {
+	clt.lifecycle.Stop()
 	if clt.watcher != nil {
 		clt.watcher.Stop()
 	}
-	clt.pm.Stop()
+	err = clt.flush(ctx)
+	if err != nil {
+		log.Error(err)
+	}
+	clt.quitOnce.Do(func() {
+		close(clt.quitCh)
+	})
+	if clt.pm != nil {
+		clt.pm.Stop()
+	}
+	if clt.monitor != nil {
+		clt.monitor.Close()
+	}
+	return err
+}
+
+// Reload applies the configuration of `cfg`, which must be an initialised `*Client`, without
+// walking `Dir` again.
+// `Log` is applied in place. If `StorageAddress` changed, the client reconnects to the new address and sends the operations
+// that weren't acknowledged yet.
+// It returns `shared.ErrRestartRequired` without applying anything if `Id`, `Dir` or
+// `MonitorAddress` changed.
+func (clt *Client) Reload(cfg shared.Runnable) error {
+	newClt, ok := cfg.(*Client)
+	if !ok {
+		return fmt.Errorf("Can't reload a nodewatcher with a configuration of type '%T'", cfg)
+	}
+	if newClt.Id != clt.Id || newClt.Dir != clt.Dir || newClt.MonitorAddress != clt.MonitorAddress {
+		return shared.ErrRestartRequired
+	}
+	clt.Log = newClt.Log
+	err := log.Configure("nodewatcher", clt.Log)
+	if err != nil {
+		return err
+	}
+	clt.mu.Lock()
+	defer clt.mu.Unlock()
+	if newClt.StorageAddress == clt.StorageAddress {
+		return nil
+	}
+	log.Infof("StorageAddress changed from '%s' to '%s', reconnecting", clt.StorageAddress, newClt.StorageAddress)
+	clt.StorageAddress = newClt.StorageAddress
+	// Closing the connection makes the RPC in flight fail, the operations it carried are kept
+	// and sent again on the new connection.
+	if clt.conn != nil {
+		clt.conn.Close()
+	}
+	select {
+	case clt.redialCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// storageAddress returns the address of the storage server.
+func (clt *Client) storageAddress() string {
+	clt.mu.Lock()
+	defer clt.mu.Unlock()
+	return clt.StorageAddress
+}
+
+// pending returns the number of operations that haven't been acknowledged by the storage server.
+func (clt *Client) pending() int {
+	if clt.pm == nil {
+		return 0
+	}
+	return clt.pm.Pending()
+}
+
+// flush waits for all pending operations to be acknowledged by the storage server.
+// It returns an error if `ctx` is done before that.
+func (clt *Client) flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		pending := clt.pending()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d operations couldn't be sent to storage : %s", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
 }
 
 // dial attempts to connect to the storage server, it is a blocking until it gets a connection,
 // or until `Stop` is called.
-// If it fails to establish a connection, it will try again after 10 seconds.
+// If it fails to establish a connection, it will try again after 10 seconds, or as soon as
+// `Reload` changes `StorageAddress`.
 // Return a connection upon establishing one or `shared.ErrQuit` if the client was stopped.
 func (clt *Client) dial() (conn net.Conn, err error) {
-	log.Info("dial")
+	log.With("address", clt.storageAddress()).Debug("Dialing storage")
 	for {
-		conn, err = net.Dial("tcp", clt.StorageAddress)
+		address := clt.storageAddress()
+		conn, err = net.Dial("tcp", address)
 		if err == nil {
+			clt.mu.Lock()
+			if address != clt.StorageAddress {
+				// `Reload` changed the address while we were dialing.
+				clt.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			clt.conn = conn
+			clt.mu.Unlock()
+			if clt.dialed {
+				clt.metrics.Counter("filewatcher_nodewatcher_reconnects_total",
+					"Number of times the connection to the storage server was established again.").Inc()
+			}
+			clt.dialed = true
 			return
 		}
-		log.Error(err)
+		log.With("address", address, "error", err).Warn("Can't dial storage")
+		clt.metrics.Counter("filewatcher_nodewatcher_dial_failures_total",
+			"Number of failed attempts to connect to the storage server.").Inc()
 		// We wait 10 seconds before attempting a connection again in order to not use 100% of the CPU
 		// if the server is down.
-		log.Info("Waiting 10 seconds")
+		log.Debug("Waiting 10 seconds")
 		select {
 		case <-clt.quitCh:
 			return nil, shared.ErrQuit
+		case <-clt.redialCh:
 		case <-time.After(time.Second * 10):
 		}
 	}
-	return
 }
 
 // Run starts the client, walking through the directory and its subdirectories to list all files.
-// It will delete the remote list on the storage server before sending the current list.
+// The current list replaces the list stored by storage, only the paths that differ being recorded
+// in its journal.
 // After sending the list it will sends all updates on any file within the directory or its subdirectories.
+// If `MonitorAddress` is set, metrics and health checks are served on that address.
+// The client fails if it can no longer watch `Dir` or once `ctx` is done.
 // It returns an error if the path in `Dir` is not a directory or if it's not watchable.
-func (clt *Client) Run() error {
+func (clt *Client) Run(ctx context.Context) error {
+	err := log.Configure("nodewatcher", clt.Log)
+	if err != nil {
+		return err
+	}
 	pathCh := make(chan []shared.Operation)
 	clt.pm = NewPathManager(pathCh)
 	clt.watcher = NewWatcher(clt.Dir)
 	if clt.watcher == nil {
 		return fmt.Errorf("Watcher couldn't be initialized")
 	}
-	err := clt.watcher.CheckDir()
+	clt.watcher.metrics = clt.metrics
+	err = clt.watcher.CheckDir()
 	if err != nil {
 		return err
 	}
-	go func() {
-		clt.watcher.WatchDir(pathCh)
-		clt.watcher.HandleFileEvents(pathCh)
-	}()
+	if clt.MonitorAddress != "" {
+		log.Infof("Serving metrics and health checks on '%s'", clt.MonitorAddress)
+		clt.monitor, err = net.Listen("tcp", clt.MonitorAddress)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", clt.metrics)
+		health.Register(mux, health.Check{Name: "walk", Check: clt.checkWalk})
+		clt.lifecycle.Go("monitor server", func() error { return http.Serve(clt.monitor, mux) })
+	}
+	clt.lifecycle.Bind(ctx)
+	clt.lifecycle.Go("watcher", func() error {
+		clt.watcher.WatchDir(clt.pm.GetChan())
+		return clt.watcher.HandleFileEvents(clt.pm.GetChan())
+	})
 	go clt.run(pathCh)
 	return nil
 }
 
-// run tries to connect to the storage server.
-// It will delete the remote list on the storage server upon the first connection,
-// and then just keep establishing a new one whenever the connection is broken until `Stop` is called.
-func (clt *Client) run(pathCh <-chan []shared.Operation) {
-	for {
-		select {
-		case <-clt.quitCh:
-			return
-		default:
-		}
-		conn, err := clt.dial()
-		if err == shared.ErrQuit {
-			return
-		}
-		err = clt.deleteRemoteList(conn)
-		conn.Close()
-		// Ugly but until this issue is fixed, not much we can do about it
-		// https://github.com/golang/go/issues/23340
-		if err == nil || err.Error() == bolt.ErrBucketNotFound.Error() {
-			break
-		}
-		log.Error(err)
-	}
+// Done returns a channel that is closed when the client fails or is stopped.
+func (clt *Client) Done() <-chan struct{} {
+	return clt.lifecycle.Done()
+}
 
+// Err returns the error that made the client fail, or nil if it didn't fail.
+func (clt *Client) Err() error {
+	return clt.lifecycle.Err()
+}
+
+// run tries to connect to the storage server, and then just keeps establishing a new connection
+// whenever it is broken until `Stop` is called.
+func (clt *Client) run(pathCh <-chan []shared.Operation) {
 	for {
 		select {
 		case <-clt.quitCh:
@@ -145,18 +314,12 @@ func (clt *Client) run(pathCh <-chan []shared.Operation) {
 	}
 }
 
-// deleteRemoteList makes an RPC to delete the list on the storage server.
-// It returns an error if it fails to do so.
-func (clt *Client) deleteRemoteList(conn net.Conn) error {
-	rpcClt := rpc.NewClient(conn)
-	defer rpcClt.Close()
-	return rpcClt.Call("Paths.DeleteList", clt.Id, &struct{}{})
-}
-
 // sendList makes an RPC to send the list on the storage server as well as all,
 // updates within the watched directory and its subdirectories.
+// The first batch, which holds the walk of `Dir`, replaces the list stored by storage through
+// `Paths.Resync`, so that only the paths that changed while the client wasn't running are
+// recorded in the journal. The following batches are sent through `Paths.Update`.
 func (clt *Client) sendList(conn net.Conn, pathCh <-chan []shared.Operation) {
-	log.Info("sendList")
 	rpcClt := rpc.NewClient(conn)
 	defer rpcClt.Close()
 	for {
@@ -169,12 +332,33 @@ func (clt *Client) sendList(conn net.Conn, pathCh <-chan []shared.Operation) {
 		}
 		transaction := &shared.Transaction{Id: clt.Id, Operations: clt.buf}
 		reply := new(shared.Transaction)
-		log.Infof("Operations : '%v'", clt.buf)
-		err := rpcClt.Call("Paths.Update", transaction, reply)
+		method := "Paths.Update"
+		if atomic.LoadInt32(&clt.walkAcked) == 0 {
+			method = "Paths.Resync"
+		}
+		log.With("operations", len(clt.buf), "method", method).Debug("Sending operations")
+		err := rpcClt.Call(method, transaction, reply)
 		if err != nil {
 			log.Error(err)
 			break
 		}
+		clt.metrics.Counter("filewatcher_nodewatcher_sent_operations_total",
+			"Number of operations acknowledged by the storage server.").Add(float64(len(reply.Operations)))
+		if clt.pm != nil {
+			clt.pm.Ack(len(clt.buf))
+		}
 		clt.buf = []shared.Operation{}
+		// The walk of `Dir` is the first batch of operations handed to the client, so the first
+		// acknowledgment means that storage has the whole list.
+		atomic.StoreInt32(&clt.walkAcked, 1)
 	}
 }
+
+// checkWalk returns an error until the list of files found by the initial walk of `Dir` has
+// been acknowledged by the storage server.
+func (clt *Client) checkWalk() error {
+	if atomic.LoadInt32(&clt.walkAcked) == 0 {
+		return fmt.Errorf("The list of '%s' hasn't been acknowledged by storage yet", clt.Dir)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package nodewatcher
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -46,8 +47,8 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer listener.Close()
-	err = clt.Run()
-	defer clt.Stop()
+	err = clt.Run(context.Background())
+	defer clt.Stop(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,7 +75,7 @@ func TestRun(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	clt.Stop()
+	clt.Stop(context.Background())
 
 	myDir = filepath.Join(rootDir, "myDir")
 	err = os.Mkdir(myDir, 0000)
@@ -84,8 +85,8 @@ func TestRun(t *testing.T) {
 	clt = new(Client)
 	shared.LoadConfig("", clt)
 	clt.Dir = myDir
-	err = clt.Run()
-	defer clt.Stop()
+	err = clt.Run(context.Background())
+	defer clt.Stop(context.Background())
 	if err == nil {
 		t.Fatalf("Run should return an error when trying to watch an unreadable directory")
 	}
@@ -127,3 +128,123 @@ func TestInit(t *testing.T) {
 		t.Fatalf("StorageAddress should be 'localhost:12345', instead is '%s'", clt.StorageAddress)
 	}
 }
+
+func Test_checkWalk(t *testing.T) {
+	clt := new(Client)
+	clt.Init()
+	if clt.checkWalk() == nil {
+		t.Fatalf("checkWalk should return an error before the list is acknowledged")
+	}
+	pathCh := make(chan []shared.Operation, 1)
+	pathCh <- []shared.Operation{{Path: "my", Event: shared.Create}}
+	listener, err := net.Listen("tcp", "localhost:18470")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rpcSrv := rpc.NewServer()
+	paths := new(shared.Paths)
+	paths.Db = db
+	rpcSrv.Register(paths)
+	go rpcSrv.Accept(listener)
+	conn, err := net.Dial("tcp", "localhost:18470")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go clt.sendList(conn, pathCh)
+	for i := 0; i < 100 && clt.checkWalk() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(clt.quitCh)
+	if clt.checkWalk() != nil {
+		t.Fatalf("checkWalk should return nil once the list is acknowledged")
+	}
+}
+
+func TestStopFlush(t *testing.T) {
+	clt := new(Client)
+	clt.StorageAddress = "localhost:18471"
+	clt.Init()
+	pathCh := make(chan []shared.Operation)
+	clt.pm = NewPathManager(pathCh)
+	clt.pm.GetChan() <- []shared.Operation{{Path: "my", Event: shared.Create}}
+
+	// Storage is unreachable, the operation can't be flushed.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := clt.Stop(ctx)
+	if err == nil {
+		t.Fatalf("Stop should return an error when pending operations can't be sent")
+	}
+
+	clt = new(Client)
+	clt.StorageAddress = "localhost:18471"
+	clt.Init()
+	pathCh = make(chan []shared.Operation)
+	clt.pm = NewPathManager(pathCh)
+	clt.pm.GetChan() <- []shared.Operation{{Path: "my", Event: shared.Create}}
+	go func() {
+		operations := <-pathCh
+		clt.pm.Ack(len(operations))
+	}()
+	err = clt.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	first, err := net.Listen("tcp", "localhost:18472")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Listen("tcp", "localhost:18473")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	clt := new(Client)
+	clt.Id = "my"
+	clt.StorageAddress = "localhost:18472"
+	clt.Init()
+	conn, err := clt.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = clt.Reload(&Client{Id: "other", Dir: clt.Dir, StorageAddress: clt.StorageAddress})
+	if err != shared.ErrRestartRequired {
+		t.Fatalf("Reload should return '%s' when Id changes, instead returns '%v'", shared.ErrRestartRequired, err)
+	}
+
+	err = clt.Reload(&Client{Id: "my", Dir: clt.Dir, StorageAddress: "localhost:18473"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clt.storageAddress() != "localhost:18473" {
+		t.Fatalf("StorageAddress should be 'localhost:18473', instead is '%s'", clt.storageAddress())
+	}
+	_, err = conn.Write([]byte("data"))
+	if err == nil {
+		t.Fatalf("The connection to the previous storage address should be closed")
+	}
+	conn, err = clt.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != second.Addr().String() {
+		t.Fatalf("Client should be connected to '%s', instead is connected to '%s'", second.Addr(), conn.RemoteAddr())
+	}
+}
@@ -1,11 +1,21 @@
 package nodewatcher
 
-import "github.com/matarc/filewatcher/shared"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/matarc/filewatcher/shared"
+)
 
 type PathManager struct {
 	operations chan []shared.Operation
 	list       []shared.Operation
 	quitCh     chan struct{}
+	quitOnce   sync.Once
+	doneCh     chan struct{}
+	pendingCh  chan chan int
+	received   int64
+	acked      int64
 }
 
 // NewPathManager returns a path manager that is responsible for getting all files operations
@@ -15,6 +25,8 @@ func NewPathManager(pathCh chan<- []shared.Operation) *PathManager {
 	pm := new(PathManager)
 	pm.operations = make(chan []shared.Operation, 10)
 	pm.quitCh = make(chan struct{})
+	pm.doneCh = make(chan struct{})
+	pm.pendingCh = make(chan chan int)
 	go pm.handleList(pathCh)
 	return pm
 }
@@ -26,33 +38,67 @@ func (pm *PathManager) GetChan() chan<- []shared.Operation {
 }
 
 // handleList keeps the list of all operations that haven't been sent to the storage server yet.
+// It also answers `Pending`, so that a batch can't be taken out of `operations` without being
+// counted in between.
 func (pm *PathManager) handleList(pathCh chan<- []shared.Operation) {
+	defer close(pm.doneCh)
 	var buf []shared.Operation
 	dataSentCh := make(chan struct{})
 	for {
 		if len(buf) == 0 && len(pm.list) > 0 {
 			buf = pm.list
 			pm.list = []shared.Operation{}
-			go func() {
+			go func(buf []shared.Operation) {
 				pathCh <- buf
-				buf = []shared.Operation{}
 				dataSentCh <- struct{}{}
-			}()
+			}(buf)
 		}
 		select {
 		case operation := <-pm.operations:
+			atomic.AddInt64(&pm.received, int64(len(operation)))
 			pm.list = append(pm.list, operation...)
 		case <-dataSentCh:
+			buf = []shared.Operation{}
+		case reply := <-pm.pendingCh:
+			reply <- pm.pending()
 		case <-pm.quitCh:
 			return
 		}
 	}
 }
 
+// Ack tells the `PathManager` that `n` operations have been acknowledged by the storage server.
+func (pm *PathManager) Ack(n int) {
+	atomic.AddInt64(&pm.acked, int64(n))
+}
+
+// Pending returns the number of operations that have been sent to the `PathManager` but haven't
+// been acknowledged by the storage server yet.
+// Batches of operations still waiting in the channel returned by `GetChan` are counted as a
+// single operation, so it is only a lower bound, but it is never 0 once a batch was sent on the
+// channel and until all its operations are acknowledged.
+func (pm *PathManager) Pending() int {
+	reply := make(chan int, 1)
+	select {
+	case pm.pendingCh <- reply:
+		return <-reply
+	case <-pm.doneCh:
+		return pm.pending()
+	}
+}
+
+// pending returns the number of pending operations, batches waiting in `operations` being
+// counted as a single operation. It must be called from `handleList`, or once it has returned,
+// since a batch taken out of `operations` by `handleList` isn't counted until it is added to
+// `received`.
+func (pm *PathManager) pending() int {
+	pending := atomic.LoadInt64(&pm.received) - atomic.LoadInt64(&pm.acked)
+	return int(pending) + len(pm.operations)
+}
+
 // Stop stops the `PathManager`.
 func (pm *PathManager) Stop() {
-	if pm.quitCh != nil {
+	pm.quitOnce.Do(func() {
 		close(pm.quitCh)
-		pm.quitCh = nil
-	}
+	})
 }
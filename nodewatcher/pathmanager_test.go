@@ -2,6 +2,7 @@ package nodewatcher
 
 import (
 	"testing"
+	"time"
 
 	"github.com/matarc/filewatcher/shared"
 )
@@ -50,3 +51,58 @@ func TestGetEventsChan(t *testing.T) {
 		t.Fatal("GetEventsChan should not return a nil channel")
 	}
 }
+
+func TestPending(t *testing.T) {
+	pathCh := make(chan []shared.Operation)
+	pm := NewPathManager(pathCh)
+	defer pm.Stop()
+	if pm.Pending() != 0 {
+		t.Fatalf("Pending should be '0', instead is '%d'", pm.Pending())
+	}
+	pm.GetChan() <- []shared.Operation{{Path: "/my/path", Event: shared.Create}, {Path: "/your/path", Event: shared.Create}}
+	pm.GetChan() <- []shared.Operation{{Path: "/their/path", Event: shared.Create}}
+	// Wait for the path manager to handle the operations.
+	for i := 0; i < 100 && pm.Pending() != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pm.Pending() != 3 {
+		t.Fatalf("Pending should be '3', instead is '%d'", pm.Pending())
+	}
+	operations := <-pathCh
+	pm.Ack(len(operations))
+	operations = <-pathCh
+	if pm.Pending() != len(operations) {
+		t.Fatalf("Pending should be '%d', instead is '%d'", len(operations), pm.Pending())
+	}
+	pm.Ack(len(operations))
+	if pm.Pending() != 0 {
+		t.Fatalf("Pending should be '0', instead is '%d'", pm.Pending())
+	}
+}
+
+func TestPendingWhileHandled(t *testing.T) {
+	pathCh := make(chan []shared.Operation)
+	pm := NewPathManager(pathCh)
+	defer pm.Stop()
+	for i := 0; i < 1000; i++ {
+		pm.GetChan() <- []shared.Operation{{Path: "/my/path", Event: shared.Create}}
+		// The batch is either in the channel or being handled, it must never be missed.
+		if pm.Pending() == 0 {
+			t.Fatalf("Pending should not be '0' before the operation is acknowledged (iteration %d)", i)
+		}
+		operations := <-pathCh
+		pm.Ack(len(operations))
+	}
+	if pm.Pending() != 0 {
+		t.Fatalf("Pending should be '0', instead is '%d'", pm.Pending())
+	}
+}
+
+func TestPendingStopped(t *testing.T) {
+	pm := NewPathManager(make(chan []shared.Operation))
+	pm.GetChan() <- []shared.Operation{{Path: "/my/path", Event: shared.Create}}
+	pm.Stop()
+	if pm.Pending() != 1 {
+		t.Fatalf("Pending should be '1' once stopped, instead is '%d'", pm.Pending())
+	}
+}
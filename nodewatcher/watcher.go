@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
 	"github.com/matarc/filewatcher/shared"
 )
 
@@ -14,6 +16,9 @@ type Watcher struct {
 	dir     string
 	watcher *fsnotify.Watcher
 	quitCh  chan struct{}
+	mu      sync.Mutex
+	watches map[string]bool
+	metrics *metrics.Registry
 }
 
 // NewWatcher returns a `Watcher` that lists and keeps track of all files present in
@@ -29,9 +34,41 @@ func NewWatcher(dir string) *Watcher {
 	}
 	w.watcher = watcher
 	w.quitCh = make(chan struct{})
+	w.watches = make(map[string]bool)
 	return w
 }
 
+// add starts watching `path` and keeps track of it.
+func (w *Watcher) add(path string) error {
+	err := w.watcher.Add(path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.watches[path] = true
+	w.mu.Unlock()
+	return nil
+}
+
+// forget stops keeping track of `path` once it has been removed or renamed.
+func (w *Watcher) forget(path string) {
+	w.mu.Lock()
+	delete(w.watches, path)
+	w.mu.Unlock()
+}
+
+// Watches returns the number of directories currently watched.
+func (w *Watcher) Watches() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches)
+}
+
+func (w *Watcher) eventsTotal() *metrics.Counter {
+	return w.metrics.Counter("filewatcher_nodewatcher_events_total",
+		"Number of file events received, by event.", "event")
+}
+
 // CheckDir returns nil if `dir` is a watchable directory, an error otherwise.
 func (w *Watcher) CheckDir() error {
 	info, err := os.Lstat(w.dir)
@@ -41,7 +78,7 @@ func (w *Watcher) CheckDir() error {
 	if !info.IsDir() {
 		return fmt.Errorf("'%s' is not a directory", w.dir)
 	}
-	err = w.watcher.Add(w.dir)
+	err = w.add(w.dir)
 	if err != nil {
 		return fmt.Errorf("'%s' : %s", w.dir, err)
 	}
@@ -69,7 +106,7 @@ func (w *Watcher) WatchDir(pathCh chan<- []shared.Operation) error {
 		}
 		operations = append(operations, shared.Operation{Path: newPath, Event: shared.Create})
 		if info.IsDir() {
-			if err := w.watcher.Add(path); err != nil {
+			if err := w.add(path); err != nil {
 				log.Error(err)
 				return filepath.SkipDir
 			}
@@ -82,21 +119,31 @@ func (w *Watcher) WatchDir(pathCh chan<- []shared.Operation) error {
 
 // HandleFileEvents notifies our pathmanager whenever there are new files or deleted files in the directory watched
 // by the `Watcher` as well as its subdirectories.
-func (w *Watcher) HandleFileEvents(pathCh chan<- []shared.Operation) {
+// Errors reported by fsnotify are logged.
+// It returns an error if fsnotify stops delivering events before `Stop` is called.
+func (w *Watcher) HandleFileEvents(pathCh chan<- []shared.Operation) error {
+	errCh := w.watcher.Errors
 	for {
 		select {
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			log.Error(err)
 		case event, ok := <-w.watcher.Events:
 			if !ok {
-				return
+				return fmt.Errorf("fsnotify stopped delivering events for '%s'", w.dir)
 			}
 			if event.Op&fsnotify.Create == fsnotify.Create {
+				w.eventsTotal().Inc(shared.Create.String())
 				newPath, err := Chroot(event.Name, w.dir)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
 				if isDir(event.Name) {
-					err = w.watcher.Add(event.Name)
+					err = w.add(event.Name)
 					if err != nil {
 						log.Error(err)
 					}
@@ -105,6 +152,7 @@ func (w *Watcher) HandleFileEvents(pathCh chan<- []shared.Operation) {
 			}
 			if event.Op&fsnotify.Remove == fsnotify.Remove ||
 				event.Op&fsnotify.Rename == fsnotify.Rename {
+				w.eventsTotal().Inc(shared.Remove.String())
 				newPath, err := Chroot(event.Name, w.dir)
 				if err != nil {
 					log.Error(err)
@@ -113,10 +161,11 @@ func (w *Watcher) HandleFileEvents(pathCh chan<- []shared.Operation) {
 				if isDir(event.Name) {
 					w.watcher.Remove(event.Name)
 				}
+				w.forget(event.Name)
 				pathCh <- []shared.Operation{shared.Operation{Path: newPath, Event: shared.Remove}}
 			}
 		case <-w.quitCh:
-			return
+			return nil
 		}
 	}
 }
@@ -334,3 +334,36 @@ func Test_isDir(t *testing.T) {
 		t.Fatalf("isDir should return false on the newly created file '%s'", file.Name())
 	}
 }
+
+func TestWatches(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "nodewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	_, err = ioutil.TempDir(rootDir, "nodewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.TempFile(rootDir, "nodewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(rootDir)
+	defer w.Stop()
+	err = w.CheckDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Watches() != 1 {
+		t.Fatalf("Watches should be '1', instead is '%d'", w.Watches())
+	}
+	pathCh := make(chan []shared.Operation, 1)
+	err = w.WatchDir(pathCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Watches() != 2 {
+		t.Fatalf("Watches should be '2', instead is '%d'", w.Watches())
+	}
+}
@@ -0,0 +1,251 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+var (
+	// baselinesBucket holds a bucket per baseline, whose keys are the paths of the baseline.
+	baselinesBucket = []byte(internalPrefix + "baselines")
+	// baselineInfoBucket maps the name of every baseline to its `Baseline` encoded in json.
+	baselineInfoBucket = []byte(internalPrefix + "baselines-info")
+)
+
+// maxName is the maximum length of the name of a baseline or a snapshot.
+const maxName = 128
+
+// CheckBaselineName returns an error if `name` can't be the name of a baseline, which is made of
+// letters, digits, '.', '_' and '-' so that it can be part of a url.
+func CheckBaselineName(name string) error {
+	return checkName("baseline", name)
+}
+
+// checkName returns an error if `name` can't be the name of a baseline or a snapshot, `kind`.
+func checkName(kind, name string) error {
+	if name == "" || len(name) > maxName {
+		return fmt.Errorf("Invalid %s name '%s'", kind, name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("Invalid %s name '%s'", kind, name)
+		}
+	}
+	return nil
+}
+
+// PinBaseline is an RPC that pins the current list of the node `req.Node`, or `req.Paths` if no
+// node is given, as the baseline `req.Name` owned by `req.Owner`, and returns its description in
+// `baseline`. The baseline of the same name is replaced if `req.Replace` is true.
+// It returns `ErrUnknownNode` if the node has no list, `ErrBaselineExists` if the baseline was
+// already pinned and `req.Replace` is false, or an error if the operation can't be completed.
+func (p *Paths) PinBaseline(req *PinRequest, baseline *Baseline) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.PinBaseline", start, err) }(time.Now())
+	if err := CheckBaselineName(req.Name); err != nil {
+		return err
+	}
+	log.With("request", req.RequestId, "baseline", req.Name, "node", req.Node).Info("Pinning baseline")
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		var src *bolt.Bucket
+		if req.Node != "" {
+			if checkId(req.Node) != nil {
+				return ErrUnknownNode
+			}
+			src = tx.Bucket([]byte(req.Node))
+			if src == nil {
+				return ErrUnknownNode
+			}
+		}
+		baselines, err := tx.CreateBucketIfNotExists(baselinesBucket)
+		if err != nil {
+			return err
+		}
+		info, err := tx.CreateBucketIfNotExists(baselineInfoBucket)
+		if err != nil {
+			return err
+		}
+		if baselines.Bucket([]byte(req.Name)) != nil {
+			if !req.Replace {
+				return ErrBaselineExists
+			}
+			err = baselines.DeleteBucket([]byte(req.Name))
+			if err != nil {
+				return err
+			}
+		}
+		b, err := baselines.CreateBucket([]byte(req.Name))
+		if err != nil {
+			return err
+		}
+		if src != nil {
+			err = src.ForEach(func(k, v []byte) error {
+				return b.Put(k, []byte{})
+			})
+		} else {
+			for _, path := range req.Paths {
+				if path == "" {
+					return fmt.Errorf("Invalid path '%s'", path)
+				}
+				err = b.Put([]byte(path), []byte{})
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		// Stats of a bucket aren't up to date before the transaction is committed.
+		count := 0
+		b.ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+		*baseline = Baseline{Name: req.Name, Node: req.Node, Owner: req.Owner, Paths: count, Created: time.Now().UTC()}
+		data, err := json.Marshal(baseline)
+		if err != nil {
+			return err
+		}
+		return info.Put([]byte(req.Name), data)
+	})
+}
+
+// DeleteBaseline is an RPC that deletes the baseline `name`.
+// It returns `ErrUnknownBaseline` if there is no such baseline, or an error if the operation can't
+// be completed.
+func (p *Paths) DeleteBaseline(name string, _ *struct{}) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.DeleteBaseline", start, err) }(time.Now())
+	log.With("baseline", name).Info("Deleting baseline")
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		baselines, info := tx.Bucket(baselinesBucket), tx.Bucket(baselineInfoBucket)
+		if baselines == nil || info == nil || baselines.Bucket([]byte(name)) == nil {
+			return ErrUnknownBaseline
+		}
+		err := baselines.DeleteBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		return info.Delete([]byte(name))
+	})
+}
+
+// Baseline is an RPC that returns in `baseline` the description of the baseline `name`.
+// It returns `ErrUnknownBaseline` if there is no such baseline, or an error if the operation can't
+// be completed.
+func (p *Paths) Baseline(name string, baseline *Baseline) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Baseline", start, err) }(time.Now())
+	return p.Db.View(func(tx *bolt.Tx) error {
+		var data []byte
+		if info := tx.Bucket(baselineInfoBucket); info != nil {
+			data = info.Get([]byte(name))
+		}
+		if data == nil {
+			return ErrUnknownBaseline
+		}
+		return json.Unmarshal(data, baseline)
+	})
+}
+
+// Baselines is an RPC that returns in `list` all the baselines, sorted by name.
+// It returns an error if the operation can't be completed.
+func (p *Paths) Baselines(_ *struct{}, list *[]Baseline) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Baselines", start, err) }(time.Now())
+	return p.Db.View(func(tx *bolt.Tx) error {
+		info := tx.Bucket(baselineInfoBucket)
+		if info == nil {
+			return nil
+		}
+		return info.ForEach(func(k, v []byte) error {
+			var baseline Baseline
+			err := json.Unmarshal(v, &baseline)
+			if err != nil {
+				return err
+			}
+			*list = append(*list, baseline)
+			return nil
+		})
+	})
+}
+
+// Drift is an RPC that compares the list of the node `req.Node` with the baseline `req.Baseline`
+// and returns in `drift` up to `req.Max` paths added to the list or removed from it since the
+// baseline, following `req.After`, or only counts them over the whole list if `req.CountOnly` is
+// true.
+// It returns `ErrUnknownNode` if the node has no list, `ErrUnknownBaseline` if there is no such
+// baseline, or an error if the operation can't be completed.
+func (p *Paths) Drift(req *DriftRequest, drift *Drift) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Drift", start, err) }(time.Now())
+	max := req.Max
+	if max <= 0 || max > MaxChunkPaths {
+		max = MaxChunkPaths
+	}
+	log.With("request", req.RequestId, "node", req.Node, "baseline", req.Baseline).Debug("Comparing list with baseline")
+	return p.Db.View(func(tx *bolt.Tx) error {
+		if checkId(req.Node) != nil {
+			return ErrUnknownNode
+		}
+		node := tx.Bucket([]byte(req.Node))
+		if node == nil {
+			return ErrUnknownNode
+		}
+		var baseline *bolt.Bucket
+		if baselines := tx.Bucket(baselinesBucket); baselines != nil && req.Baseline != "" {
+			baseline = baselines.Bucket([]byte(req.Baseline))
+		}
+		if baseline == nil {
+			return ErrUnknownBaseline
+		}
+		if req.CountOnly {
+			_, drift.Done = compare(node, baseline, "", "", -1,
+				func(string) { drift.AddedCount++ },
+				func(string) { drift.RemovedCount++ })
+			return nil
+		}
+		drift.Next, drift.Done = compare(node, baseline, "", req.After, max,
+			func(path string) { drift.Added = append(drift.Added, path) },
+			func(path string) { drift.Removed = append(drift.Removed, path) })
+		return nil
+	})
+}
+
+// Nodes is an RPC that returns in `nodes` the id of every node having a list and the number of
+// paths in it, sorted by id. The numbers are the ones recorded along with the revisions, so the
+// lists aren't walked.
+// It returns an error if the operation can't be completed.
+func (p *Paths) Nodes(_ *struct{}, nodes *[]NodeInfo) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Nodes", start, err) }(time.Now())
+	return p.Db.View(func(tx *bolt.Tx) error {
+		ForEachNode(tx, func(id string, paths int) {
+			*nodes = append(*nodes, NodeInfo{Id: id, Paths: paths})
+		})
+		return nil
+	})
+}
@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDrift(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	paths := &Paths{Db: db}
+	update := func(id string, event Event, files ...string) {
+		tr := &Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("web-1", Create, "etc/a", "etc/b", "etc/c")
+
+	baseline := new(Baseline)
+	err = paths.PinBaseline(&PinRequest{Name: "golden", Node: "web-1"}, baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Paths != 3 || baseline.Node != "web-1" {
+		t.Fatalf("Baseline should have '3' paths of 'web-1', instead is '%+v'", baseline)
+	}
+	err = paths.PinBaseline(&PinRequest{Name: "manifest", Paths: []string{"etc/a", "etc/z"}, Owner: "ops"}, new(Baseline))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.PinBaseline(&PinRequest{Name: "manifest", Paths: []string{"etc/b"}}, new(Baseline))
+	if err != ErrBaselineExists {
+		t.Fatalf("PinBaseline should return '%s', instead returns '%v'", ErrBaselineExists, err)
+	}
+	err = paths.PinBaseline(&PinRequest{Name: "manifest", Paths: []string{"etc/a", "etc/z"}, Owner: "ops", Replace: true}, new(Baseline))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline = new(Baseline)
+	err = paths.Baseline("manifest", baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Owner != "ops" || baseline.Paths != 2 {
+		t.Fatalf("Baseline should have '2' paths owned by 'ops', instead is '%+v'", baseline)
+	}
+	err = paths.Baseline("absent", new(Baseline))
+	if err != ErrUnknownBaseline {
+		t.Fatalf("Baseline should return '%s', instead returns '%v'", ErrUnknownBaseline, err)
+	}
+	var baselines []Baseline
+	err = paths.Baselines(nil, &baselines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(baselines) != 2 || baselines[0].Name != "golden" || baselines[1].Name != "manifest" {
+		t.Fatalf("Baselines should be 'golden' and 'manifest', instead are '%+v'", baselines)
+	}
+
+	update("web-1", Create, "etc/d")
+	update("web-1", Remove, "etc/b")
+	for _, test := range []struct {
+		baseline, added, removed string
+	}{
+		{"golden", "[etc/d]", "[etc/b]"},
+		{"manifest", "[etc/c etc/d]", "[etc/z]"},
+	} {
+		added, removed := []string{}, []string{}
+		req := &DriftRequest{Node: "web-1", Baseline: test.baseline, Max: 1}
+		for done := false; !done; {
+			drift := new(Drift)
+			err = paths.Drift(req, drift)
+			if err != nil {
+				t.Fatal(err)
+			}
+			added, removed = append(added, drift.Added...), append(removed, drift.Removed...)
+			req.After, done = drift.Next, drift.Done
+		}
+		if fmt.Sprint(added) != test.added || fmt.Sprint(removed) != test.removed {
+			t.Fatalf("Drift from '%s' should be '%s' and '%s', instead is '%v' and '%v'", test.baseline, test.added, test.removed, added, removed)
+		}
+		drift := new(Drift)
+		err = paths.Drift(&DriftRequest{Node: "web-1", Baseline: test.baseline, CountOnly: true}, drift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drift.AddedCount != len(added) || drift.RemovedCount != len(removed) || len(drift.Added) != 0 {
+			t.Fatalf("Drift from '%s' should count '%d' and '%d' paths, instead is '%+v'", test.baseline, len(added), len(removed), drift)
+		}
+	}
+
+	err = paths.DeleteBaseline("golden", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.Drift(&DriftRequest{Node: "web-1", Baseline: "golden"}, new(Drift))
+	if err != ErrUnknownBaseline {
+		t.Fatalf("Drift should return '%s', instead returns '%v'", ErrUnknownBaseline, err)
+	}
+	err = paths.PinBaseline(&PinRequest{Name: "golden", Node: "web-2"}, new(Baseline))
+	if err != ErrUnknownNode {
+		t.Fatalf("PinBaseline should return '%s', instead returns '%v'", ErrUnknownNode, err)
+	}
+	err = paths.PinBaseline(&PinRequest{Name: "../golden"}, new(Baseline))
+	if err == nil {
+		t.Fatalf("PinBaseline should refuse the name '../golden'")
+	}
+
+	var nodes []NodeInfo
+	err = paths.Nodes(nil, &nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(nodes) != "[{web-1 3}]" {
+		t.Fatalf("Nodes should be '[{web-1 3}]', instead are '%v'", nodes)
+	}
+}
@@ -0,0 +1,313 @@
+package shared
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/matarc/filewatcher/log"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the configuration.
+const EnvPrefix = "FILEWATCHER_"
+
+// Config describes where the configuration of a `Runnable` comes from.
+// The layers are applied in the following order, each one overriding the previous ones :
+// the defaults set by `Init`, the json file `Path`, the environment variables
+// `FILEWATCHER_<COMPONENT>_<FIELD>` and the flags registered with `Flags`.
+// Nested fields are named by joining the names of their parents, for instance the environment
+// variable `FILEWATCHER_MASTERSERVER_TLS_CERTFILE` or the flag `-tls.certFile`.
+type Config struct {
+	Path      string
+	Component string
+	// Strict makes `Load` fail if `Path` can't be read or if it contains unknown fields, if an
+	// environment variable doesn't match any field, or if `Validate` finds a problem when the
+	// `Runnable` is a `Validator`.
+	Strict bool
+	// Environ is the environment in the form `key=value`, `os.Environ()` is used if it is nil.
+	Environ   []string
+	overrides []override
+}
+
+// override is the value of a flag set on the command line.
+type override struct {
+	field []string
+	value string
+}
+
+// overrideFlag is a `flag.Value` recording the values it is set to, so that they can be applied
+// after the file and the environment.
+type overrideFlag struct {
+	cfg   *Config
+	field []string
+}
+
+func (f *overrideFlag) String() string {
+	return ""
+}
+
+func (f *overrideFlag) Set(value string) error {
+	f.cfg.overrides = append(f.cfg.overrides, override{field: f.field, value: value})
+	return nil
+}
+
+// Flags registers on `flags` one flag per field of `r`, prefixed by `prefix`.
+func (cfg *Config) Flags(flags *flag.FlagSet, prefix string, r Runnable) {
+	walkFields(reflect.TypeOf(r).Elem(), nil, func(field []string, t reflect.Type) {
+		names := make([]string, len(field))
+		for i := range field {
+			names[i] = flagName(field[i])
+		}
+		usage := fmt.Sprintf("Overrides %s in the configuration of %s", strings.Join(field, "."), cfg.Component)
+		flags.Var(&overrideFlag{cfg: cfg, field: field}, prefix+strings.Join(names, "."), usage)
+	})
+}
+
+// Load builds the configuration of `r` from all its layers and initialises `r` by calling `Init`.
+// It returns an error if a value can't be parsed, or if one of the checks of `Strict` fails.
+func (cfg *Config) Load(r Runnable) error {
+	err := cfg.loadFile(r)
+	if err != nil {
+		return err
+	}
+	err = cfg.loadEnv(r)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(r).Elem()
+	for _, o := range cfg.overrides {
+		err = setField(v, o.field, o.value)
+		if err != nil {
+			return fmt.Errorf("flag '%s' : %s", strings.Join(o.field, "."), err)
+		}
+	}
+	if validator, ok := r.(Validator); ok && cfg.Strict {
+		errs := validator.Validate()
+		if len(errs) > 0 {
+			msgs := make([]string, len(errs))
+			for i := range errs {
+				msgs[i] = errs[i].Error()
+			}
+			return fmt.Errorf("Invalid configuration : %s", strings.Join(msgs, ", "))
+		}
+	}
+	r.Init()
+	return nil
+}
+
+// loadFile decodes the json file `Path` in `r`.
+// If `Strict` is false, a file that can't be read or decoded is logged and ignored.
+func (cfg *Config) loadFile(r Runnable) error {
+	file, err := os.Open(cfg.Path)
+	if err != nil {
+		if cfg.Strict {
+			return err
+		}
+		log.Warnf("Can't open '%s', using default configuration instead", cfg.Path)
+		return nil
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	if cfg.Strict {
+		dec.DisallowUnknownFields()
+	}
+	err = dec.Decode(r)
+	if err != nil {
+		if cfg.Strict {
+			return fmt.Errorf("Can't decode '%s' : %s", cfg.Path, err)
+		}
+		log.Errorf("Can't decode '%s' as a json file, using default configuration instead", cfg.Path)
+	}
+	return nil
+}
+
+// loadEnv applies the environment variables `FILEWATCHER_<COMPONENT>_<FIELD>` to `r`.
+func (cfg *Config) loadEnv(r Runnable) error {
+	if cfg.Component == "" {
+		return nil
+	}
+	environ := cfg.Environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	prefix := EnvPrefix + strings.ToUpper(cfg.Component) + "_"
+	fields := make(map[string][]string)
+	walkFields(reflect.TypeOf(r).Elem(), nil, func(field []string, t reflect.Type) {
+		fields[prefix+strings.ToUpper(strings.Join(field, "_"))] = field
+	})
+	v := reflect.ValueOf(r).Elem()
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], prefix) {
+			continue
+		}
+		key, value := kv[:i], kv[i+1:]
+		field, ok := fields[key]
+		if !ok {
+			if cfg.Strict {
+				return fmt.Errorf("Unknown environment variable '%s'", key)
+			}
+			log.Warnf("Unknown environment variable '%s', ignoring it", key)
+			continue
+		}
+		err := setField(v, field, value)
+		if err != nil {
+			return fmt.Errorf("'%s' : %s", key, err)
+		}
+	}
+	return nil
+}
+
+// walkFields calls `fn` for every exported field of the struct type `t` that can be configured.
+// Fields that are structs or pointers to structs are walked instead, `field` being the path of
+// their parents.
+func walkFields(t reflect.Type, field []string, fn func(field []string, t reflect.Type)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous || f.Tag.Get("json") == "-" {
+			continue
+		}
+		path := append(append([]string{}, field...), f.Name)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			walkFields(ft, path, fn)
+			continue
+		}
+		fn(path, f.Type)
+	}
+}
+
+// setField parses `value` and stores it in the field of the struct `v` found by following
+// `field`, allocating the pointers to structs on the way.
+// Strings are used as is, numbers, booleans and durations are parsed and every other type is
+// decoded as json.
+func setField(v reflect.Value, field []string, value string) error {
+	for _, name := range field {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.FieldByName(name)
+	}
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
+
+// flagName returns the name of the flag for the field `name`, that is `name` with its leading
+// capitals in lower case : `StorageAddress` becomes `storageAddress` and `TLS` becomes `tls`.
+func flagName(name string) string {
+	runes := []rune(name)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		// The last capital of an acronym starts the next word, as in `HTTPServer`.
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// RedactSecrets returns a copy of the configuration `r`, a pointer to a struct, in which the
+// non-empty string fields tagged `secret:"true"` are replaced by `***`, so that it can be printed.
+// It returns an error if `r` can't be copied.
+func RedactSecrets(r interface{}) (interface{}, error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	c := reflect.New(reflect.TypeOf(r).Elem())
+	err = json.Unmarshal(buf, c.Interface())
+	if err != nil {
+		return nil, err
+	}
+	redact(c.Elem())
+	return c.Interface(), nil
+}
+
+// redact replaces the secrets found in `v`, see `RedactSecrets`.
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			redact(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i))
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			redact(e)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.String {
+				if v.Field(i).String() != "" {
+					v.Field(i).SetString("***")
+				}
+				continue
+			}
+			redact(v.Field(i))
+		}
+	}
+}
+
+// PrintConfig writes the configuration of `r` to `stdout` as indented json.
+func PrintConfig(r interface{}) error {
+	buf, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", buf)
+	return err
+}
@@ -0,0 +1,172 @@
+package shared
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type nested struct {
+	CertFile string
+	Port     int
+}
+
+type configured struct {
+	Address string
+	Timeout time.Duration
+	Verbose bool
+	Nodes   []string
+	TLS     *nested
+	secret  string
+}
+
+func (c *configured) Init() {
+	if c.Address == "" {
+		c.Address = "localhost:8080"
+	}
+}
+func (c *configured) Run(ctx context.Context) error  { return nil }
+func (c *configured) Stop(ctx context.Context) error { return nil }
+func (c *configured) Done() <-chan struct{}          { return nil }
+func (c *configured) Err() error                     { return nil }
+
+func Test_flagName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"StorageAddress": "storageAddress",
+		"TLS":            "tls",
+		"Id":             "id",
+		"HTTPServer":     "httpServer",
+	} {
+		if flagName(name) != expected {
+			t.Fatalf("flagName('%s') should be '%s', instead is '%s'", name, expected, flagName(name))
+		}
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.WriteString(`{"Address": "file:1", "Timeout": 1000, "Nodes": ["a"], "TLS": {"CertFile": "file.pem"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Path: file.Name(), Component: "test", Environ: []string{
+		"FILEWATCHER_TEST_ADDRESS=env:1",
+		"FILEWATCHER_TEST_TLS_PORT=443",
+		"FILEWATCHER_TEST_NODES=[\"b\", \"c\"]",
+		"FILEWATCHER_OTHER_ADDRESS=other:1",
+	}}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.Flags(flags, "", new(configured))
+	err = flags.Parse([]string{"-address", "flag:1", "-timeout", "2s", "-verbose", "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.Lookup("secret") != nil {
+		t.Fatalf("Unexported fields should not have a flag")
+	}
+	c := new(configured)
+	err = cfg.Load(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != "flag:1" {
+		t.Fatalf("Address should be 'flag:1', instead is '%s'", c.Address)
+	}
+	if c.Timeout != 2*time.Second {
+		t.Fatalf("Timeout should be '2s', instead is '%s'", c.Timeout)
+	}
+	if !c.Verbose {
+		t.Fatalf("Verbose should be true")
+	}
+	if len(c.Nodes) != 2 || c.Nodes[0] != "b" {
+		t.Fatalf("Nodes should be '[b c]', instead is '%v'", c.Nodes)
+	}
+	if c.TLS.CertFile != "file.pem" || c.TLS.Port != 443 {
+		t.Fatalf("TLS should be '{file.pem 443}', instead is '%v'", *c.TLS)
+	}
+
+	// Defaults are applied to the fields left unset
+	c = new(configured)
+	err = (&Config{Path: "", Component: "test", Environ: []string{"FILEWATCHER_TEST_TLS_CERTFILE=env.pem"}}).Load(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != "localhost:8080" {
+		t.Fatalf("Address should be 'localhost:8080', instead is '%s'", c.Address)
+	}
+	if c.TLS == nil || c.TLS.CertFile != "env.pem" {
+		t.Fatalf("TLS.CertFile should be 'env.pem', instead is '%v'", c.TLS)
+	}
+
+	err = (&Config{Component: "test", Environ: []string{"FILEWATCHER_TEST_TLS_PORT=https"}}).Load(new(configured))
+	if err == nil {
+		t.Fatalf("Load should return an error when a value can't be parsed")
+	}
+}
+
+func TestConfigStrict(t *testing.T) {
+	file, err := ioutil.TempFile("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.WriteString(`{"Adress": "file:1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&Config{Path: file.Name()}).Load(new(configured))
+	if err != nil {
+		t.Fatalf("Unknown fields should be ignored when not strict, instead Load returns '%s'", err)
+	}
+	err = (&Config{Path: file.Name(), Strict: true}).Load(new(configured))
+	if err == nil {
+		t.Fatalf("Load should return an error on unknown fields when strict")
+	}
+	err = (&Config{Path: file.Name() + "missing", Strict: true}).Load(new(configured))
+	if err == nil {
+		t.Fatalf("Load should return an error on a missing file when strict")
+	}
+	err = (&Config{Component: "test", Strict: true, Environ: []string{"FILEWATCHER_TEST_ADRESS=env:1"}}).Load(new(configured))
+	if err == nil {
+		t.Fatalf("Load should return an error on an unknown environment variable when strict")
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	type account struct {
+		Name     string
+		Password string `secret:"true"`
+	}
+	type withSecrets struct {
+		Token    string `secret:"true"`
+		Empty    string `secret:"true"`
+		Accounts []account
+		Admin    *account
+	}
+	cfg := &withSecrets{Token: "s3cr3t", Accounts: []account{{Name: "ops", Password: "hunter2"}}, Admin: &account{Name: "root", Password: "toor"}}
+	redacted, err := RedactSecrets(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := redacted.(*withSecrets)
+	if r.Token != "***" || r.Empty != "" || r.Accounts[0].Password != "***" || r.Admin.Password != "***" {
+		t.Fatalf("Secrets should be replaced by '***', instead are '%+v'", r)
+	}
+	if r.Accounts[0].Name != "ops" || r.Admin.Name != "root" {
+		t.Fatalf("Other fields should be kept, instead are '%+v'", r)
+	}
+	if cfg.Token != "s3cr3t" || cfg.Accounts[0].Password != "hunter2" || cfg.Admin.Password != "toor" {
+		t.Fatalf("The configuration should be left untouched, instead is '%+v'", cfg)
+	}
+}
@@ -1,7 +1,16 @@
 package shared
 
+import "time"
+
 const (
 	DefaultMasterserverAddress = "localhost:8080"
 	DefaultStorageAddress      = "localhost:8081"
 	DefaultDbPath              = "mydb.bolt"
+	DefaultTLSMinVersion       = "1.2"
+	PingTimeout                = 2 * time.Second
+	DefaultShutdownTimeout     = 10 * time.Second
+	// TracesKept is the number of traces kept by each component for `/debug/traces`.
+	TracesKept = 100
+	// MaxChunkPaths is the maximum number of paths sent in a chunk by `Paths.ListChunk`.
+	MaxChunkPaths = 10000
 )
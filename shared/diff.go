@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+// Diff is an RPC that compares the lists of the nodes `req.A` and `req.B` and returns in `diff`
+// up to `req.Max` paths starting with `req.Prefix` that are only in one of them, following
+// `req.After`.
+// Both lists are walked in order, side by side, so that neither is loaded in memory.
+// It returns `ErrUnknownNode` if one of the nodes has no list, or an error if the operation can't
+// be completed.
+func (p *Paths) Diff(req *DiffRequest, diff *Diff) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Diff", start, err) }(time.Now())
+	max := req.Max
+	if max <= 0 || max > MaxChunkPaths {
+		max = MaxChunkPaths
+	}
+	log.With("request", req.RequestId, "a", req.A, "b", req.B, "prefix", req.Prefix).Debug("Comparing lists")
+	return p.Db.View(func(tx *bolt.Tx) error {
+		if checkId(req.A) != nil || checkId(req.B) != nil {
+			return ErrUnknownNode
+		}
+		a, b := tx.Bucket([]byte(req.A)), tx.Bucket([]byte(req.B))
+		if a == nil || b == nil {
+			return ErrUnknownNode
+		}
+		diff.Next, diff.Done = compare(a, b, req.Prefix, req.After, max,
+			func(path string) { diff.OnlyA = append(diff.OnlyA, path) },
+			func(path string) { diff.OnlyB = append(diff.OnlyB, path) })
+		return nil
+	})
+}
+
+// compare walks the paths of the buckets `a` and `b` starting with `prefix` and following `after`
+// in order, side by side, and calls `onlyA` or `onlyB` with up to `max` paths that are only in one
+// of them, or with all of them if `max` is negative.
+// It returns the last path reported, and whether all paths were compared.
+func compare(a, b *bolt.Bucket, prefix, after string, max int, onlyA, onlyB func(path string)) (last string, done bool) {
+	start := prefix
+	if after > start {
+		start = after
+	}
+	seek := func(c *bolt.Cursor) []byte {
+		k, _ := c.Seek([]byte(start))
+		if k != nil && after != "" && string(k) == after {
+			k, _ = c.Next()
+		}
+		if !bytes.HasPrefix(k, []byte(prefix)) {
+			return nil
+		}
+		return k
+	}
+	next := func(c *bolt.Cursor) []byte {
+		k, _ := c.Next()
+		if !bytes.HasPrefix(k, []byte(prefix)) {
+			return nil
+		}
+		return k
+	}
+	ca, cb := a.Cursor(), b.Cursor()
+	ka, kb := seek(ca), seek(cb)
+	for count := 0; ka != nil || kb != nil; {
+		cmp := bytes.Compare(ka, kb)
+		if ka == nil {
+			cmp = 1
+		} else if kb == nil {
+			cmp = -1
+		}
+		if cmp == 0 {
+			// Paths in both lists don't differ as long as lists don't hold any metadata.
+			ka, kb = next(ca), next(cb)
+			continue
+		}
+		if count == max {
+			return last, false
+		}
+		if cmp < 0 {
+			last = string(ka)
+			onlyA(last)
+			ka = next(ca)
+		} else {
+			last = string(kb)
+			onlyB(last)
+			kb = next(cb)
+		}
+		count++
+	}
+	return last, true
+}
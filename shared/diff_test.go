@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDiff(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	paths := &Paths{Db: db}
+	for id, files := range map[string][]string{
+		"blue":  {"app/a", "app/b", "app/c", "etc/x", "var/z"},
+		"green": {"app/b", "app/d", "etc/x", "etc/y"},
+	} {
+		tr := &Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, Operation{Path: file, Event: Create})
+		}
+		err = paths.Update(tr, new(Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		prefix       string
+		max          int
+		onlyA, onlyB string
+		pages        int
+	}{
+		{"", 100, "[app/a app/c var/z]", "[app/d etc/y]", 1},
+		{"", 1, "[app/a app/c var/z]", "[app/d etc/y]", 5},
+		{"app/", 2, "[app/a app/c]", "[app/d]", 2},
+		{"etc/x", 100, "[]", "[]", 1},
+	} {
+		onlyA, onlyB, pages := []string{}, []string{}, 0
+		req := &DiffRequest{A: "blue", B: "green", Prefix: test.prefix, Max: test.max}
+		for done := false; !done; pages++ {
+			diff := new(Diff)
+			err = paths.Diff(req, diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			onlyA, onlyB = append(onlyA, diff.OnlyA...), append(onlyB, diff.OnlyB...)
+			req.After, done = diff.Next, diff.Done
+		}
+		if fmt.Sprint(onlyA) != test.onlyA || fmt.Sprint(onlyB) != test.onlyB {
+			t.Fatalf("Diff with prefix '%s' should be '%s' and '%s', instead is '%v' and '%v'", test.prefix, test.onlyA, test.onlyB, onlyA, onlyB)
+		}
+		if pages != test.pages {
+			t.Fatalf("Diff with prefix '%s' and max '%d' should take '%d' pages, instead takes '%d'", test.prefix, test.max, test.pages, pages)
+		}
+	}
+
+	err = paths.Diff(&DiffRequest{A: "blue", B: "red"}, new(Diff))
+	if err != ErrUnknownNode {
+		t.Fatalf("Diff should return '%s', instead returns '%v'", ErrUnknownNode, err)
+	}
+}
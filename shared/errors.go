@@ -2,4 +2,24 @@ package shared
 
 import "fmt"
 
-var ErrQuit = fmt.Errorf("Quit")
+var (
+	ErrQuit         = fmt.Errorf("Quit")
+	ErrShuttingDown = fmt.Errorf("Shutting down")
+	// ErrRestartRequired is returned by `Reloadable.Reload` when the new configuration can't be
+	// applied to a running instance.
+	ErrRestartRequired = fmt.Errorf("Restart required")
+	// ErrUnknownNode is returned by RPCs asked about a node that has no list.
+	ErrUnknownNode = fmt.Errorf("Unknown node")
+	// ErrUnknownBaseline is returned by RPCs asked about a baseline that wasn't pinned.
+	ErrUnknownBaseline = fmt.Errorf("Unknown baseline")
+	// ErrBaselineExists is returned by `Paths.PinBaseline` when the baseline was already pinned and
+	// wasn't asked to be replaced.
+	ErrBaselineExists = fmt.Errorf("Baseline already exists")
+	// ErrUnknownSnapshot is returned by RPCs asked about a snapshot that wasn't taken.
+	ErrUnknownSnapshot = fmt.Errorf("Unknown snapshot")
+	// ErrSnapshotInProgress is returned by RPCs changing a snapshot that is being taken.
+	ErrSnapshotInProgress = fmt.Errorf("Snapshot is being taken")
+	// ErrBeforeJournal is returned by RPCs asked about a list at a time the journal doesn't go
+	// back to.
+	ErrBeforeJournal = fmt.Errorf("The journal doesn't go back that far")
+)
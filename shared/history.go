@@ -0,0 +1,156 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+// historyBucket holds a bucket per node indexing its journal by path, through keys made of the
+// path and the key of the change in the journal separated by `indexSeparator`, so that the
+// changes of a path are a range of keys in order. The values are the events.
+var historyBucket = []byte(internalPrefix + "history")
+
+// historyKey returns the key of the history recording the change of `path` under `key` in the
+// journal.
+func historyKey(path string, key []byte) []byte {
+	return append([]byte(path+indexSeparator), key...)
+}
+
+// recordHistory records in the history of the node `id` that `event` happened to `path`, the
+// change being recorded under `key` in the journal.
+func recordHistory(tx *bolt.Tx, id, path string, key []byte, event Event) error {
+	root, err := tx.CreateBucketIfNotExists(historyBucket)
+	if err != nil {
+		return err
+	}
+	b, err := root.CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(event))
+	return b.Put(historyKey(path, key), value)
+}
+
+// forgetHistory removes from the history of the node `id` the change of `path` recorded under
+// `key` in the journal.
+func forgetHistory(tx *bolt.Tx, id, path string, key []byte) error {
+	root := tx.Bucket(historyBucket)
+	if root == nil {
+		return nil
+	}
+	b := root.Bucket([]byte(id))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(historyKey(path, key))
+}
+
+// BuildHistory fills the history from the journal if the database doesn't have one yet, which is
+// the case of databases whose journal was started before the history existed.
+func (p *Paths) BuildHistory() error {
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(historyBucket) != nil {
+			return nil
+		}
+		start := time.Now()
+		_, err := tx.CreateBucket(historyBucket)
+		if err != nil {
+			return err
+		}
+		journal := tx.Bucket(journalBucket)
+		if journal == nil {
+			return nil
+		}
+		var ids [][]byte
+		journal.ForEach(func(id, _ []byte) error {
+			ids = append(ids, append([]byte{}, id...))
+			return nil
+		})
+		count := 0
+		for _, id := range ids {
+			err = journal.Bucket(id).ForEach(func(k, v []byte) error {
+				event, path := journalEntry(v)
+				count++
+				return recordHistory(tx, string(id), path, k, event)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		log.With("changes", count, "duration", time.Since(start)).Info("Built the history of the paths")
+		return nil
+	})
+}
+
+// History is an RPC that returns in `history` up to `req.Max` changes of the path `req.Path` of
+// the node `req.Node` recorded in the journal, in order and following `req.After`.
+// It returns `ErrUnknownNode` if the node never had a list, or an error if the operation can't be
+// completed.
+func (p *Paths) History(req *HistoryRequest, history *History) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.History", start, err) }(time.Now())
+	max := req.Max
+	if max <= 0 || max > MaxChunkPaths {
+		max = MaxChunkPaths
+	}
+	after, err := hex.DecodeString(req.After)
+	if err != nil {
+		return err
+	}
+	log.With("request", req.RequestId, "node", req.Node, "path", req.Path).Debug("Reading history")
+	return p.Db.View(func(tx *bolt.Tx) error {
+		if checkId(req.Node) != nil {
+			return ErrUnknownNode
+		}
+		var since []byte
+		if b := tx.Bucket(journalSinceBucket); b != nil {
+			since = b.Get([]byte(req.Node))
+		}
+		if since == nil {
+			if tx.Bucket([]byte(req.Node)) == nil {
+				return ErrUnknownNode
+			}
+			history.Done = true
+			return nil
+		}
+		history.Since = keyTime(since)
+		var b *bolt.Bucket
+		if root := tx.Bucket(historyBucket); root != nil {
+			b = root.Bucket([]byte(req.Node))
+		}
+		if b == nil {
+			history.Done = true
+			return nil
+		}
+		prefix := []byte(req.Path + indexSeparator)
+		c := b.Cursor()
+		k, v := c.Seek(prefix)
+		if len(after) > 0 {
+			start := historyKey(req.Path, after)
+			k, v = c.Seek(start)
+			if k != nil && bytes.Equal(k, start) {
+				k, v = c.Next()
+			}
+		}
+		for count := 0; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if count == max {
+				return nil
+			}
+			key := k[len(prefix):]
+			history.Events = append(history.Events, PathEvent{Time: keyTime(key), Event: Event(binary.BigEndian.Uint32(v))})
+			history.Next = hex.EncodeToString(key)
+			count++
+		}
+		history.Done = true
+		return nil
+	})
+}
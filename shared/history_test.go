@@ -0,0 +1,138 @@
+package shared
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// history returns the events of `path` on the node `id`, asked `max` events at a time.
+func history(paths *Paths, id, path string, max int) ([]string, error) {
+	events := []string{}
+	req := &HistoryRequest{Node: id, Path: path, Max: max}
+	for done := false; !done; {
+		h := new(History)
+		err := paths.History(req, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range h.Events {
+			events = append(events, e.Event.String())
+		}
+		req.After, done = h.Next, h.Done
+	}
+	return events, nil
+}
+
+func TestHistory(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	updateAt(t, paths, "web-1", Create, "etc/a", "etc/ab")
+	t1 := updateAt(t, paths, "web-1", Remove, "etc/a")
+	updateAt(t, paths, "web-1", Create, "etc/a", "etc/ab")
+	updateAt(t, paths, "web-2", Create, "etc/a")
+	err := paths.DeleteList("web-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		id, path, events string
+	}{
+		{"web-1", "etc/a", "[Create Remove Create Remove]"},
+		{"web-1", "etc/ab", "[Create Remove]"},
+		{"web-1", "etc", "[]"},
+		{"web-2", "etc/a", "[Create]"},
+	} {
+		for _, max := range []int{1, 100} {
+			events, err := history(paths, test.id, test.path, max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(events) != test.events {
+				t.Fatalf("History of '%s' on '%s' should be '%s', instead is '%v'", test.path, test.id, test.events, events)
+			}
+		}
+	}
+	h := new(History)
+	err = paths.History(&HistoryRequest{Node: "web-1", Path: "etc/a"}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(h.Events); i++ {
+		if h.Events[i].Time.Before(h.Events[i-1].Time) {
+			t.Fatalf("Events should be in order, instead are '%+v'", h.Events)
+		}
+	}
+	if h.Since.IsZero() || h.Since.After(h.Events[0].Time) {
+		t.Fatalf("Since should be at the latest '%s', instead is '%s'", h.Events[0].Time, h.Since)
+	}
+	err = paths.History(&HistoryRequest{Node: "web-3", Path: "etc/a"}, new(History))
+	if err != ErrUnknownNode {
+		t.Fatalf("History should return '%s', instead returns '%v'", ErrUnknownNode, err)
+	}
+
+	_, err = paths.PruneJournal(t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := history(paths, "web-1", "etc/a", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(events) != "[Create Remove]" {
+		t.Fatalf("History should be '[Create Remove]' once pruned, instead is '%v'", events)
+	}
+
+	// The history of a journal started without it is built from the journal.
+	err = paths.Db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(historyBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.BuildHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err = history(paths, "web-1", "etc/a", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(events) != "[Create Remove]" {
+		t.Fatalf("History should be '[Create Remove]' once built, instead is '%v'", events)
+	}
+}
+
+func TestHistoryResync(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+	updateAt(t, paths, "web-1", Create, "etc/a", "etc/b")
+	updateAt(t, paths, "web-1", Remove, "etc/b")
+
+	// Restarting on an unchanged directory adds nothing to the history of its paths.
+	resync(t, paths, "web-1", "etc/a")
+	resync(t, paths, "web-1", "etc/a")
+	for path, expected := range map[string]string{"etc/a": "[Create]", "etc/b": "[Create Remove]"} {
+		events, err := history(paths, "web-1", path, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(events) != expected {
+			t.Fatalf("History of '%s' should be '%s' after restarts, instead is '%v'", path, expected, events)
+		}
+	}
+
+	// Paths changed while the nodewatcher wasn't running are recorded once.
+	resync(t, paths, "web-1", "etc/b")
+	for path, expected := range map[string]string{"etc/a": "[Create Remove]", "etc/b": "[Create Remove Create]"} {
+		events, err := history(paths, "web-1", path, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(events) != expected {
+			t.Fatalf("History of '%s' should be '%s', instead is '%v'", path, expected, events)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+// indexBucket maps every path to the nodes having it, through keys made of the path and the id of
+// a node separated by `indexSeparator`, so that the nodes having a path are a range of keys.
+var indexBucket = []byte(internalPrefix + "index")
+
+// indexSeparator can't be part of a path.
+const indexSeparator = "\x00"
+
+// indexKey returns the key of the index recording that the node `id` has `path`.
+func indexKey(path, id string) []byte {
+	return []byte(path + indexSeparator + id)
+}
+
+// index records in the index that the node `id` has `path`, or no longer has it if `remove` is
+// true.
+func index(tx *bolt.Tx, id, path string, remove bool) error {
+	b, err := tx.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return err
+	}
+	if remove {
+		return b.Delete(indexKey(path, id))
+	}
+	return b.Put(indexKey(path, id), []byte{})
+}
+
+// BuildIndex fills the index from the lists of all nodes if the database doesn't have one yet,
+// which is the case of databases created before the index existed.
+func (p *Paths) BuildIndex() error {
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(indexBucket) != nil {
+			return nil
+		}
+		start := time.Now()
+		idx, err := tx.CreateBucket(indexBucket)
+		if err != nil {
+			return err
+		}
+		count := 0
+		err = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if IsInternalBucket(name) {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				count++
+				return idx.Put(indexKey(string(k), string(name)), []byte{})
+			})
+		})
+		if err != nil {
+			return err
+		}
+		log.With("paths", count, "duration", time.Since(start)).Info("Built the path index")
+		return nil
+	})
+}
+
+// Lookup is an RPC that returns in `reply` the nodes having each of the paths of `req`, in the
+// order of `req.Paths`.
+// It returns an error if the operation can't be completed.
+func (p *Paths) Lookup(req *LookupRequest, reply *[]PathNodes) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Lookup", start, err) }(time.Now())
+	log.With("request", req.RequestId, "paths", len(req.Paths)).Debug("Looking up paths")
+	return p.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		for _, path := range req.Paths {
+			found := PathNodes{Path: path, Nodes: []string{}}
+			if b != nil {
+				prefix := []byte(path + indexSeparator)
+				c := b.Cursor()
+				for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+					found.Nodes = append(found.Nodes, string(k[len(prefix):]))
+				}
+			}
+			*reply = append(*reply, found)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestLookup(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	paths := &Paths{Db: db}
+	update := func(id string, event Event, files ...string) {
+		tr := &Transaction{Id: id}
+		for _, file := range files {
+			tr.Operations = append(tr.Operations, Operation{Path: file, Event: event})
+		}
+		err := paths.Update(tr, new(Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(expected string, files ...string) {
+		reply := []PathNodes{}
+		err := paths.Lookup(&LookupRequest{Paths: files}, &reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(reply) != expected {
+			t.Fatalf("Lookup should return '%s', instead returns '%v'", expected, reply)
+		}
+	}
+	update("1", Create, "etc/a", "etc/a/b")
+	update("2", Create, "etc/a")
+	update("3", Create, "etc/a")
+	lookup("[{etc/a [1 2 3]} {etc/a/b [1]} {etc []}]", "etc/a", "etc/a/b", "etc")
+	update("2", Remove, "etc/a")
+	err = paths.DeleteList("3", &struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup("[{etc/a [1]}]", "etc/a")
+
+	// A database created before the index existed.
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(indexBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup("[{etc/a []}]", "etc/a")
+	err = paths.BuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup("[{etc/a [1]} {etc/a/b [1]}]", "etc/a", "etc/a/b")
+}
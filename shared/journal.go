@@ -0,0 +1,306 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+var (
+	// journalBucket holds a bucket per node, recording every change of its list under a key made
+	// of the time of the change followed by a sequence number, the value being the event followed
+	// by the path.
+	journalBucket = []byte(internalPrefix + "journal")
+	// journalSinceBucket maps the id of every node to the time from which its list can be rebuilt
+	// from the journal.
+	journalSinceBucket = []byte(internalPrefix + "journal-since")
+)
+
+// timeKey returns `t` as a key sorting like time.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// keyTime returns the time starting `key`.
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8]))).UTC()
+}
+
+// hasPath returns true if the list `b` holds `path`.
+func hasPath(b *bolt.Bucket, path string) bool {
+	k, _ := b.Cursor().Seek([]byte(path))
+	return k != nil && string(k) == path
+}
+
+// journal records in the journal of the node `id` that `event` happened to `path` at `now`, and in
+// the history of `path`.
+// Only changes should be recorded, such as the creation of a path that wasn't in the list.
+func journal(tx *bolt.Tx, id string, now time.Time, event Event, path string) error {
+	root, err := tx.CreateBucketIfNotExists(journalBucket)
+	if err != nil {
+		return err
+	}
+	b, err := root.CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	since, err := tx.CreateBucketIfNotExists(journalSinceBucket)
+	if err != nil {
+		return err
+	}
+	if since.Get([]byte(id)) == nil {
+		err = since.Put([]byte(id), timeKey(now))
+		if err != nil {
+			return err
+		}
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	copy(key, timeKey(now))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	value := make([]byte, 4+len(path))
+	binary.BigEndian.PutUint32(value, uint32(event))
+	copy(value[4:], path)
+	err = b.Put(key, value)
+	if err != nil {
+		return err
+	}
+	return recordHistory(tx, id, path, key, event)
+}
+
+// journalEntry decodes the value of an entry of the journal.
+func journalEntry(value []byte) (Event, string) {
+	return Event(binary.BigEndian.Uint32(value)), string(value[4:])
+}
+
+// StartJournal starts the journal of the nodes whose list was stored before the journal existed,
+// from now on.
+func (p *Paths) StartJournal() error {
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		since, err := tx.CreateBucketIfNotExists(journalSinceBucket)
+		if err != nil {
+			return err
+		}
+		var ids [][]byte
+		err = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !IsInternalBucket(name) && since.Get(name) == nil {
+				ids = append(ids, append([]byte{}, name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		now := timeKey(time.Now())
+		for _, id := range ids {
+			err = since.Put(id, now)
+			if err != nil {
+				return err
+			}
+		}
+		if len(ids) > 0 {
+			log.With("nodes", len(ids)).Info("Started the journal of the lists")
+		}
+		return nil
+	})
+}
+
+// listAt calls `fn` with up to `max` paths of the list of the node `id` as it was at `at`, in
+// order and following `after`, or with all of them if `max` is negative.
+// The list is rebuilt from the current one by undoing the changes recorded after `at`, so that
+// only these changes are held in memory.
+// It returns the last path given to `fn` and whether all paths were given, `ErrUnknownNode` if
+// the node never had a list, or `ErrBeforeJournal` if the journal doesn't go back to `at`.
+func listAt(tx *bolt.Tx, id string, at time.Time, after string, max int, fn func(path string)) (string, bool, error) {
+	if checkId(id) != nil {
+		return "", false, ErrUnknownNode
+	}
+	current := tx.Bucket([]byte(id))
+	var since []byte
+	if b := tx.Bucket(journalSinceBucket); b != nil {
+		since = b.Get([]byte(id))
+	}
+	if since == nil && current == nil {
+		return "", false, ErrUnknownNode
+	}
+	if since == nil || at.Before(keyTime(since)) {
+		return "", false, ErrBeforeJournal
+	}
+
+	// The first change of a path after `at` tells whether it was in the list at `at`.
+	first := make(map[string]Event)
+	if root := tx.Bucket(journalBucket); root != nil {
+		if b := root.Bucket([]byte(id)); b != nil {
+			c := b.Cursor()
+			for k, v := c.Seek(timeKey(at.Add(time.Nanosecond))); k != nil; k, v = c.Next() {
+				event, path := journalEntry(v)
+				if _, ok := first[path]; !ok {
+					first[path] = event
+				}
+			}
+		}
+	}
+	removed := []string{}
+	for path, event := range first {
+		if event == Remove && path > after {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+
+	var c *bolt.Cursor
+	var k []byte
+	if current != nil {
+		c = current.Cursor()
+		k, _ = c.Seek([]byte(after))
+		if k != nil && after != "" && string(k) == after {
+			k, _ = c.Next()
+		}
+	}
+	last, count := "", 0
+	for k != nil || len(removed) > 0 {
+		var path string
+		switch {
+		case k == nil:
+			path, removed = removed[0], removed[1:]
+		case len(removed) == 0 || bytes.Compare(k, []byte(removed[0])) < 0:
+			path = string(k)
+			k, _ = c.Next()
+		default:
+			if string(k) == removed[0] {
+				// Removed after `at` and created again since.
+				k, _ = c.Next()
+			}
+			path, removed = removed[0], removed[1:]
+		}
+		if first[path] == Create {
+			continue
+		}
+		if count == max {
+			return last, false, nil
+		}
+		fn(path)
+		last = path
+		count++
+	}
+	return last, true, nil
+}
+
+// walk calls `fn` with up to `max` keys of `b` following `after`, in order, or with all of them if
+// `max` is negative.
+// It returns the last key given to `fn` and whether all keys were given.
+func walk(b *bolt.Bucket, after string, max int, fn func(key string)) (string, bool) {
+	c := b.Cursor()
+	k, _ := c.Seek([]byte(after))
+	if k != nil && after != "" && string(k) == after {
+		k, _ = c.Next()
+	}
+	last := ""
+	for count := 0; k != nil; k, _ = c.Next() {
+		if count == max {
+			return last, false
+		}
+		last = string(k)
+		fn(last)
+		count++
+	}
+	return last, true
+}
+
+// FilesAt is an RPC that returns in `files` up to `req.Max` paths of the list of the node
+// `req.Node` following `req.After`, as it was at `req.At`, or as it is in the snapshot
+// `req.Snapshot` if it is set.
+// It returns `ErrUnknownNode` if the node had no list, `ErrBeforeJournal` if the journal doesn't
+// go back to `req.At`, `ErrUnknownSnapshot` if there is no such snapshot, or an error if the
+// operation can't be completed.
+func (p *Paths) FilesAt(req *FilesRequest, files *Files) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.FilesAt", start, err) }(time.Now())
+	max := req.Max
+	if max <= 0 || max > MaxChunkPaths {
+		max = MaxChunkPaths
+	}
+	log.With("request", req.RequestId, "node", req.Node, "at", req.At, "snapshot", req.Snapshot).Debug("Listing files in the past")
+	add := func(path string) { files.Paths = append(files.Paths, path) }
+	return p.Db.View(func(tx *bolt.Tx) (err error) {
+		if req.Snapshot == "" {
+			files.Next, files.Done, err = listAt(tx, req.Node, req.At, req.After, max, add)
+			return err
+		}
+		snapshot, err := snapshotOf(tx, req.Snapshot)
+		if err != nil {
+			return err
+		}
+		b := snapshot.Bucket([]byte(req.Node))
+		if b == nil {
+			return ErrUnknownNode
+		}
+		files.Next, files.Done = walk(b, req.After, max, add)
+		return nil
+	})
+}
+
+// PruneJournal removes the changes recorded before `before` from the journal and from the history
+// of the paths, after which lists can only be rebuilt from `before` on.
+// It returns the number of changes removed.
+func (p *Paths) PruneJournal(before time.Time) (pruned int, err error) {
+	if err := p.begin(); err != nil {
+		return 0, err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.PruneJournal", start, err) }(time.Now())
+	limit := timeKey(before)
+	for {
+		// Changes are removed in several transactions so that the database isn't locked for long.
+		n := 0
+		err = p.Db.Update(func(tx *bolt.Tx) error {
+			n = 0
+			root, since := tx.Bucket(journalBucket), tx.Bucket(journalSinceBucket)
+			if root == nil || since == nil {
+				return nil
+			}
+			var ids [][]byte
+			root.ForEach(func(id, _ []byte) error {
+				ids = append(ids, append([]byte{}, id...))
+				return nil
+			})
+			for _, id := range ids {
+				c := root.Bucket(id).Cursor()
+				deleted := false
+				for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0 && n < MaxChunkPaths; k, v = c.First() {
+					_, path := journalEntry(v)
+					if err := forgetHistory(tx, string(id), path, append([]byte{}, k...)); err != nil {
+						return err
+					}
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					n++
+					deleted = true
+				}
+				if deleted {
+					if err := since.Put(id, limit); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		pruned += n
+		if err != nil || n < MaxChunkPaths {
+			return pruned, err
+		}
+	}
+}
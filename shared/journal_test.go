@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// openPaths returns paths stored in a new database, removed along with its directory by the
+// returned function.
+func openPaths(t *testing.T) (*Paths, func()) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		os.RemoveAll(rootDir)
+		t.Fatal(err)
+	}
+	return &Paths{Db: db}, func() {
+		db.Close()
+		os.RemoveAll(rootDir)
+	}
+}
+
+// updateAt applies `event` to `files` of the node `id` and returns a time between the update and
+// the next one.
+func updateAt(t *testing.T, paths *Paths, id string, event Event, files ...string) time.Time {
+	tr := &Transaction{Id: id}
+	for _, file := range files {
+		tr.Operations = append(tr.Operations, Operation{Path: file, Event: event})
+	}
+	err := paths.Update(tr, new(Transaction))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	return at
+}
+
+// filesAt returns the list of the node `id` at `at`, asked `max` paths at a time.
+func filesAt(paths *Paths, id string, at time.Time, max int) ([]string, error) {
+	list := []string{}
+	req := &FilesRequest{Node: id, At: at, Max: max}
+	for done := false; !done; {
+		files := new(Files)
+		err := paths.FilesAt(req, files)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, files.Paths...)
+		req.After, done = files.Next, files.Done
+	}
+	return list, nil
+}
+
+func TestFilesAt(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	t0 := updateAt(t, paths, "web-1", Create, "etc/a", "etc/b", "etc/c")
+	t1 := updateAt(t, paths, "web-1", Remove, "etc/b")
+	t2 := updateAt(t, paths, "web-1", Create, "etc/b", "etc/d", "etc/a")
+	t3 := updateAt(t, paths, "web-1", Remove, "etc/a", "etc/missing")
+	err := paths.DeleteList("web-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		at   time.Time
+		list string
+	}{
+		{t0, "[etc/a etc/b etc/c]"},
+		{t1, "[etc/a etc/c]"},
+		{t2, "[etc/a etc/b etc/c etc/d]"},
+		{t3, "[etc/b etc/c etc/d]"},
+		{time.Now(), "[]"},
+	} {
+		for _, max := range []int{1, 100} {
+			list, err := filesAt(paths, "web-1", test.at, max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(list) != test.list {
+				t.Fatalf("List at '%s' should be '%s', instead is '%v'", test.at, test.list, list)
+			}
+		}
+	}
+
+	_, err = filesAt(paths, "web-1", t0.Add(-time.Hour), 100)
+	if err != ErrBeforeJournal {
+		t.Fatalf("FilesAt should return '%s', instead returns '%v'", ErrBeforeJournal, err)
+	}
+	_, err = filesAt(paths, "web-2", t0, 100)
+	if err != ErrUnknownNode {
+		t.Fatalf("FilesAt should return '%s', instead returns '%v'", ErrUnknownNode, err)
+	}
+
+	pruned, err := paths.PruneJournal(t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 6 {
+		t.Fatalf("PruneJournal should remove '6' changes, instead removes '%d'", pruned)
+	}
+	_, err = filesAt(paths, "web-1", t1, 100)
+	if err != ErrBeforeJournal {
+		t.Fatalf("FilesAt should return '%s' once pruned, instead returns '%v'", ErrBeforeJournal, err)
+	}
+	list, err := filesAt(paths, "web-1", t3, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(list) != "[etc/b etc/c etc/d]" {
+		t.Fatalf("List at '%s' should be '[etc/b etc/c etc/d]' once pruned, instead is '%v'", t3, list)
+	}
+}
+
+func TestStartJournal(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+	err := paths.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("web-1"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("etc/a"), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	_, err = filesAt(paths, "web-1", time.Now(), 100)
+	if err != ErrBeforeJournal {
+		t.Fatalf("FilesAt should return '%s' before the journal starts, instead returns '%v'", ErrBeforeJournal, err)
+	}
+	err = paths.StartJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := filesAt(paths, "web-1", time.Now(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(list) != "[etc/a]" {
+		t.Fatalf("List should be '[etc/a]', instead is '%v'", list)
+	}
+	_, err = filesAt(paths, "web-1", before, 100)
+	if err != ErrBeforeJournal {
+		t.Fatalf("FilesAt should return '%s' before the journal started, instead returns '%v'", ErrBeforeJournal, err)
+	}
+}
@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Lifecycle keeps track of the background goroutines of a `Runnable` and records the first fatal
+// error one of them encounters.
+// Its zero value is ready to use.
+type Lifecycle struct {
+	mu       sync.Mutex
+	done     chan struct{}
+	err      error
+	stopping bool
+}
+
+// doneCh returns the channel closed by `Fail` and `Stop`, creating it if needed.
+// It must be called with `lc.mu` held.
+func (lc *Lifecycle) doneCh() chan struct{} {
+	if lc.done == nil {
+		lc.done = make(chan struct{})
+	}
+	return lc.done
+}
+
+// Bind makes the lifecycle fail with the error of `ctx` once `ctx` is done.
+func (lc *Lifecycle) Bind(ctx context.Context) {
+	done := lc.Done()
+	go func() {
+		select {
+		case <-ctx.Done():
+			lc.Fail(ctx.Err())
+		case <-done:
+		}
+	}()
+}
+
+// Go runs `f` in a new goroutine named `name`.
+// If `f` returns an error before `Stop` is called, the lifecycle fails with that error.
+func (lc *Lifecycle) Go(name string, f func() error) {
+	go func() {
+		err := f()
+		if err != nil {
+			lc.Fail(fmt.Errorf("%s : %s", name, err))
+		}
+	}()
+}
+
+// Fail records `err` as the reason the `Runnable` can't keep running and closes the channel
+// returned by `Done`.
+// Only the first error is kept, and errors reported after `Stop` was called are ignored.
+func (lc *Lifecycle) Fail(err error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.stopping || lc.err != nil {
+		return
+	}
+	lc.err = err
+	close(lc.doneCh())
+}
+
+// Stop tells the lifecycle that the `Runnable` is being stopped, errors reported by background
+// goroutines are expected from now on and ignored.
+// It closes the channel returned by `Done`.
+func (lc *Lifecycle) Stop() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.stopping {
+		return
+	}
+	lc.stopping = true
+	if lc.err == nil {
+		close(lc.doneCh())
+	}
+}
+
+// Done returns a channel that is closed when the `Runnable` fails or is stopped.
+func (lc *Lifecycle) Done() <-chan struct{} {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.doneCh()
+}
+
+// Err returns the error that made the `Runnable` fail, or nil if it didn't fail.
+func (lc *Lifecycle) Err() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.err
+}
@@ -0,0 +1,63 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLifecycleFail(t *testing.T) {
+	lc := new(Lifecycle)
+	lc.Go("accept", func() error { return fmt.Errorf("use of closed network connection") })
+	select {
+	case <-lc.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done should be closed once a goroutine fails")
+	}
+	if lc.Err() == nil || lc.Err().Error() != "accept : use of closed network connection" {
+		t.Fatalf("Err should be 'accept : use of closed network connection', instead is '%v'", lc.Err())
+	}
+	// Only the first error is kept
+	lc.Fail(fmt.Errorf("second"))
+	if lc.Err().Error() != "accept : use of closed network connection" {
+		t.Fatalf("Err should still be the first error, instead is '%s'", lc.Err())
+	}
+	lc.Stop()
+}
+
+func TestLifecycleStop(t *testing.T) {
+	lc := new(Lifecycle)
+	lc.Go("run", func() error { return nil })
+	select {
+	case <-lc.Done():
+		t.Fatalf("Done should not be closed when a goroutine returns without error")
+	case <-time.After(50 * time.Millisecond):
+	}
+	lc.Stop()
+	lc.Stop()
+	select {
+	case <-lc.Done():
+	default:
+		t.Fatalf("Done should be closed once stopped")
+	}
+	lc.Fail(fmt.Errorf("listener closed"))
+	if lc.Err() != nil {
+		t.Fatalf("Errors after Stop should be ignored, instead Err is '%s'", lc.Err())
+	}
+}
+
+func TestLifecycleBind(t *testing.T) {
+	lc := new(Lifecycle)
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Bind(ctx)
+	cancel()
+	select {
+	case <-lc.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done should be closed once the context is canceled")
+	}
+	if lc.Err() != context.Canceled {
+		t.Fatalf("Err should be '%s', instead is '%v'", context.Canceled, lc.Err())
+	}
+}
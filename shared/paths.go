@@ -1,55 +1,167 @@
 package shared
 
 import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/boltdb/bolt"
 	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
+	"github.com/matarc/filewatcher/trace"
 )
 
 type Paths struct {
-	Db *bolt.DB
+	Db       *bolt.DB
+	Metrics  *metrics.Registry
+	Traces   *trace.Recorder
+	mu       sync.Mutex
+	calls    sync.WaitGroup
+	draining bool
+	// snapshotting holds the names of the snapshots being taken.
+	snapshotting map[string]bool
+}
+
+// begin registers a call in flight, it must be followed by a call to `end` once the RPC is done.
+// It returns `ErrShuttingDown` if `Drain` has been called.
+func (p *Paths) begin() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return ErrShuttingDown
+	}
+	p.calls.Add(1)
+	return nil
+}
+
+func (p *Paths) end() {
+	p.calls.Done()
+}
+
+// Drain makes all subsequent RPCs fail with `ErrShuttingDown` and waits for the calls in flight
+// to complete.
+// It returns an error if `ctx` is done before all calls are completed.
+func (p *Paths) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe records the outcome and the duration of a call to the RPC `method`.
+func (p *Paths) observe(method string, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	p.Metrics.Counter("filewatcher_storage_rpc_calls_total",
+		"Number of RPCs handled, by method and status.", "method", "status").Inc(method, status)
+	p.Metrics.Histogram("filewatcher_storage_rpc_duration_seconds",
+		"Time spent handling RPCs, by method.", metrics.DefaultBuckets, "method").Observe(time.Since(start).Seconds(), method)
 }
 
 // Update is an RPC that take a list of operations as an argument (`transaction`) and
 // returns a list of all successful operations in `reply`.
+// The revision of the node and the global revision are increased if any operation succeeded, and
+// the paths actually created or removed are recorded in the journal.
 // It returns an error if any operation can't be completed.
-func (p *Paths) Update(transaction *Transaction, reply *Transaction) error {
-	log.Info("Update")
+func (p *Paths) Update(transaction *Transaction, reply *Transaction) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Update", start, err) }(time.Now())
+	if err := checkId(transaction.Id); err != nil {
+		return err
+	}
 	return p.Db.Batch(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(transaction.Id))
 		if err != nil {
 			return err
 		}
-		log.Infof("Attempt to update paths for nodewatcher '%s'", transaction.Id)
+		logger := log.With("node", transaction.Id)
+		logger.Debugf("Updating %d paths", len(transaction.Operations))
+		now := time.Now()
+		delta := 0
 		for _, op := range transaction.Operations {
 			if op.Event&Create == Create {
-				log.Infof("Adding '%s' in the database", op.Path)
+				logger.With("path", op.Path).Debug("Adding path")
+				exists := hasPath(b, op.Path)
 				err = b.Put([]byte(op.Path), []byte{})
+				if err == nil {
+					err = index(tx, transaction.Id, op.Path, false)
+				}
+				if err == nil && !exists {
+					err = journal(tx, transaction.Id, now, Create, op.Path)
+					delta++
+				}
 				if err != nil {
 					return err
 				}
 				reply.Operations = append(reply.Operations, op)
 			} else if op.Event&Remove == Remove {
-				log.Infof("Removing '%s' in the database", op.Path)
+				logger.With("path", op.Path).Debug("Removing path")
+				exists := hasPath(b, op.Path)
 				err = b.Delete([]byte(op.Path))
+				if err == nil {
+					err = index(tx, transaction.Id, op.Path, true)
+				}
+				if err == nil && exists {
+					err = journal(tx, transaction.Id, now, Remove, op.Path)
+					delta--
+				}
 				if err != nil {
 					return err
 				}
 				reply.Operations = append(reply.Operations, op)
 			}
 		}
-		return nil
+		if len(reply.Operations) == 0 {
+			return nil
+		}
+		return bumpRevision(tx, transaction.Id, delta)
 	})
 }
 
-// Update is an RPC that list all files from all nodewatchers and returns it in `list`.
+// ListFiles is an RPC that list all files from all nodewatchers and returns it in `list`.
+// The call is traced under the id of the request that triggered it, or a new id if there is none.
 // It returns an error if the operation can't be completed.
-func (p *Paths) ListFiles(_ *struct{}, list *[]Node) error {
-	log.Info("ListFiles")
+func (p *Paths) ListFiles(req *ListRequest, list *[]Node) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.ListFiles", start, err) }(time.Now())
+	id := req.RequestId
+	if !trace.ValidId(id) {
+		id = trace.NewId()
+	}
+	t := trace.New(id, "Paths.ListFiles")
+	logger := log.With("request", id)
+	defer func() {
+		logger.With("nodes", len(*list), "duration", t.Finish()).Debug("Listed files")
+		p.Traces.Record(t)
+	}()
+	endSpan := t.Span("read database")
+	defer endSpan()
 	return p.Db.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if IsInternalBucket(name) {
+				return nil
+			}
 			node := Node{Id: string(name)}
 			err := b.ForEach(func(k, v []byte) error {
-				log.Infof("'%s' - '%s'", node.Id, string(k))
 				node.Files = append(node.Files, string(k))
 				return nil
 			})
@@ -57,16 +169,202 @@ func (p *Paths) ListFiles(_ *struct{}, list *[]Node) error {
 				return err
 			}
 			*list = append(*list, node)
-			log.Infof("Summary--------\n%v", *list)
+			logger.With("node", node.Id, "paths", len(node.Files)).Debug("Listed node")
 			return nil
 		})
 	})
 }
 
-// DeleteList is an RPC that removes the list from the nodewatcher `id`.
+// ListChunk is an RPC that returns in `chunk` up to `req.Max` paths of the lists of all
+// nodewatchers, starting at `req.Next`, so that the lists can be sent in parts of bounded size.
+// Each chunk is read in its own transaction, the lists may change from one chunk to the next.
+// The call is traced like `ListFiles`.
+// It returns an error if the operation can't be completed.
+func (p *Paths) ListChunk(req *ListChunkRequest, chunk *ListChunk) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.ListChunk", start, err) }(time.Now())
+	max := req.Max
+	if max <= 0 || max > MaxChunkPaths {
+		max = MaxChunkPaths
+	}
+	id := req.RequestId
+	if !trace.ValidId(id) {
+		id = trace.NewId()
+	}
+	t := trace.New(id, "Paths.ListChunk")
+	defer func() {
+		log.With("request", id, "node", req.Next.Node, "parts", len(chunk.Parts), "done", chunk.Done,
+			"duration", t.Finish()).Debug("Listed chunk")
+		p.Traces.Record(t)
+	}()
+	endSpan := t.Span("read database")
+	defer endSpan()
+	return p.Db.View(func(tx *bolt.Tx) error {
+		count := 0
+		c := tx.Cursor()
+		name, _ := c.First()
+		if req.Next.Node != "" {
+			name, _ = c.Seek([]byte(req.Next.Node))
+		}
+		for ; name != nil; name, _ = c.Next() {
+			b := tx.Bucket(name)
+			if IsInternalBucket(name) || b == nil {
+				continue
+			}
+			part := Node{Id: string(name)}
+			fc := b.Cursor()
+			path, _ := fc.First()
+			if part.Id == req.Next.Node && req.Next.After != "" {
+				path, _ = fc.Seek([]byte(req.Next.After))
+				if path != nil && string(path) == req.Next.After {
+					path, _ = fc.Next()
+				}
+			}
+			for ; path != nil; path, _ = fc.Next() {
+				if count == max {
+					chunk.Next = ListCursor{Node: part.Id}
+					if len(part.Files) > 0 {
+						chunk.Parts = append(chunk.Parts, part)
+						chunk.Next.After = part.Files[len(part.Files)-1]
+					}
+					return nil
+				}
+				part.Files = append(part.Files, string(path))
+				count++
+			}
+			chunk.Parts = append(chunk.Parts, part)
+		}
+		chunk.Done = true
+		return nil
+	})
+}
+
+// DeleteList is an RPC that removes the list from the nodewatcher `id`, increasing its revision
+// and the global revision, and records the removal of every path in the journal.
 // It returns an error if the operation can't be completed.
-func (p *Paths) DeleteList(id string, _ *struct{}) error {
+func (p *Paths) DeleteList(id string, _ *struct{}) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.DeleteList", start, err) }(time.Now())
+	if err := checkId(id); err != nil {
+		return err
+	}
 	return p.Db.Batch(func(tx *bolt.Tx) error {
-		return tx.DeleteBucket([]byte(id))
+		if b := tx.Bucket([]byte(id)); b != nil {
+			now := time.Now()
+			err := b.ForEach(func(k, v []byte) error {
+				err := index(tx, id, string(k), true)
+				if err != nil {
+					return err
+				}
+				return journal(tx, id, now, Remove, string(k))
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.DeleteBucket([]byte(id))
+		if err != nil {
+			return err
+		}
+		return bumpRevision(tx, id, 0)
+	})
+}
+
+// Resync is an RPC that replaces the list of the nodewatcher `transaction.Id` with the list made
+// by applying `transaction.Operations` to an empty list, which is what a nodewatcher sends once it
+// walked its directory. Only the paths that differ from the stored list are created or removed,
+// and recorded in the journal, so that a nodewatcher starting again on an unchanged directory
+// leaves the list, its revision and the journal untouched. `reply` holds all the operations.
+// It returns an error if the operation can't be completed.
+func (p *Paths) Resync(transaction *Transaction, reply *Transaction) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Resync", start, err) }(time.Now())
+	if err := checkId(transaction.Id); err != nil {
+		return err
+	}
+	list := map[string]bool{}
+	for _, op := range transaction.Operations {
+		if op.Event&Create == Create {
+			list[op.Path] = true
+		} else if op.Event&Remove == Remove {
+			delete(list, op.Path)
+		}
+	}
+	err = p.Db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(transaction.Id))
+		if err != nil {
+			return err
+		}
+		var removed, added []string
+		err = b.ForEach(func(k, v []byte) error {
+			if !list[string(k)] {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for path := range list {
+			if !hasPath(b, path) {
+				added = append(added, path)
+			}
+		}
+		sort.Strings(added)
+		log.With("node", transaction.Id, "paths", len(list), "added", len(added), "removed", len(removed)).Info("Resyncing list")
+		now := time.Now()
+		for _, path := range removed {
+			err = b.Delete([]byte(path))
+			if err == nil {
+				err = index(tx, transaction.Id, path, true)
+			}
+			if err == nil {
+				err = journal(tx, transaction.Id, now, Remove, path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, path := range added {
+			err = b.Put([]byte(path), []byte{})
+			if err == nil {
+				err = index(tx, transaction.Id, path, false)
+			}
+			if err == nil {
+				err = journal(tx, transaction.Id, now, Create, path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(removed)+len(added) == 0 {
+			return nil
+		}
+		return bumpRevision(tx, transaction.Id, len(added)-len(removed))
+	})
+	if err != nil {
+		return err
+	}
+	reply.Operations = transaction.Operations
+	return nil
+}
+
+// Ping is a lightweight RPC that returns an error if the database can't be read.
+func (p *Paths) Ping(_ *struct{}, _ *struct{}) error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	return p.Db.View(func(tx *bolt.Tx) error {
+		return nil
 	})
 }
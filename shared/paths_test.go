@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -144,7 +145,7 @@ func TestListFiles(t *testing.T) {
 	paths := new(Paths)
 	paths.Db = db
 	list := []Node{}
-	err = paths.ListFiles(&struct{}{}, &list)
+	err = paths.ListFiles(&ListRequest{}, &list)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -189,6 +190,69 @@ func TestListFiles(t *testing.T) {
 	}
 }
 
+func TestListChunk(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	paths := &Paths{Db: db}
+	for _, tr := range []Transaction{
+		{Id: "1", Operations: []Operation{{Path: "/a", Event: Create}, {Path: "/b", Event: Create}, {Path: "/c", Event: Create}}},
+		{Id: "2", Operations: []Operation{{Path: "/d", Event: Create}, {Path: "/d", Event: Remove}}},
+		{Id: "3", Operations: []Operation{{Path: "/e", Event: Create}, {Path: "/f", Event: Create}}},
+	} {
+		err = paths.Update(&tr, new(Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	full := []Node{}
+	err = paths.ListFiles(&ListRequest{}, &full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, max := range []int{1, 2, 3, 100} {
+		list, req, chunks := []Node{}, &ListChunkRequest{Max: max}, 0
+		for {
+			chunk := new(ListChunk)
+			err = paths.ListChunk(req, chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks++
+			count := 0
+			for _, part := range chunk.Parts {
+				count += len(part.Files)
+				if len(list) > 0 && list[len(list)-1].Id == part.Id {
+					list[len(list)-1].Files = append(list[len(list)-1].Files, part.Files...)
+				} else {
+					list = append(list, part)
+				}
+			}
+			if count > max {
+				t.Fatalf("A chunk should have at most '%d' paths, instead has '%d'", max, count)
+			}
+			if chunk.Done {
+				break
+			}
+			req.Next = chunk.Next
+		}
+		if got, want := fmt.Sprint(list), fmt.Sprint(full); got != want {
+			t.Fatalf("Chunks of '%d' paths should add up to '%s', instead add up to '%s'", max, want, got)
+		}
+		if max == 1 && chunks != 5 {
+			t.Fatalf("There should be '5' chunks of '1' path, instead there are '%d'", chunks)
+		}
+	}
+}
+
 func TestDeleteList(t *testing.T) {
 	rootDir, err := ioutil.TempDir("", "filewatcher")
 	if err != nil {
@@ -222,3 +286,147 @@ func TestDeleteList(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// resync sends `files` as the whole list of the node `id`, as a nodewatcher does when it starts.
+func resync(t *testing.T, paths *Paths, id string, files ...string) {
+	tr := &Transaction{Id: id}
+	for _, file := range files {
+		tr.Operations = append(tr.Operations, Operation{Path: file, Event: Create})
+	}
+	reply := new(Transaction)
+	err := paths.Resync(tr, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Operations) != len(files) {
+		t.Fatalf("Resync should acknowledge '%d' operations, instead acknowledges '%d'", len(files), len(reply.Operations))
+	}
+}
+
+// journalLength returns the number of changes recorded in the journal of the node `id`.
+func journalLength(t *testing.T, paths *Paths, id string) int {
+	length := 0
+	err := paths.Db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(journalBucket).Bucket([]byte(id)); b != nil {
+			length = b.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return length
+}
+
+func TestResync(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+	updateAt(t, paths, "web-1", Create, "etc/a", "etc/b", "etc/c")
+	rev := new(Revision)
+	err := paths.Revision(nil, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A nodewatcher starting again on an unchanged directory changes nothing.
+	resync(t, paths, "web-1", "etc/c", "etc/a", "etc/b")
+	if length := journalLength(t, paths, "web-1"); length != 3 {
+		t.Fatalf("Journal should hold '3' changes, instead holds '%d'", length)
+	}
+	after := new(Revision)
+	err = paths.Revision(nil, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Global != rev.Global || after.Nodes["web-1"] != rev.Nodes["web-1"] {
+		t.Fatalf("Revision should be '%+v', instead is '%+v'", rev, after)
+	}
+
+	// Only the paths that changed while it wasn't running are recorded.
+	resync(t, paths, "web-1", "etc/a", "etc/d", "etc/c")
+	if length := journalLength(t, paths, "web-1"); length != 5 {
+		t.Fatalf("Journal should hold '5' changes, instead holds '%d'", length)
+	}
+	files, err := filesAt(paths, "web-1", time.Now(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(files) != "[etc/a etc/c etc/d]" {
+		t.Fatalf("List should be '[etc/a etc/c etc/d]', instead is '%v'", files)
+	}
+	var found []PathNodes
+	err = paths.Lookup(&LookupRequest{Paths: []string{"etc/b", "etc/d"}}, &found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(found) != "[{etc/b []} {etc/d [web-1]}]" {
+		t.Fatalf("Index should be '[{etc/b []} {etc/d [web-1]}]', instead is '%v'", found)
+	}
+
+	// The list of a new node is created.
+	resync(t, paths, "web-2", "etc/a")
+	if length := journalLength(t, paths, "web-2"); length != 1 {
+		t.Fatalf("Journal should hold '1' change, instead holds '%d'", length)
+	}
+}
+
+func TestPing(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	dbPath := filepath.Join(rootDir, "mydb")
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := new(Paths)
+	paths.Db = db
+	err = paths.Ping(&struct{}{}, &struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	err = paths.Ping(&struct{}{}, &struct{}{})
+	if err == nil {
+		t.Fatalf("Ping should return an error when the database is closed")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	paths := new(Paths)
+	paths.Db = db
+	// Simulate a call in flight
+	err = paths.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = paths.Drain(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Drain should return '%s', instead returned '%v'", context.DeadlineExceeded, err)
+	}
+	err = paths.Ping(&struct{}{}, &struct{}{})
+	if err != ErrShuttingDown {
+		t.Fatalf("Ping should return '%s' while draining, instead returned '%v'", ErrShuttingDown, err)
+	}
+	paths.end()
+	err = paths.Drain(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
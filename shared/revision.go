@@ -0,0 +1,137 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// internalPrefix starts the names of the buckets that don't hold the list of a node.
+const internalPrefix = "\x00"
+
+var (
+	// revisionsBucket maps the id of every node to the revision of its list, and `globalKey` to
+	// the global revision.
+	revisionsBucket = []byte(internalPrefix + "revisions")
+	globalKey       = []byte(internalPrefix + "global")
+	// countsBucket maps the id of every node having a list to the number of paths in it, updated
+	// along with its revision so that it is read without walking the list.
+	countsBucket = []byte(internalPrefix + "counts")
+)
+
+// IsInternalBucket returns true if the bucket `name` doesn't hold the list of a node.
+func IsInternalBucket(name []byte) bool {
+	return strings.HasPrefix(string(name), internalPrefix)
+}
+
+// checkId returns an error if `id` can't be the id of a node.
+func checkId(id string) error {
+	if id == "" || strings.HasPrefix(id, internalPrefix) {
+		return fmt.Errorf("Invalid node id '%s'", id)
+	}
+	return nil
+}
+
+// bumpRevision increases the revision of the node `id` and the global revision, and adds `delta`
+// to the number of paths of the node, which is forgotten once the node has no list.
+func bumpRevision(tx *bolt.Tx, id string, delta int) error {
+	b, err := tx.CreateBucketIfNotExists(revisionsBucket)
+	if err != nil {
+		return err
+	}
+	for _, key := range [][]byte{[]byte(id), globalKey} {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, readRevision(b, key)+1)
+		err = b.Put(key, buf)
+		if err != nil {
+			return err
+		}
+	}
+	counts, err := tx.CreateBucketIfNotExists(countsBucket)
+	if err != nil {
+		return err
+	}
+	if tx.Bucket([]byte(id)) == nil {
+		return counts.Delete([]byte(id))
+	}
+	return putCount(counts, id, int(readRevision(counts, []byte(id)))+delta)
+}
+
+// putCount records in `counts` that the node `id` has `paths` paths.
+func putCount(counts *bolt.Bucket, id string, paths int) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(paths))
+	return counts.Put([]byte(id), buf)
+}
+
+// CountPaths records the number of paths of every node if the database doesn't have them yet,
+// which is the case of databases created before they were recorded.
+func (p *Paths) CountPaths() error {
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(countsBucket) != nil {
+			return nil
+		}
+		counts, err := tx.CreateBucket(countsBucket)
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if IsInternalBucket(name) {
+				return nil
+			}
+			return putCount(counts, string(name), b.Stats().KeyN)
+		})
+	})
+}
+
+// ForEachNode calls `fn` with the id of every node having a list and the number of paths in it,
+// sorted by id.
+func ForEachNode(tx *bolt.Tx, fn func(id string, paths int)) {
+	counts := tx.Bucket(countsBucket)
+	if counts == nil {
+		return
+	}
+	counts.ForEach(func(k, v []byte) error {
+		fn(string(k), int(readRevision(counts, k)))
+		return nil
+	})
+}
+
+// readRevision returns the revision, or the number, stored under `key` in `b`, 0 if there is none.
+func readRevision(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// Revision is an RPC that returns the global revision and the revision of every node in `rev`,
+// including the nodes whose list was deleted.
+// It is cheap compared to `ListFiles` and tells whether the lists changed since they were listed.
+func (p *Paths) Revision(_ *struct{}, rev *Revision) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Revision", start, err) }(time.Now())
+	rev.Nodes = make(map[string]uint64)
+	return p.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revisionsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, globalKey) {
+				rev.Global = readRevision(b, k)
+			} else {
+				rev.Nodes[string(k)] = readRevision(b, k)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRevision(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	db, err := bolt.Open(filepath.Join(rootDir, "mydb"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	paths := &Paths{Db: db}
+
+	rev := new(Revision)
+	err = paths.Revision(&struct{}{}, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Global != 0 || len(rev.Nodes) != 0 {
+		t.Fatalf("An empty database should be at revision 0, instead is at '%d'", rev.Global)
+	}
+
+	update := func(id string, ops ...Operation) {
+		err := paths.Update(&Transaction{Id: id, Operations: ops}, new(Transaction))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("1", Operation{Path: "/a", Event: Create})
+	update("1", Operation{Path: "/b", Event: Create})
+	update("2", Operation{Path: "/c", Event: Create})
+	// Nothing is applied, the revisions don't change.
+	update("2", Operation{Path: "/d", Event: Event(0)})
+	err = paths.DeleteList("2", &struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rev = new(Revision)
+	err = paths.Revision(&struct{}{}, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Global != 4 {
+		t.Fatalf("Global revision should be '4', instead is '%d'", rev.Global)
+	}
+	if rev.Nodes["1"] != 2 || rev.Nodes["2"] != 2 || len(rev.Nodes) != 2 {
+		t.Fatalf("Revisions of the nodes should be '2', instead are '%v'", rev.Nodes)
+	}
+
+	// The revisions aren't listed as a node.
+	list := []Node{}
+	err = paths.ListFiles(&ListRequest{}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "1" {
+		t.Fatalf("list should only have node '1', instead has '%d' nodes", len(list))
+	}
+
+	for _, id := range []string{"", internalPrefix + "revisions"} {
+		err = paths.Update(&Transaction{Id: id, Operations: []Operation{{Path: "/a", Event: Create}}}, new(Transaction))
+		if err == nil {
+			t.Fatalf("Update should refuse the id '%q'", id)
+		}
+		err = paths.DeleteList(id, &struct{}{})
+		if err == nil {
+			t.Fatalf("DeleteList should refuse the id '%q'", id)
+		}
+	}
+}
+
+func TestCountPaths(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	// A database created before the numbers of paths were recorded.
+	err := paths.Db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("db-1"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("var/lib/db"), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.CountPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateAt(t, paths, "web-1", Create, "etc/a", "etc/b", "etc/c")
+	updateAt(t, paths, "web-1", Remove, "etc/a", "etc/d")
+	// Paths created twice are counted once.
+	updateAt(t, paths, "web-1", Create, "etc/b")
+	resync(t, paths, "web-2", "etc/a", "etc/b")
+	resync(t, paths, "web-2", "etc/b", "etc/c", "etc/d")
+	updateAt(t, paths, "web-3", Create, "etc/a")
+	err = paths.DeleteList("web-3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	err = paths.Db.View(func(tx *bolt.Tx) error {
+		ForEachNode(tx, func(id string, n int) {
+			counts[id] = n
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(counts) != "map[db-1:1 web-1:2 web-2:3]" {
+		t.Fatalf("Numbers of paths should be 'map[db-1:1 web-1:2 web-2:3]', instead are '%v'", counts)
+	}
+}
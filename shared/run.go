@@ -1,30 +1,37 @@
 package shared
 
-import (
-	"encoding/json"
-	"os"
-
-	"github.com/matarc/filewatcher/log"
-)
+import "context"
 
 // Runnable is an interface that represents either a server or a client.
+// `Run` starts the background goroutines of the runnable and returns, they keep running until
+// `Stop` is called or until `ctx` is done.
+// `Done` returns a channel that is closed when the runnable fails or is stopped, in which case
+// `Err` returns the fatal error that made it fail, if any.
+// `Stop` stops accepting new work, waits for the work in flight to complete and then releases
+// all resources. It returns an error if the work in flight couldn't be completed before `ctx`
+// is done, in which case resources are released anyway.
 type Runnable interface {
-	Run() error
-	Stop()
+	Run(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Done() <-chan struct{}
+	Err() error
 	Init()
 }
 
+// Reloadable is a `Runnable` whose configuration can be changed while it runs.
+// `Reload` receives a new configuration, of the same type as the runnable and already initialised
+// by `LoadConfig`, works out what changed and applies only that.
+// It returns `ErrRestartRequired` if some changes can't be applied in place, in which case none
+// of them are applied.
+type Reloadable interface {
+	Runnable
+	Reload(cfg Runnable) error
+}
+
 // LoadConfig loads the json file `cfgPath` and stores it in `r`.
 // It initialises `r` after loading it by calling `Init`
+// If the file can't be read, the default configuration is used, see `Config` for more control.
 func LoadConfig(cfgPath string, r Runnable) {
-	file, err := os.Open(cfgPath)
-	if err != nil {
-		log.Errorf("Can't open '%s', using default configuration instead", cfgPath)
-	} else {
-		err = json.NewDecoder(file).Decode(r)
-		if err != nil {
-			log.Errorf("Can't decode '%s' as a json file, using default configuration instead", cfgPath)
-		}
-	}
-	r.Init()
+	cfg := &Config{Path: cfgPath}
+	cfg.Load(r)
 }
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -12,9 +13,11 @@ type server struct {
 	StorageAddress string
 }
 
-func (s *server) Init()      {}
-func (s *server) Run() error { return nil }
-func (s *server) Stop()      {}
+func (s *server) Init()                          {}
+func (s *server) Run(ctx context.Context) error  { return nil }
+func (s *server) Stop(ctx context.Context) error { return nil }
+func (s *server) Done() <-chan struct{}          { return nil }
+func (s *server) Err() error                     { return nil }
 
 func TestLoadConfig(t *testing.T) {
 	file, err := ioutil.TempFile("", "filewatcher")
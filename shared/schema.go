@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"reflect"
+	"time"
+)
+
+// SchemaURL is the version of JSON Schema produced by `Schema`.
+const SchemaURL = "http://json-schema.org/draft-07/schema#"
+
+// Schema returns the JSON Schema of the json configuration of `r`, generated from its exported
+// fields, titled `title`.
+func Schema(r interface{}, title string) map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(r))
+	schema["$schema"] = SchemaURL
+	schema["title"] = title
+	return schema
+}
+
+// typeSchema returns the JSON Schema of the values of type `t`.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	nullable := false
+	if t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+	schema := make(map[string]interface{})
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Anonymous || f.Tag.Get("json") == "-" {
+				continue
+			}
+			properties[f.Name] = typeSchema(f.Type)
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+	case reflect.Slice, reflect.Array:
+		schema["type"] = "array"
+		schema["items"] = typeSchema(t.Elem())
+		nullable = t.Kind() == reflect.Slice
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = typeSchema(t.Elem())
+		nullable = true
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		schema["type"] = "integer"
+		if t == reflect.TypeOf(time.Duration(0)) {
+			schema["description"] = "Duration in nanoseconds"
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+		schema["minimum"] = 0
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	}
+	if nullable {
+		schema["type"] = []interface{}{schema["type"], "null"}
+	}
+	return schema
+}
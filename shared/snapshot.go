@@ -0,0 +1,283 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matarc/filewatcher/log"
+)
+
+var (
+	// snapshotsBucket holds a bucket per snapshot, under the key given by `snapshotKey`, holding a
+	// bucket per node whose keys are the paths of its list.
+	snapshotsBucket = []byte(internalPrefix + "snapshots")
+	// snapshotInfoBucket maps the name of every snapshot to its `Snapshot` encoded in json.
+	snapshotInfoBucket = []byte(internalPrefix + "snapshots-info")
+)
+
+// CheckSnapshotName returns an error if `name` can't be the name of a snapshot, which follows the
+// rules of the names of baselines.
+func CheckSnapshotName(name string) error {
+	return checkName("snapshot", name)
+}
+
+// snapshotKey returns the key of the bucket holding the lists of the snapshot `name` taken at
+// `created`, so that a snapshot can be taken again under the same name while the previous one is
+// still read.
+func snapshotKey(name string, created time.Time) []byte {
+	return append([]byte(name+indexSeparator), timeKey(created)...)
+}
+
+// snapshotInfo returns the description of the snapshot `name`, or `ErrUnknownSnapshot` if there
+// is none.
+func snapshotInfo(tx *bolt.Tx, name string) (Snapshot, error) {
+	var snapshot Snapshot
+	var data []byte
+	if info := tx.Bucket(snapshotInfoBucket); info != nil {
+		data = info.Get([]byte(name))
+	}
+	if data == nil {
+		return snapshot, ErrUnknownSnapshot
+	}
+	return snapshot, json.Unmarshal(data, &snapshot)
+}
+
+// snapshotOf returns the bucket of the snapshot `name`, or `ErrUnknownSnapshot` if there is none.
+func snapshotOf(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	snapshot, err := snapshotInfo(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if root := tx.Bucket(snapshotsBucket); root != nil {
+		if b := root.Bucket(snapshotKey(name, snapshot.Created)); b != nil {
+			return b, nil
+		}
+	}
+	return nil, ErrUnknownSnapshot
+}
+
+// TakeSnapshot is an RPC that copies the lists of all nodes as they were at `req.At`, or as they
+// are now if it is zero, into the snapshot `req.Name`, replacing the snapshot of the same name if
+// any, and returns its description in `snapshot`.
+// The lists of a snapshot are read as fast as the current lists and are kept however old the
+// journal is. Nodes whose journal doesn't go back to `req.At` are left out.
+// Lists are copied a chunk at a time by `copyList`, so that updates aren't blocked while the
+// snapshot is taken, and the snapshot only replaces the previous one once it is complete.
+// It returns `ErrSnapshotInProgress` if the snapshot `req.Name` is already being taken, or an
+// error if the operation can't be completed.
+func (p *Paths) TakeSnapshot(req *SnapshotRequest, snapshot *Snapshot) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.TakeSnapshot", start, err) }(time.Now())
+	if err := CheckSnapshotName(req.Name); err != nil {
+		return err
+	}
+	if err := p.startSnapshot(req.Name); err != nil {
+		return err
+	}
+	defer p.endSnapshot(req.Name)
+	now := time.Now().UTC()
+	at := req.At
+	if at.IsZero() {
+		at = now
+	} else if at.After(now) {
+		return fmt.Errorf("Snapshot time '%s' is in the future", at.Format(time.RFC3339))
+	}
+	logger := log.With("request", req.RequestId, "snapshot", req.Name, "at", at)
+	logger.Info("Taking snapshot")
+	key := snapshotKey(req.Name, now)
+	var ids []string
+	err = p.Db.Update(func(tx *bolt.Tx) error {
+		ids = nil
+		root, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		if err != nil {
+			return err
+		}
+		if since := tx.Bucket(journalSinceBucket); since != nil {
+			since.ForEach(func(k, v []byte) error {
+				ids = append(ids, string(k))
+				return nil
+			})
+		}
+		_, err = root.CreateBucket(key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// The lists copied so far are dropped.
+			p.Db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(snapshotsBucket).DeleteBucket(key)
+			})
+		}
+	}()
+
+	*snapshot = Snapshot{Name: req.Name, At: at.UTC(), Created: now, NodePaths: map[string]int{}}
+	for _, id := range ids {
+		paths, err := p.copyList(key, id, at)
+		if err == ErrBeforeJournal || err == ErrUnknownNode {
+			logger.With("node", id).Debug("Leaving node out of snapshot")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if paths > 0 {
+			snapshot.Nodes++
+			snapshot.Paths += paths
+			snapshot.NodePaths[id] = paths
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		info, err := tx.CreateBucketIfNotExists(snapshotInfoBucket)
+		if err != nil {
+			return err
+		}
+		if previous, err := snapshotInfo(tx, req.Name); err == nil {
+			root := tx.Bucket(snapshotsBucket)
+			if root.Bucket(snapshotKey(req.Name, previous.Created)) != nil {
+				err = root.DeleteBucket(snapshotKey(req.Name, previous.Created))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return info.Put([]byte(req.Name), data)
+	})
+}
+
+// copyList copies the list of the node `id` as it was at `at` into the bucket `key` of the
+// snapshots, and returns the number of paths copied.
+// Every chunk of at most `MaxChunkPaths` paths is rebuilt in a read transaction and written in a
+// write transaction of its own, so that neither the whole list is held in memory nor updates are
+// blocked while it is copied. As the list is rebuilt at `at`, the changes made between two chunks
+// don't alter it.
+// It returns the errors of `listAt`, or an error if the operation can't be completed.
+func (p *Paths) copyList(key []byte, id string, at time.Time) (int, error) {
+	after, count := "", 0
+	for {
+		var chunk []string
+		var done bool
+		err := p.Db.View(func(tx *bolt.Tx) (err error) {
+			after, done, err = listAt(tx, id, at, after, MaxChunkPaths, func(path string) {
+				chunk = append(chunk, path)
+			})
+			return err
+		})
+		if err != nil {
+			return count, err
+		}
+		if len(chunk) > 0 {
+			err = p.Db.Update(func(tx *bolt.Tx) error {
+				snapshot := tx.Bucket(snapshotsBucket).Bucket(key)
+				if snapshot == nil {
+					return ErrUnknownSnapshot
+				}
+				b, err := snapshot.CreateBucketIfNotExists([]byte(id))
+				if err != nil {
+					return err
+				}
+				for _, path := range chunk {
+					err = b.Put([]byte(path), []byte{})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return count, err
+			}
+		}
+		count += len(chunk)
+		if done {
+			return count, nil
+		}
+	}
+}
+
+// startSnapshot records that the snapshot `name` is being taken, so that it is taken or deleted
+// by one RPC at a time. It must be followed by a call to `endSnapshot`.
+// It returns `ErrSnapshotInProgress` if the snapshot is already being taken.
+func (p *Paths) startSnapshot(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.snapshotting[name] {
+		return ErrSnapshotInProgress
+	}
+	if p.snapshotting == nil {
+		p.snapshotting = make(map[string]bool)
+	}
+	p.snapshotting[name] = true
+	return nil
+}
+
+func (p *Paths) endSnapshot(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.snapshotting, name)
+}
+
+// DeleteSnapshot is an RPC that deletes the snapshot `name`.
+// It returns `ErrUnknownSnapshot` if there is no such snapshot, `ErrSnapshotInProgress` if it is
+// being taken, or an error if the operation can't be completed.
+func (p *Paths) DeleteSnapshot(name string, _ *struct{}) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.DeleteSnapshot", start, err) }(time.Now())
+	if err := p.startSnapshot(name); err != nil {
+		return err
+	}
+	defer p.endSnapshot(name)
+	log.With("snapshot", name).Info("Deleting snapshot")
+	return p.Db.Update(func(tx *bolt.Tx) error {
+		snapshot, err := snapshotInfo(tx, name)
+		if err != nil {
+			return err
+		}
+		if root := tx.Bucket(snapshotsBucket); root != nil && root.Bucket(snapshotKey(name, snapshot.Created)) != nil {
+			err = root.DeleteBucket(snapshotKey(name, snapshot.Created))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(snapshotInfoBucket).Delete([]byte(name))
+	})
+}
+
+// Snapshots is an RPC that returns in `list` all the snapshots, sorted by name.
+// It returns an error if the operation can't be completed.
+func (p *Paths) Snapshots(_ *struct{}, list *[]Snapshot) (err error) {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+	defer func(start time.Time) { p.observe("Paths.Snapshots", start, err) }(time.Now())
+	return p.Db.View(func(tx *bolt.Tx) error {
+		info := tx.Bucket(snapshotInfoBucket)
+		if info == nil {
+			return nil
+		}
+		return info.ForEach(func(k, v []byte) error {
+			var snapshot Snapshot
+			err := json.Unmarshal(v, &snapshot)
+			if err != nil {
+				return err
+			}
+			*list = append(*list, snapshot)
+			return nil
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package shared
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	updateAt(t, paths, "db-1", Create, "var/lib/db")
+	t0 := updateAt(t, paths, "web-1", Create, "etc/a", "etc/b")
+	updateAt(t, paths, "web-1", Remove, "etc/a")
+	updateAt(t, paths, "web-2", Create, "etc/c")
+
+	snapshot := new(Snapshot)
+	err := paths.TakeSnapshot(&SnapshotRequest{Name: "before-deploy", At: t0}, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Nodes != 2 || snapshot.Paths != 3 {
+		t.Fatalf("Snapshot should hold '2' nodes and '3' paths, instead is '%+v'", snapshot)
+	}
+	if fmt.Sprint(snapshot.NodePaths) != "map[db-1:1 web-1:2]" {
+		t.Fatalf("Snapshot should hold '1' path of 'db-1' and '2' of 'web-1', instead holds '%v'", snapshot.NodePaths)
+	}
+	err = paths.TakeSnapshot(&SnapshotRequest{Name: "now"}, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Nodes != 3 || snapshot.Paths != 3 {
+		t.Fatalf("Snapshot should hold '3' nodes and '3' paths, instead is '%+v'", snapshot)
+	}
+
+	// Snapshots outlive the journal.
+	_, err = paths.PruneJournal(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		snapshot, node, list string
+	}{
+		{"before-deploy", "web-1", "[etc/a etc/b]"},
+		{"now", "web-1", "[etc/b]"},
+		{"now", "web-2", "[etc/c]"},
+	} {
+		list := []string{}
+		req := &FilesRequest{Node: test.node, Snapshot: test.snapshot, Max: 1}
+		for done := false; !done; {
+			files := new(Files)
+			err = paths.FilesAt(req, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, files.Paths...)
+			req.After, done = files.Next, files.Done
+		}
+		if fmt.Sprint(list) != test.list {
+			t.Fatalf("List of '%s' in '%s' should be '%s', instead is '%v'", test.node, test.snapshot, test.list, list)
+		}
+	}
+	err = paths.FilesAt(&FilesRequest{Node: "web-2", Snapshot: "before-deploy"}, new(Files))
+	if err != ErrUnknownNode {
+		t.Fatalf("FilesAt should return '%s', instead returns '%v'", ErrUnknownNode, err)
+	}
+
+	var snapshots []Snapshot
+	err = paths.Snapshots(nil, &snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != "before-deploy" || !snapshots[0].At.Equal(t0) {
+		t.Fatalf("Snapshots should be 'before-deploy' at '%s' and 'now', instead are '%+v'", t0, snapshots)
+	}
+	err = paths.DeleteSnapshot("before-deploy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.FilesAt(&FilesRequest{Node: "web-1", Snapshot: "before-deploy"}, new(Files))
+	if err != ErrUnknownSnapshot {
+		t.Fatalf("FilesAt should return '%s', instead returns '%v'", ErrUnknownSnapshot, err)
+	}
+	err = paths.TakeSnapshot(&SnapshotRequest{Name: "later", At: time.Now().Add(time.Hour)}, snapshot)
+	if err == nil {
+		t.Fatalf("TakeSnapshot should refuse a time in the future")
+	}
+}
+
+func TestTakeSnapshotChunks(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	files := make([]string, MaxChunkPaths+1)
+	for i := range files {
+		files[i] = fmt.Sprintf("var/log/%05d", i)
+	}
+	updateAt(t, paths, "web-1", Create, files...)
+
+	// Taking a snapshot again replaces the lists of the previous one.
+	for i := 0; i < 2; i++ {
+		snapshot := new(Snapshot)
+		err := paths.TakeSnapshot(&SnapshotRequest{Name: "big"}, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.Paths != len(files) {
+			t.Fatalf("Snapshot should hold '%d' paths, instead holds '%d'", len(files), snapshot.Paths)
+		}
+	}
+	err := paths.Db.View(func(tx *bolt.Tx) error {
+		buckets := 0
+		tx.Bucket(snapshotsBucket).ForEach(func(k, v []byte) error {
+			buckets++
+			return nil
+		})
+		if buckets != 1 {
+			t.Fatalf("Snapshots should hold '1' bucket, instead hold '%d'", buckets)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := new(Files)
+	err = paths.FilesAt(&FilesRequest{Node: "web-1", Snapshot: "big", After: files[MaxChunkPaths-1]}, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(list.Paths) != fmt.Sprint(files[MaxChunkPaths:]) {
+		t.Fatalf("List should be '%v', instead is '%v'", files[MaxChunkPaths:], list.Paths)
+	}
+}
+
+func TestTakeSnapshotInProgress(t *testing.T) {
+	paths, closeDb := openPaths(t)
+	defer closeDb()
+
+	updateAt(t, paths, "web-1", Create, "etc/a")
+	err := paths.startSnapshot("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = paths.TakeSnapshot(&SnapshotRequest{Name: "busy"}, new(Snapshot))
+	if err != ErrSnapshotInProgress {
+		t.Fatalf("TakeSnapshot should return '%s', instead returns '%v'", ErrSnapshotInProgress, err)
+	}
+	err = paths.DeleteSnapshot("busy", nil)
+	if err != ErrSnapshotInProgress {
+		t.Fatalf("DeleteSnapshot should return '%s', instead returns '%v'", ErrSnapshotInProgress, err)
+	}
+	// Other snapshots can still be taken.
+	err = paths.TakeSnapshot(&SnapshotRequest{Name: "other"}, new(Snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths.endSnapshot("busy")
+	err = paths.TakeSnapshot(&SnapshotRequest{Name: "busy"}, new(Snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,5 +1,7 @@
 package shared
 
+import "time"
+
 type Operation struct {
 	Path  string
 	Event Event
@@ -10,6 +12,218 @@ type Transaction struct {
 	Operations []Operation
 }
 
+// ListRequest is the argument of the `Paths.ListFiles` RPC.
+type ListRequest struct {
+	// RequestId is the id of the request that triggered the RPC, used to follow it from one
+	// component to the next.
+	RequestId string
+}
+
+// ListChunkRequest is the argument of the `Paths.ListChunk` RPC.
+type ListChunkRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	// Next is where the chunk starts, the beginning of the first list if it is the zero value.
+	Next ListCursor
+	// Max is the maximum number of paths in the chunk.
+	Max int
+}
+
+// ListCursor is a position in the lists : the path following `After` in the list of the node
+// `Node`, or the first path of `Node` if `After` is empty.
+type ListCursor struct {
+	Node  string
+	After string
+}
+
+// ListChunk is the reply of the `Paths.ListChunk` RPC, consecutive parts of the lists of the
+// nodes ordered by id.
+// The list of a node may be split in several parts, over several chunks, in which case the parts
+// following the first one have the same id.
+type ListChunk struct {
+	Parts []Node
+	// Next is where the next chunk starts, unless `Done` is true.
+	Next ListCursor
+	// Done is true if the chunk ends with the last path of the last list.
+	Done bool
+}
+
+// LookupRequest is the argument of the `Paths.Lookup` RPC.
+type LookupRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Paths     []string
+}
+
+// PathNodes is a path along with the ids of the nodes having it, in the reply of `Paths.Lookup`.
+type PathNodes struct {
+	Path  string
+	Nodes []string
+}
+
+// DiffRequest is the argument of the `Paths.Diff` RPC.
+type DiffRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	// A and B are the ids of the nodes whose lists are compared.
+	A, B string
+	// Prefix restricts the comparison to the paths starting with it.
+	Prefix string
+	// After is the last path of the previous part of the comparison, if any.
+	After string
+	// Max is the maximum number of paths in the reply.
+	Max int
+}
+
+// Diff is the reply of the `Paths.Diff` RPC.
+type Diff struct {
+	OnlyA []string
+	OnlyB []string
+	// Changed are the paths of both lists whose metadata differ, lists don't hold any yet.
+	Changed []string
+	// Next is the `After` of the next part of the comparison, unless `Done` is true.
+	Next string
+	Done bool
+}
+
+// NodeInfo describes the list of a node, in the reply of the `Paths.Nodes` RPC.
+type NodeInfo struct {
+	Id    string
+	Paths int
+}
+
+// Baseline is a list pinned under `Name`, to which the lists of nodes can be compared.
+type Baseline struct {
+	Name string
+	// Node is the node whose list was pinned, empty if the list was uploaded.
+	Node string
+	// Owner is the name of the credential that pinned the baseline, empty if the REST API has no
+	// authentication.
+	Owner   string
+	Paths   int
+	Created time.Time
+}
+
+// PinRequest is the argument of the `Paths.PinBaseline` RPC, which pins the list of `Node` if it
+// is set, `Paths` otherwise.
+type PinRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Name      string
+	Node      string
+	Paths     []string
+	Owner     string
+	// Replace replaces the baseline of the same name, pinning it again is refused otherwise.
+	Replace bool
+}
+
+// DriftRequest is the argument of the `Paths.Drift` RPC.
+type DriftRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Node      string
+	Baseline  string
+	// After is the last path of the previous part of the drift, if any.
+	After string
+	// Max is the maximum number of paths in the reply.
+	Max int
+	// CountOnly only counts the paths added and removed, over the whole list.
+	CountOnly bool
+}
+
+// Drift is the reply of the `Paths.Drift` RPC, the paths added to the list of a node and the
+// paths removed from it since its baseline.
+type Drift struct {
+	Added   []string
+	Removed []string
+	// AddedCount and RemovedCount are only set if `CountOnly` was asked.
+	AddedCount   int
+	RemovedCount int
+	// Next is the `After` of the next part of the drift, unless `Done` is true.
+	Next string
+	Done bool
+}
+
+// FilesRequest is the argument of the `Paths.FilesAt` RPC.
+type FilesRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Node      string
+	// At is the time the list is asked at, unless `Snapshot` is set.
+	At       time.Time
+	Snapshot string
+	// After is the last path of the previous part of the list, if any.
+	After string
+	// Max is the maximum number of paths in the reply.
+	Max int
+}
+
+// Files is the reply of the `Paths.FilesAt` RPC, a part of the list of a node.
+type Files struct {
+	Paths []string
+	// Next is the `After` of the next part of the list, unless `Done` is true.
+	Next string
+	Done bool
+}
+
+// Snapshot is the lists of all nodes at `At`, kept under `Name`.
+type Snapshot struct {
+	Name    string
+	At      time.Time
+	Created time.Time
+	Nodes   int
+	Paths   int
+	// NodePaths maps the id of every node in the snapshot to the number of paths of its list.
+	NodePaths map[string]int
+}
+
+// SnapshotRequest is the argument of the `Paths.TakeSnapshot` RPC, which takes the snapshot
+// `Name` of the lists at `At`, now if it is zero.
+type SnapshotRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Name      string
+	At        time.Time
+}
+
+// HistoryRequest is the argument of the `Paths.History` RPC.
+type HistoryRequest struct {
+	// RequestId is the id of the request that triggered the RPC.
+	RequestId string
+	Node      string
+	Path      string
+	// After is the `Next` of the previous part of the history, if any.
+	After string
+	// Max is the maximum number of events in the reply.
+	Max int
+}
+
+// PathEvent is a change of a path at `Time`.
+type PathEvent struct {
+	Time  time.Time
+	Event Event
+}
+
+// History is the reply of the `Paths.History` RPC, a part of the changes of a path.
+type History struct {
+	// Since is the time from which changes are recorded, zero if the journal of the node wasn't
+	// started.
+	Since  time.Time
+	Events []PathEvent
+	// Next is the `After` of the next part of the history, unless `Done` is true.
+	Next string
+	Done bool
+}
+
+// Revision is the reply of the `Paths.Revision` RPC.
+type Revision struct {
+	// Global increases every time any list changes.
+	Global uint64
+	// Nodes maps the id of every node to the revision of its list, which increases every time
+	// the list changes.
+	Nodes map[string]uint64
+}
+
 type Node struct {
 	Id    string
 	Files []string
@@ -0,0 +1,288 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Validator is implemented by the configurations that can check their settings.
+type Validator interface {
+	// Validate returns the problems found in the settings that are set.
+	Validate() []FieldError
+}
+
+// FieldError is a problem found in the setting `Field`, nested settings being named by joining
+// the names of their parents with `.`.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s : %s", e.Field, e.Err)
+}
+
+// ConfigError is a problem found at line `Line` of a configuration file.
+type ConfigError struct {
+	Line  int
+	Field string
+	Err   error
+}
+
+func (e ConfigError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d : %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d : %s : %s", e.Line, e.Field, e.Err)
+}
+
+// ValidateConfig checks the json configuration `data` against the settings of `r`.
+// It reports syntax errors, unknown settings and values of the wrong type, and then the
+// problems found by `Validate` if `r` is a `Validator`.
+// It returns every problem found, ordered by line.
+func ValidateConfig(data []byte, r Runnable) []ConfigError {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		// Errors that aren't syntax errors, such as an unexpected end of file, are reported on
+		// the last line.
+		line := lineAt(data, len(data))
+		if serr, ok := err.(*json.SyntaxError); ok {
+			line = lineAt(data, int(serr.Offset))
+		}
+		return []ConfigError{{Line: line, Err: err}}
+	}
+	var errs []ConfigError
+	checkValue(data, v, reflect.TypeOf(r), nil, &errs)
+	json.Unmarshal(data, r)
+	if validator, ok := r.(Validator); ok {
+		for _, ferr := range validator.Validate() {
+			field := strings.Split(ferr.Field, ".")
+			errs = append(errs, ConfigError{Line: locate(data, field), Field: ferr.Field, Err: ferr.Err})
+		}
+	}
+	sortConfigErrors(errs)
+	return errs
+}
+
+// sortConfigErrors sorts `errs` by line, keeping the order of errors found on the same line.
+func sortConfigErrors(errs []ConfigError) {
+	for i := 1; i < len(errs); i++ {
+		for j := i; j > 0 && errs[j].Line < errs[j-1].Line; j-- {
+			errs[j], errs[j-1] = errs[j-1], errs[j]
+		}
+	}
+}
+
+// checkValue checks that the decoded json value `v` can be stored in a value of type `t`.
+// `field` is the path of `v` in `data`, used to find the line of the problems appended to `errs`.
+func checkValue(data []byte, v interface{}, t reflect.Type, field []string, errs *[]ConfigError) {
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, ConfigError{
+			Line:  locate(data, field),
+			Field: strings.Join(field, "."),
+			Err:   fmt.Errorf(format, a...),
+		})
+	}
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		default:
+			fail("can't be null")
+		}
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("should be an object, instead is %s", jsonType(v))
+			return
+		}
+		for key, value := range obj {
+			path := append(append([]string{}, field...), key)
+			f, ok := fieldByJSONName(t, key)
+			if !ok {
+				*errs = append(*errs, ConfigError{
+					Line:  locate(data, path),
+					Field: strings.Join(path, "."),
+					Err:   fmt.Errorf("unknown setting"),
+				})
+				continue
+			}
+			checkValue(data, value, f.Type, path, errs)
+		}
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			fail("should be an array, instead is %s", jsonType(v))
+			return
+		}
+		for _, value := range arr {
+			checkValue(data, value, t.Elem(), field, errs)
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("should be an object, instead is %s", jsonType(v))
+			return
+		}
+		for key, value := range obj {
+			checkValue(data, value, t.Elem(), append(append([]string{}, field...), key), errs)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			fail("should be a string, instead is %s", jsonType(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			fail("should be a boolean, instead is %s", jsonType(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("should be an integer, instead is %s", jsonType(v))
+			return
+		}
+		if _, err := n.Int64(); err != nil {
+			fail("should be an integer, instead is '%s'", n)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(json.Number); !ok {
+			fail("should be a number, instead is %s", jsonType(v))
+		}
+	}
+}
+
+// fieldByJSONName returns the exported field of the struct type `t` that encoding/json decodes
+// `name` into, names being matched regardless of their case.
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous || f.Tag.Get("json") == "-" {
+			continue
+		}
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonType returns the name of the json type of the decoded value `v`.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	}
+	return "null"
+}
+
+// locate returns the line of `data` where the setting `field` is defined, looking for the keys
+// of its parents one after the other.
+// If a key can't be found, the line of the last key found is returned.
+func locate(data []byte, field []string) int {
+	lower := bytes.ToLower(data)
+	offset, found := 0, 0
+	for _, name := range field {
+		key := []byte(`"` + strings.ToLower(name) + `"`)
+		i := bytes.Index(lower[offset:], key)
+		if i < 0 {
+			break
+		}
+		found = offset + i
+		offset = found + len(key)
+	}
+	return lineAt(data, found)
+}
+
+// lineAt returns the line of `data` at `offset`, starting at 1.
+func lineAt(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// CheckAddress returns an error if `address` isn't in the form `host:port`.
+func CheckAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+// CheckDir returns an error if `path` isn't an existing directory.
+func CheckDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", path)
+	}
+	return nil
+}
+
+// CheckReadable returns an error if the file `path` can't be read.
+func CheckReadable(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// CheckWritable returns an error if the file `path` can't be written, or created if it doesn't
+// exist yet.
+// It leaves the file system untouched.
+func CheckWritable(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("'%s' is a directory", path)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	dir := filepath.Dir(path)
+	err = CheckDir(dir)
+	if err != nil {
+		return fmt.Errorf("'%s' can't be created : %s", path, err)
+	}
+	file, err := ioutil.TempFile(dir, ".filewatcher")
+	if err != nil {
+		return fmt.Errorf("'%s' can't be created, '%s' is not writable", path, dir)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,113 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func (c *configured) Validate() (errs []FieldError) {
+	if c.Address != "" {
+		if err := CheckAddress(c.Address); err != nil {
+			errs = append(errs, FieldError{Field: "Address", Err: err})
+		}
+	}
+	if c.TLS != nil && c.TLS.CertFile != "" {
+		if err := CheckReadable(c.TLS.CertFile); err != nil {
+			errs = append(errs, FieldError{Field: "TLS.CertFile", Err: err})
+		}
+	}
+	return errs
+}
+
+func TestValidateConfig(t *testing.T) {
+	errs := ValidateConfig([]byte(`{"Address": "localhost:8080", "Nodes": ["a"]}`), new(configured))
+	if len(errs) != 0 {
+		t.Fatalf("There should be no error, instead there are '%v'", errs)
+	}
+
+	data := `{
+	"Address": "localhost",
+	"Verbose": "yes",
+	"Nodes": [1],
+	"Unknown": true,
+	"TLS": {
+		"Port": 1.5,
+		"CertFile": "/nonexistent/cert.pem"
+	}
+}`
+	errs = ValidateConfig([]byte(data), new(configured))
+	expected := []struct {
+		line  int
+		field string
+	}{
+		{2, "Address"},
+		{3, "Verbose"},
+		{4, "Nodes"},
+		{5, "Unknown"},
+		{7, "TLS.Port"},
+		{8, "TLS.CertFile"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("There should be %d errors, instead there are %d : '%v'", len(expected), len(errs), errs)
+	}
+	for i := range expected {
+		if errs[i].Line != expected[i].line || errs[i].Field != expected[i].field {
+			t.Fatalf("Error %d should be on line %d for '%s', instead is '%s'", i, expected[i].line, expected[i].field, errs[i])
+		}
+	}
+
+	errs = ValidateConfig([]byte("{\n\t\"Address\": \"localhost:8080\",\n}"), new(configured))
+	if len(errs) != 1 || errs[0].Line != 3 {
+		t.Fatalf("There should be a syntax error on line 3, instead there are '%v'", errs)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	err = CheckWritable(filepath.Join(rootDir, "mydb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(rootDir)
+	if len(files) != 0 {
+		t.Fatalf("CheckWritable should leave the directory untouched, instead it contains %d files", len(files))
+	}
+	err = CheckWritable(rootDir)
+	if err == nil {
+		t.Fatalf("CheckWritable should return an error on a directory")
+	}
+	err = CheckWritable(filepath.Join(rootDir, "missing", "mydb"))
+	if err == nil || !strings.Contains(err.Error(), "can't be created") {
+		t.Fatalf("CheckWritable should return an error when the directory doesn't exist, instead returns '%v'", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema(new(configured), "test")
+	if schema["$schema"] != SchemaURL || schema["title"] != "test" {
+		t.Fatalf("Schema should have a $schema and a title, instead is '%v'", schema)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	if _, ok := properties["secret"]; ok {
+		t.Fatalf("Unexported fields should not be in the schema")
+	}
+	address := properties["Address"].(map[string]interface{})
+	if address["type"] != "string" {
+		t.Fatalf("Address should be a string, instead is '%v'", address["type"])
+	}
+	tls := properties["TLS"].(map[string]interface{})
+	port := tls["properties"].(map[string]interface{})["Port"].(map[string]interface{})
+	if port["type"] != "integer" {
+		t.Fatalf("TLS.Port should be an integer, instead is '%v'", port["type"])
+	}
+	if tls["additionalProperties"] != false {
+		t.Fatalf("TLS should not allow additional properties")
+	}
+}
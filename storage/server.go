@@ -1,23 +1,58 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"net/http"
 	"net/rpc"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 
+	"github.com/matarc/filewatcher/health"
 	"github.com/matarc/filewatcher/log"
+	"github.com/matarc/filewatcher/metrics"
 	"github.com/matarc/filewatcher/shared"
+	"github.com/matarc/filewatcher/trace"
 )
 
+const (
+	// defaultJournalMaxAge is the number of days changes are kept in the journal if `Journal` is
+	// unset.
+	defaultJournalMaxAge = 30
+	// pruneInterval is the time between two prunings of the journal.
+	pruneInterval = time.Hour
+)
+
+// JournalConfig sets how long the changes of the lists are kept in the journal, which bounds how
+// far back lists can be rebuilt. Snapshots are kept until they are deleted.
+type JournalConfig struct {
+	// MaxAge is the number of days changes are kept, 0 keeps them forever.
+	MaxAge int
+}
+
 type Server struct {
-	Address  string
-	DbPath   string
-	rpcSrv   *rpc.Server
-	listener net.Listener
-	db       *bolt.DB
+	Address        string
+	DbPath         string
+	MonitorAddress string
+	Log            *log.Config
+	Journal        *JournalConfig
+	rpcSrv         *rpc.Server
+	paths          *shared.Paths
+	listener       net.Listener
+	monitor        *http.Server
+	db             *bolt.DB
+	metrics        *metrics.Registry
+	traces         *trace.Recorder
+	pruneCh        chan struct{}
+	mu             sync.Mutex
+	conns          map[net.Conn]bool
+	wg             sync.WaitGroup
+	lifecycle      shared.Lifecycle
 }
 
 // Init initialises the server.
@@ -30,14 +65,59 @@ func (srv *Server) Init() {
 		log.Infof("DbPath is unset, using default path '%s'", shared.DefaultDbPath)
 		srv.DbPath = shared.DefaultDbPath
 	}
+	if srv.Journal == nil {
+		log.Infof("Journal is unset, keeping changes for %d days", defaultJournalMaxAge)
+		srv.Journal = &JournalConfig{MaxAge: defaultJournalMaxAge}
+	}
 	srv.rpcSrv = rpc.NewServer()
 	srv.DbPath = filepath.Clean(srv.DbPath)
+	srv.metrics = metrics.NewRegistry()
+	srv.metrics.Collect(srv.collectDbMetrics)
+	srv.traces = trace.NewRecorder(shared.TracesKept)
+	srv.conns = make(map[net.Conn]bool)
+	srv.pruneCh = make(chan struct{}, 1)
+}
+
+// Validate checks the settings of the server that are set.
+func (srv *Server) Validate() (errs []shared.FieldError) {
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, shared.FieldError{Field: field, Err: err})
+		}
+	}
+	if srv.Address != "" {
+		check("Address", shared.CheckAddress(srv.Address))
+	}
+	if srv.MonitorAddress != "" {
+		check("MonitorAddress", shared.CheckAddress(srv.MonitorAddress))
+	}
+	if srv.DbPath != "" {
+		check("DbPath", shared.CheckWritable(srv.DbPath))
+	}
+	if srv.Log != nil {
+		if field, err := srv.Log.Check(); err != nil {
+			check("Log."+field, err)
+		}
+		if srv.Log.File != nil && srv.Log.File.Path != "" {
+			check("Log.File.Path", shared.CheckWritable(srv.Log.File.Path))
+		}
+	}
+	if srv.Journal != nil && srv.Journal.MaxAge < 0 {
+		check("Journal.MaxAge", fmt.Errorf("can't be negative"))
+	}
+	return errs
 }
 
 // Run starts the storage server by opening its database `db` and listening on `Address` to
 // start the RPC.Server.
-// It returns an error if it fails to do any of those two actions.
-func (srv *Server) Run() (err error) {
+// If `MonitorAddress` is set, metrics and health checks are served on that address.
+// The server fails if it can no longer accept connections or once `ctx` is done.
+// It returns an error if it fails to do any of those actions.
+func (srv *Server) Run(ctx context.Context) (err error) {
+	err = log.Configure("storage", srv.Log)
+	if err != nil {
+		return err
+	}
 	log.Infof("Opening database '%s'", srv.DbPath)
 	srv.db, err = bolt.Open(srv.DbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
@@ -45,9 +125,25 @@ func (srv *Server) Run() (err error) {
 		return
 	}
 
-	paths := new(shared.Paths)
-	paths.Db = srv.db
-	srv.rpcSrv.Register(paths)
+	srv.paths = new(shared.Paths)
+	srv.paths.Db = srv.db
+	srv.paths.Metrics = srv.metrics
+	srv.paths.Traces = srv.traces
+	err = srv.paths.BuildIndex()
+	if err == nil {
+		err = srv.paths.CountPaths()
+	}
+	if err == nil {
+		err = srv.paths.StartJournal()
+	}
+	if err == nil {
+		err = srv.paths.BuildHistory()
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	srv.rpcSrv.Register(srv.paths)
 
 	log.Infof("Listening on '%s'", srv.Address)
 	srv.listener, err = net.Listen("tcp", srv.Address)
@@ -55,19 +151,195 @@ func (srv *Server) Run() (err error) {
 		log.Error(err)
 		return
 	}
+	srv.lifecycle.Bind(ctx)
+	srv.lifecycle.Go("rpc listener", func() error { return srv.accept(srv.listener) })
+	srv.lifecycle.Go("journal pruning", func() error { return srv.pruneJournal(srv.lifecycle.Done()) })
 
-	go func() {
-		srv.rpcSrv.Accept(srv.listener)
-	}()
+	if srv.MonitorAddress != "" {
+		log.Infof("Serving metrics, health checks and traces on '%s'", srv.MonitorAddress)
+		listener, err := net.Listen("tcp", srv.MonitorAddress)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.metrics)
+		mux.Handle("/debug/traces", srv.traces)
+		health.Register(mux,
+			health.Check{Name: "database", Check: func() error {
+				return srv.paths.Ping(&struct{}{}, &struct{}{})
+			}},
+			health.Check{Name: "listener", Check: srv.checkListener},
+		)
+		srv.monitor = &http.Server{Handler: mux}
+		srv.lifecycle.Go("monitor server", func() error { return srv.monitor.Serve(listener) })
+	}
 	return nil
 }
 
-// Stop stops the server.
-func (srv *Server) Stop() {
-	if srv.db != nil {
-		srv.db.Close()
+// accept serves RPCs on every connection accepted by `listener` until it is closed.
+// Connections are tracked so that they can be closed once the server is drained.
+// Temporary errors, such as running out of file descriptors, are retried with a backoff.
+// It returns the error that made `listener` unusable.
+func (srv *Server) accept(listener net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.With("error", err, "delay", delay).Warn("Accept error, retrying")
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.rpcSrv.ServeConn(conn)
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+// pruneJournal removes the changes older than `Journal.MaxAge` from the journal every
+// `pruneInterval`, and as soon as `Journal` is reloaded, until `done` is closed.
+func (srv *Server) pruneJournal(done <-chan struct{}) error {
+	for {
+		if maxAge := srv.journalConfig().MaxAge; maxAge > 0 {
+			before := time.Now().AddDate(0, 0, -maxAge)
+			pruned, err := srv.paths.PruneJournal(before)
+			if err != nil {
+				log.With("error", err).Error("Can't prune the journal")
+			} else if pruned > 0 {
+				log.With("changes", pruned, "before", before).Info("Pruned the journal")
+			}
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(pruneInterval):
+		case <-srv.pruneCh:
+		}
+	}
+}
+
+// journalConfig returns the configuration of the journal.
+func (srv *Server) journalConfig() JournalConfig {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.Journal == nil {
+		return JournalConfig{}
+	}
+	return *srv.Journal
+}
+
+// checkListener returns an error if the RPC listener doesn't accept connections.
+func (srv *Server) checkListener() error {
+	conn, err := net.DialTimeout("tcp", srv.listener.Addr().String(), shared.PingTimeout)
+	if err != nil {
+		return err
 	}
+	return conn.Close()
+}
+
+// collectDbMetrics updates the metrics computed from the content of the database.
+func (srv *Server) collectDbMetrics() {
+	size := srv.metrics.Gauge("filewatcher_storage_db_size_bytes", "Size of the bolt database.")
+	paths := srv.metrics.Gauge("filewatcher_storage_node_paths", "Number of paths stored, by node.", "node")
+	paths.Reset()
+	if srv.db == nil {
+		return
+	}
+	err := srv.db.View(func(tx *bolt.Tx) error {
+		size.Set(float64(tx.Size()))
+		shared.ForEachNode(tx, func(id string, n int) {
+			paths.Set(float64(n), id)
+		})
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Stop stops accepting connections, waits for the RPCs in flight to complete, then closes all
+// connections and the database.
+// It returns an error if the RPCs in flight didn't complete before `ctx` is done.
+func (srv *Server) Stop(ctx context.Context) (err error) {
+	srv.lifecycle.Stop()
 	if srv.listener != nil {
 		srv.listener.Close()
 	}
+	if srv.paths != nil {
+		err = srv.paths.Drain(ctx)
+		if err != nil {
+			log.Errorf("RPCs in flight didn't complete : %s", err)
+		}
+	}
+	srv.mu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	if err == nil {
+		// A connection only terminates once its calls are completed, so we can only wait for
+		// them if the drain succeeded.
+		srv.wg.Wait()
+	}
+	if srv.monitor != nil {
+		srv.monitor.Close()
+	}
+	if srv.db != nil {
+		srv.db.Close()
+	}
+	return err
+}
+
+// Reload compares the configuration of `cfg`, which must be an initialised `*Server`, with the
+// running one.
+// Only `Log` and `Journal` can be changed in place, so it returns `shared.ErrRestartRequired` if
+// any other setting changed, leaving the connections and the database untouched otherwise.
+func (srv *Server) Reload(cfg shared.Runnable) error {
+	newSrv, ok := cfg.(*Server)
+	if !ok {
+		return fmt.Errorf("Can't reload a storage server with a configuration of type '%T'", cfg)
+	}
+	if newSrv.Address != srv.Address || newSrv.DbPath != srv.DbPath ||
+		newSrv.MonitorAddress != srv.MonitorAddress {
+		return shared.ErrRestartRequired
+	}
+	srv.mu.Lock()
+	if !reflect.DeepEqual(newSrv.Journal, srv.Journal) {
+		log.Infof("Journal changed, changes are now kept for %d days", newSrv.Journal.MaxAge)
+		srv.Journal = newSrv.Journal
+		select {
+		case srv.pruneCh <- struct{}{}:
+		default:
+		}
+	}
+	srv.mu.Unlock()
+	srv.Log = newSrv.Log
+	return log.Configure("storage", srv.Log)
+}
+
+// Done returns a channel that is closed when the server fails or is stopped.
+func (srv *Server) Done() <-chan struct{} {
+	return srv.lifecycle.Done()
+}
+
+// Err returns the error that made the server fail, or nil if it didn't fail.
+func (srv *Server) Err() error {
+	return srv.lifecycle.Err()
 }
@@ -1,11 +1,17 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/matarc/filewatcher/shared"
 )
@@ -42,8 +48,8 @@ func TestRun(t *testing.T) {
 	srv := new(Server)
 	shared.LoadConfig("", srv)
 	srv.DbPath = dbPath
-	err = srv.Run()
-	defer srv.Stop()
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,7 +58,7 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer clt.Close()
-	srv.Stop()
+	srv.Stop(context.Background())
 	_, err = rpc.Dial("tcp", shared.DefaultStorageAddress)
 	if err == nil {
 		t.Fatalf("Listener should no longer be listening")
@@ -62,3 +68,179 @@ func TestRun(t *testing.T) {
 		t.Fatalf("'%s' was not created", dbPath)
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	srv := new(Server)
+	srv.Address = "localhost:18450"
+	srv.MonitorAddress = "localhost:18451"
+	srv.DbPath = filepath.Join(rootDir, "mydb")
+	shared.LoadConfig("", srv)
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt, err := rpc.Dial("tcp", srv.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	transaction := &shared.Transaction{Id: "1", Operations: []shared.Operation{
+		{Path: "my/a", Event: shared.Create},
+		{Path: "my/b", Event: shared.Create},
+	}}
+	err = clt.Call("Paths.Update", transaction, new(shared.Transaction))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get("http://localhost:18451/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(buf)
+	for _, expected := range []string{
+		`filewatcher_storage_rpc_calls_total{method="Paths.Update",status="ok"} 1`,
+		`filewatcher_storage_rpc_duration_seconds_count{method="Paths.Update"} 1`,
+		`filewatcher_storage_node_paths{node="1"} 2`,
+		"filewatcher_storage_db_size_bytes ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics should contain '%s', instead are '%s'", expected, body)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	srv := new(Server)
+	srv.Address = "localhost:18452"
+	srv.MonitorAddress = "localhost:18453"
+	srv.DbPath = filepath.Join(rootDir, "mydb")
+	shared.LoadConfig("", srv)
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		res, err := http.Get("http://localhost:18453" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Status of '%s' should be '%d', instead is '%s'", path, http.StatusOK, res.Status)
+		}
+	}
+
+	srv.db.Close()
+	res, err := http.Get("http://localhost:18453/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Status should be '%d', instead is '%s'", http.StatusServiceUnavailable, res.Status)
+	}
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), `"Name":"database","Ok":false`) {
+		t.Fatalf("The database check should fail, instead the report is '%s'", buf)
+	}
+}
+
+func TestDone(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	srv := new(Server)
+	srv.Address = "localhost:18454"
+	srv.DbPath = filepath.Join(rootDir, "mydb")
+	shared.LoadConfig("", srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = srv.Run(ctx)
+	defer srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.Done():
+		t.Fatalf("Done should not be closed while the server is running")
+	default:
+	}
+
+	// Losing the listener is fatal
+	srv.listener.Close()
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done should be closed once the listener is lost")
+	}
+	if srv.Err() == nil || !strings.HasPrefix(srv.Err().Error(), "rpc listener") {
+		t.Fatalf("Err should be an error of the rpc listener, instead is '%v'", srv.Err())
+	}
+	err = srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadJournal(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "filewatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	srv := new(Server)
+	srv.Address = "localhost:18499"
+	srv.DbPath = filepath.Join(rootDir, "mydb")
+	shared.LoadConfig("", srv)
+	err = srv.Run(context.Background())
+	defer srv.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// prunings returns true once the journal was pruned `n` times.
+	prunings := func(n int) bool {
+		expected := fmt.Sprintf(`filewatcher_storage_rpc_calls_total{method="Paths.PruneJournal",status="ok"} %d`, n)
+		for i := 0; i < 100; i++ {
+			w := httptest.NewRecorder()
+			srv.metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			if strings.Contains(w.Body.String(), expected) {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !prunings(1) {
+		t.Fatalf("The journal should be pruned once the server starts")
+	}
+	err = srv.Reload(&Server{Address: srv.Address, DbPath: srv.DbPath, Journal: &JournalConfig{MaxAge: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prunings(2) {
+		t.Fatalf("The journal should be pruned again once Journal is reloaded")
+	}
+}
@@ -0,0 +1,190 @@
+// Package trace gives requests an id that is carried from one component to the next, and records
+// how long each step of a request takes so that slow requests can be looked into.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header is the HTTP header carrying the id of a request.
+const Header = "X-Request-ID"
+
+// maxIdLength is the length above which an incoming id is replaced by a new one.
+const maxIdLength = 128
+
+// NewId returns a new random request id.
+func NewId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidId returns true if `id` can be used as a request id : it is not empty, not too long and
+// only contains letters, digits, `-`, `_`, `.` and `:`, so that it can be written in logs and
+// headers as is.
+func ValidId(id string) bool {
+	if id == "" || len(id) > maxIdLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Span is a step of a request.
+type Span struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+func (s Span) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name     string
+		Start    time.Time
+		Duration string
+	}{s.Name, s.Start, s.Duration.String()})
+}
+
+// Trace is a request identified by `Id` and the steps it went through.
+// All methods are safe for concurrent use, and can be called on a nil `Trace` in which case they
+// do nothing.
+type Trace struct {
+	Id       string
+	Name     string
+	Start    time.Time
+	mu       sync.Mutex
+	duration time.Duration
+	spans    []Span
+}
+
+// New starts the trace of the request `id`, `name` describing what the request does.
+func New(id, name string) *Trace {
+	return &Trace{Id: id, Name: name, Start: time.Now()}
+}
+
+// Span starts the step `name` and returns the function that ends it.
+func (t *Trace) Span(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, Span{Name: name, Start: start, Duration: time.Since(start)})
+	}
+}
+
+// Finish ends the trace and returns how long the request took.
+func (t *Trace) Finish() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.duration = time.Since(t.Start)
+	return t.duration
+}
+
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return json.Marshal(struct {
+		Id       string
+		Name     string
+		Start    time.Time
+		Duration string
+		Spans    []Span
+	}{t.Id, t.Name, t.Start, t.duration.String(), t.spans})
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of `ctx` carrying `t`.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the trace carried by `ctx`, or nil if there is none.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(contextKey{}).(*Trace)
+	return t
+}
+
+// IdFromContext returns the id of the trace carried by `ctx`, or an empty string if there is none.
+func IdFromContext(ctx context.Context) string {
+	if t := FromContext(ctx); t != nil {
+		return t.Id
+	}
+	return ""
+}
+
+// Recorder keeps the last finished traces so that they can be exported as json.
+// All methods are safe for concurrent use, and can be called on a nil `Recorder` in which case
+// they do nothing.
+type Recorder struct {
+	mu     sync.Mutex
+	traces []*Trace
+	next   int
+}
+
+// NewRecorder returns a `Recorder` keeping the last `size` traces.
+func NewRecorder(size int) *Recorder {
+	return &Recorder{traces: make([]*Trace, 0, size)}
+}
+
+// Record adds `t` to the recorded traces, replacing the oldest one if the recorder is full.
+func (r *Recorder) Record(t *Trace) {
+	if r == nil || t == nil || cap(r.traces) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.traces) < cap(r.traces) {
+		r.traces = append(r.traces, t)
+		return
+	}
+	r.traces[r.next] = t
+	r.next = (r.next + 1) % len(r.traces)
+}
+
+// Traces returns the recorded traces, the most recent first.
+func (r *Recorder) Traces() []*Trace {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	traces := make([]*Trace, 0, len(r.traces))
+	for i := len(r.traces) - 1; i >= 0; i-- {
+		traces = append(traces, r.traces[(r.next+i)%len(r.traces)])
+	}
+	return traces
+}
+
+// ServeHTTP writes the recorded traces as a json array, the most recent first.
+// The query parameter `id` only keeps the traces of that request.
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	traces := []*Trace{}
+	for _, t := range r.Traces() {
+		if id == "" || t.Id == id {
+			traces = append(traces, t)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traces)
+}
@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidId(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"":                       false,
+		"0123abcd":               true,
+		"web-42_a.b:c":           true,
+		"with space":             false,
+		"new\nline":              false,
+		strings.Repeat("a", 129): false,
+		strings.Repeat("a", 128): true,
+		NewId():                  true,
+	} {
+		if ValidId(id) != valid {
+			t.Fatalf("ValidId('%s') should be '%t', instead is '%t'", id, valid, !valid)
+		}
+	}
+	if NewId() == NewId() {
+		t.Fatalf("NewId should return a different id every time")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var nilTrace *Trace
+	nilTrace.Span("nothing")()
+	nilTrace.Finish()
+
+	tr := New("abc", "GET /list")
+	ctx := NewContext(context.Background(), tr)
+	if FromContext(ctx) != tr || IdFromContext(ctx) != "abc" {
+		t.Fatalf("The trace should be carried by the context")
+	}
+	if IdFromContext(context.Background()) != "" {
+		t.Fatalf("IdFromContext should be empty without a trace")
+	}
+	FromContext(ctx).Span("dial storage")()
+	tr.Finish()
+	buf, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Id    string
+		Spans []struct{ Name, Duration string }
+	}
+	err = json.Unmarshal(buf, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Id != "abc" || len(decoded.Spans) != 1 || decoded.Spans[0].Name != "dial storage" {
+		t.Fatalf("Trace should have a single span 'dial storage', instead is '%s'", buf)
+	}
+	if !strings.HasSuffix(decoded.Spans[0].Duration, "s") {
+		t.Fatalf("Duration should be readable, instead is '%s'", decoded.Spans[0].Duration)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(2)
+	for _, id := range []string{"1", "2", "3"} {
+		r.Record(New(id, "test"))
+	}
+	traces := r.Traces()
+	if len(traces) != 2 || traces[0].Id != "3" || traces[1].Id != "2" {
+		t.Fatalf("Recorder should keep traces '3' and '2', instead has %d traces", len(traces))
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/traces?id=2", nil))
+	var decoded []struct{ Id string }
+	err := json.NewDecoder(w.Body).Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].Id != "2" {
+		t.Fatalf("Only trace '2' should be sent, instead %d traces are sent", len(decoded))
+	}
+
+	var nilRecorder *Recorder
+	nilRecorder.Record(New("1", "test"))
+	if nilRecorder.Traces() != nil {
+		t.Fatalf("A nil recorder shouldn't have any trace")
+	}
+}